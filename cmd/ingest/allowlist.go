@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// The allowlist of a mailbox is stored in the "allowlist" field of mailboxes/{m}.
+// It holds exact addresses (user@domain.com) and domains (@domain.com);
+// mail from these senders never needs to be paid for.
+
+// allowlisted tells if the sender matches one of the allowlist entries
+func allowlisted(allowlist []string, sender string) bool {
+	if len(allowlist) == 0 {
+		// addrAllowed allows everything when the list is absent
+		return false
+	}
+	return addrAllowed(sender, allowlist)
+}
+
+// normalizeAllowlistEntry validates an address or @domain entry
+func normalizeAllowlistEntry(entry string) (string, error) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if strings.HasPrefix(entry, "@") {
+		if len(entry) == 1 || strings.ContainsAny(entry[1:], "@ <>") {
+			return "", fmt.Errorf("invalid allowlist domain %q", entry)
+		}
+		return entry, nil
+	}
+	addr, err := mail.ParseAddress(entry)
+	if err != nil || !strings.Contains(addr.Address, "@") {
+		return "", fmt.Errorf("invalid allowlist address %q", entry)
+	}
+	return addr.Address, nil
+}
+
+func (b firestoreBackend) Allowlist(mailbox string) ([]string, error) {
+	doc, err := b.db.Collection("mailboxes").Doc(mailbox).Get(b.ctx)
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Allowlist []string `firestore:"allowlist"`
+	}
+	err = doc.DataTo(&data)
+	return data.Allowlist, err
+}
+
+func (b firestoreBackend) SetAllowlist(mailbox string, entries []string) error {
+	_, err := b.db.Collection("mailboxes").Doc(mailbox).Update(b.ctx, []firestore.Update{{Path: "allowlist", Value: entries}})
+	return err
+}
+
+func (b firestoreBackend) AddToAllowlist(mailbox string, entries ...string) error {
+	_, err := b.db.Collection("mailboxes").Doc(mailbox).Update(b.ctx, []firestore.Update{{Path: "allowlist", Value: firestore.ArrayUnion(toInterfaces(entries)...)}})
+	return err
+}
+
+func (b firestoreBackend) RemoveFromAllowlist(mailbox string, entries ...string) error {
+	_, err := b.db.Collection("mailboxes").Doc(mailbox).Update(b.ctx, []firestore.Update{{Path: "allowlist", Value: firestore.ArrayRemove(toInterfaces(entries)...)}})
+	return err
+}
+
+func toInterfaces(list []string) []interface{} {
+	out := make([]interface{}, len(list))
+	for i, s := range list {
+		out[i] = s
+	}
+	return out
+}
+
+// allowlistHandler manages the allowlist of the mailbox of the user:
+// GET lists it, PUT replaces it, POST adds entries and DELETE removes entries.
+// Entries are posted as {"allowlist": ["user@domain.com", "@domain.com"]}.
+func (s *provisionServer) allowlistHandler(logger *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fb, mailbox, err := authorize(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var body struct {
+			Allowlist []string `json:"allowlist"`
+		}
+		if entry := mux.Vars(r)["entry"]; entry != "" {
+			body.Allowlist = []string{entry}
+		} else if r.Method != http.MethodGet {
+			if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for i, entry := range body.Allowlist {
+			if body.Allowlist[i], err = normalizeAllowlistEntry(entry); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			err = fb.SetAllowlist(mailbox, body.Allowlist)
+		case http.MethodPost:
+			err = fb.AddToAllowlist(mailbox, body.Allowlist...)
+		case http.MethodDelete:
+			err = fb.RemoveFromAllowlist(mailbox, body.Allowlist...)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if r.Method != http.MethodGet {
+			logger.Info("Updated allowlist", zap.String("mailbox", mailbox), zap.String("method", r.Method), zap.Strings("entries", body.Allowlist))
+		}
+
+		list, err := fb.Allowlist(mailbox)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if list == nil {
+			list = []string{}
+		}
+		writeJSON(w, map[string]interface{}{"allowlist": list})
+	}
+}
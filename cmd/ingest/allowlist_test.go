@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowlisted(t *testing.T) {
+	list := []string{"friend@example.org", "@q42.nl"}
+	assert.True(t, allowlisted(list, "Friend@Example.org"))
+	assert.True(t, allowlisted(list, "herman@q42.nl"))
+	assert.False(t, allowlisted(list, "herman@evilq42.nl"))
+	assert.False(t, allowlisted(list, "enemy@example.org"))
+	assert.False(t, allowlisted(nil, "friend@example.org"))
+}
+
+func TestNormalizeAllowlistEntry(t *testing.T) {
+	for in, out := range map[string]string{
+		" Friend@Example.org ":        "friend@example.org",
+		"Friend <friend@example.org>": "friend@example.org",
+		"@Q42.nl":                     "@q42.nl",
+	} {
+		entry, err := normalizeAllowlistEntry(in)
+		assert.NoError(t, err)
+		assert.Equal(t, out, entry)
+	}
+	for _, in := range []string{"", "@", "friend", "@a@b.nl", "not an address"} {
+		_, err := normalizeAllowlistEntry(in)
+		assert.Error(t, err, in)
+	}
+}
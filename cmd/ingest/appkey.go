@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/firestore"
+	"github.com/emersion/go-imap/backend"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// App keys are the device passwords of a mailbox, stored in mailboxes/{m}/appkeys.
+// Version v1 keys hold the password in plaintext in "key"; version v2 keys
+// hold an argon2id hash in "hash", encoded like
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>. A v1 key is rehashed as v2 on
+// its first successful login. Each key has a "label" naming the device and
+// records when it was "lastUsed".
+
+// appKeyParams are the argon2id parameters for new hashes
+var appKeyParams = argon2Params{memory: 19 * 1024, time: 2, threads: 1, saltLength: 16, keyLength: 32}
+
+type argon2Params struct {
+	memory     uint32
+	time       uint32
+	threads    uint8
+	saltLength int
+	keyLength  uint32
+}
+
+// AppKey is an app key without its secret, as listed to the user
+type AppKey struct {
+	ID       string     `json:"id"`
+	Label    string     `json:"label"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+// maxAppKeyLabel bounds the length of labels
+const maxAppKeyLabel = 100
+
+// normalizeAppKeyLabel validates a label
+func normalizeAppKeyLabel(label string) (string, error) {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return "", errors.New("label can not be empty")
+	}
+	if utf8.RuneCountInString(label) > maxAppKeyLabel {
+		return "", fmt.Errorf("label can not be longer than %d characters", maxAppKeyLabel)
+	}
+	return label, nil
+}
+
+// hashAppKey hashes the password with argon2id and a random salt
+func hashAppKey(password string, p argon2Params) (string, error) {
+	salt := make([]byte, p.saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// verifyAppKeyHash tells if the password matches the encoded argon2id hash
+func verifyAppKeyHash(encoded, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errors.New("unsupported app key hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errors.New("unsupported argon2 version")
+	}
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return false, errors.Wrap(err, "invalid argon2 parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errors.Wrap(err, "invalid argon2 salt")
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errors.Wrap(err, "invalid argon2 hash")
+	}
+	actual := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, actual) == 1, nil
+}
+
+// matchAppKey tells if the password matches the app key document, and if
+// the key is stored in an outdated version
+func matchAppKey(data map[string]interface{}, password string) (match, outdated bool) {
+	switch data["version"] {
+	case "v1":
+		key, _ := data["key"].(string)
+		return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(password)) == 1, true
+	case "v2":
+		hash, _ := data["hash"].(string)
+		ok, err := verifyAppKeyHash(hash, password)
+		if err != nil {
+			zap.L().Warn("Invalid app key hash", zap.Error(err))
+		}
+		return ok, false
+	}
+	return false, false
+}
+
+// AddAppKey stores a new app key for the device with the label
+func (b firestoreBackend) AddAppKey(mail string, key string, label string) (err error) {
+	hash, err := hashAppKey(key, appKeyParams)
+	if err != nil {
+		return err
+	}
+	_, _, err = b.db.Collection("mailboxes").Doc(mail).Collection("appkeys").Add(b.ctx, map[string]interface{}{
+		"hash":    hash,
+		"label":   label,
+		"date":    time.Now(),
+		"version": "v2",
+	})
+	return err
+}
+
+// CheckAppKey verifies the password against the app keys of the mailbox and
+// returns the id of the matching key, or an empty id when none matches
+func (b firestoreBackend) CheckAppKey(mail string, password string) (id string, err error) {
+	it := b.db.Collection("mailboxes").Doc(mail).Collection("appkeys").Documents(b.ctx)
+	defer it.Stop()
+	for {
+		doc, err := it.Next()
+		if err == iterator.Done {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		match, outdated := matchAppKey(doc.Data(), password)
+		if !match {
+			continue
+		}
+
+		updates := []firestore.Update{{Path: "lastUsed", Value: time.Now()}}
+		if outdated {
+			hash, err := hashAppKey(password, appKeyParams)
+			if err != nil {
+				return "", err
+			}
+			updates = append(updates,
+				firestore.Update{Path: "hash", Value: hash},
+				firestore.Update{Path: "version", Value: "v2"},
+				firestore.Update{Path: "key", Value: firestore.Delete},
+			)
+		}
+		if _, err = doc.Ref.Update(b.ctx, updates); err != nil {
+			// The login itself is valid, bookkeeping is retried on the next login
+			zap.L().Warn("Failed to update app key", zap.String("mailbox", mail), zap.String("key", doc.Ref.ID), zap.Error(err))
+		}
+		return doc.Ref.ID, nil
+	}
+}
+
+// AppKeys lists the app keys of the mailbox, oldest first
+func (b firestoreBackend) AppKeys(mail string) ([]AppKey, error) {
+	docs, err := b.db.Collection("mailboxes").Doc(mail).Collection("appkeys").OrderBy("date", firestore.Asc).Documents(b.ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]AppKey, 0, len(docs))
+	for _, doc := range docs {
+		var data struct {
+			Label    string     `firestore:"label"`
+			Date     time.Time  `firestore:"date"`
+			LastUsed *time.Time `firestore:"lastUsed"`
+		}
+		if err = doc.DataTo(&data); err != nil {
+			return nil, err
+		}
+		keys = append(keys, AppKey{ID: doc.Ref.ID, Label: data.Label, Created: data.Date, LastUsed: data.LastUsed})
+	}
+	return keys, nil
+}
+
+// RenameAppKey changes the label of an app key
+func (b firestoreBackend) RenameAppKey(mail, id, label string) error {
+	_, err := b.db.Collection("mailboxes").Doc(mail).Collection("appkeys").Doc(id).Update(b.ctx, []firestore.Update{{Path: "label", Value: label}})
+	return err
+}
+
+// RevokeAppKey deletes an app key, so it can no longer be used to log in
+func (b firestoreBackend) RevokeAppKey(mail, id string) error {
+	_, err := b.db.Collection("mailboxes").Doc(mail).Collection("appkeys").Doc(id).Delete(b.ctx, firestore.Exists)
+	return err
+}
+
+// AppKeyExists tells if the app key was not revoked
+func (b firestoreBackend) AppKeyExists(mail, id string) (bool, error) {
+	_, err := b.db.Collection("mailboxes").Doc(mail).Collection("appkeys").Doc(id).Get(b.ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// appKeysHandler manages the app keys of the mailbox of the user:
+// GET /api/appkeys lists them, PUT /api/appkeys/{id} with {"label": "..."}
+// renames one and DELETE /api/appkeys/{id} revokes one, ending its IMAP sessions
+// here at once and on other replicas within -auth_cache_ttl.
+// All respond with the remaining keys as {"appkeys": [...]}.
+func (s *provisionServer) appKeysHandler(logger *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fb, mailbox, err := authorize(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		switch r.Method {
+		case http.MethodPut:
+			var body struct {
+				Label string `json:"label"`
+			}
+			if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if body.Label, err = normalizeAppKeyLabel(body.Label); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = fb.RenameAppKey(mailbox, id, body.Label)
+		case http.MethodDelete:
+			if err = fb.RevokeAppKey(mailbox, id); err == nil {
+				if s.auth != nil {
+					s.auth.Forget(mailbox, id)
+				}
+				ended := appKeySessions.revoke(mailbox, id)
+				logger.Info("Revoked app key", zap.String("mailbox", mailbox), zap.String("key", id), zap.Int("sessions", ended))
+			}
+		}
+		if status.Code(err) == codes.NotFound {
+			http.Error(w, "app key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		keys, err := fb.AppKeys(mailbox)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"appkeys": keys})
+	}
+}
+
+// appKeySessions are the live IMAP sessions of this process per app key
+var appKeySessions = newSessionRegistry()
+
+// sessionRegistry tracks the live sessions per app key, so revoking the key ends them
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[appKeyRef]map[io.Closer]struct{}
+}
+
+type appKeyRef struct {
+	mailbox, id string
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[appKeyRef]map[io.Closer]struct{})}
+}
+
+// add registers a session that logged in with the key; remove is called when it ends
+func (r *sessionRegistry) add(mailbox, id string, session io.Closer) (remove func()) {
+	key := appKeyRef{mailbox, id}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[key] == nil {
+		r.sessions[key] = make(map[io.Closer]struct{})
+	}
+	r.sessions[key][session] = struct{}{}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.sessions[key], session)
+		if len(r.sessions[key]) == 0 {
+			delete(r.sessions, key)
+		}
+	}
+}
+
+// revoke closes the sessions of the key and returns how many there were
+func (r *sessionRegistry) revoke(mailbox, id string) int {
+	key := appKeyRef{mailbox, id}
+	r.mu.Lock()
+	sessions := r.sessions[key]
+	delete(r.sessions, key)
+	r.mu.Unlock()
+	// Closing logs the user out, which calls remove, so not under the lock
+	for session := range sessions {
+		session.Close()
+	}
+	return len(sessions)
+}
+
+// keys lists the app keys that have live sessions
+func (r *sessionRegistry) keys() []appKeyRef {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]appKeyRef, 0, len(r.sessions))
+	for key := range r.sessions {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// endRevoked ends the sessions of app keys that no longer exist, as those
+// revoked on another replica are only ended there. It returns how many
+// sessions it ended.
+func (a *authService) endRevoked(sessions *sessionRegistry) (ended int) {
+	for _, key := range sessions.keys() {
+		exists, err := a.keys.AppKeyExists(key.mailbox, key.id)
+		if err != nil {
+			a.logger.Warn("Failed to check app key", zap.String("mailbox", key.mailbox), zap.String("key", key.id), zap.Error(err))
+			continue
+		}
+		if !exists {
+			a.Forget(key.mailbox, key.id)
+			n := sessions.revoke(key.mailbox, key.id)
+			a.logger.Info("Ended the sessions of a revoked app key", zap.String("mailbox", key.mailbox), zap.String("key", key.id), zap.Int("sessions", n))
+			ended += n
+		}
+	}
+	return ended
+}
+
+// watchRevoked runs endRevoked every interval until ctx is done
+func (a *authService) watchRevoked(ctx context.Context, sessions *sessionRegistry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.endRevoked(sessions)
+		}
+	}
+}
+
+// revocableUser is a user logged in with an app key, which is forgotten on logout
+type revocableUser struct {
+	backend.User
+	remove func()
+}
+
+func (u *revocableUser) Logout() error {
+	u.remove()
+	return u.User.Logout()
+}
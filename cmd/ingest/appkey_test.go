@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashAppKey(t *testing.T) {
+	hash, err := hashAppKey("secret", appKeyParams)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"), hash)
+
+	ok, err := verifyAppKeyHash(hash, "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = verifyAppKeyHash(hash, "Secret")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Salted, so equal passwords have different hashes
+	other, _ := hashAppKey("secret", appKeyParams)
+	assert.NotEqual(t, hash, other)
+
+	// Hashes with other parameters still verify
+	weak, _ := hashAppKey("secret", argon2Params{memory: 1024, time: 1, threads: 1, saltLength: 8, keyLength: 16})
+	ok, err = verifyAppKeyHash(weak, "secret")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	for _, invalid := range []string{"", "secret", "$bcrypt$x", "$argon2id$v=16$m=1,t=1,p=1$AAAA$AAAA", "$argon2id$v=19$m=1,t=1,p=1$!!$AAAA"} {
+		_, err = verifyAppKeyHash(invalid, "secret")
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMatchAppKey(t *testing.T) {
+	hash, _ := hashAppKey("secret", appKeyParams)
+	for _, tc := range []struct {
+		name     string
+		data     map[string]interface{}
+		match    bool
+		outdated bool
+	}{
+		{"v1", map[string]interface{}{"version": "v1", "key": "secret"}, true, true},
+		{"v1 wrong", map[string]interface{}{"version": "v1", "key": "other"}, false, true},
+		{"v1 empty", map[string]interface{}{"version": "v1"}, false, true},
+		{"v2", map[string]interface{}{"version": "v2", "hash": hash}, true, false},
+		{"v2 plaintext", map[string]interface{}{"version": "v2", "key": "secret"}, false, false},
+		{"unknown", map[string]interface{}{"key": "secret"}, false, false},
+	} {
+		match, outdated := matchAppKey(tc.data, "secret")
+		assert.Equal(t, tc.match, match, tc.name)
+		assert.Equal(t, tc.outdated, outdated, tc.name)
+	}
+}
+
+type closeCounter struct{ closed int }
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestSessionRegistry(t *testing.T) {
+	r := newSessionRegistry()
+	phone, laptop, other := &closeCounter{}, &closeCounter{}, &closeCounter{}
+	r.add("herman@example.org", "phone", phone)
+	removeLaptop := r.add("herman@example.org", "laptop", laptop)
+	r.add("other@example.org", "phone", other)
+
+	// Sessions that logged out are not closed again
+	removeLaptop()
+	assert.Equal(t, 0, r.revoke("herman@example.org", "laptop"))
+
+	assert.Equal(t, 1, r.revoke("herman@example.org", "phone"))
+	assert.Equal(t, 1, phone.closed)
+	assert.Equal(t, 0, laptop.closed)
+	assert.Equal(t, 0, other.closed)
+	assert.Equal(t, 0, r.revoke("herman@example.org", "phone"))
+}
+
+func TestEndRevoked(t *testing.T) {
+	keys := &fakeAppKeys{keys: map[string]string{"herman@example.org/secret": "phone", "herman@example.org/other": "laptop"}}
+	a, _ := newTestAuthService(keys)
+	r := newSessionRegistry()
+	phone, laptop := &closeCounter{}, &closeCounter{}
+	r.add("herman@example.org", "phone", phone)
+	r.add("herman@example.org", "laptop", laptop)
+	ip := net.ParseIP("192.0.2.1")
+	_, err := a.Authenticate("herman@example.org", "secret", ip)
+	assert.NoError(t, err)
+
+	// Revoked on another replica
+	delete(keys.keys, "herman@example.org/secret")
+	assert.Equal(t, 1, a.endRevoked(r))
+	assert.Equal(t, 1, phone.closed)
+	assert.Equal(t, 0, laptop.closed)
+	_, err = a.Authenticate("herman@example.org", "secret", ip)
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials, "the cached login is forgotten")
+
+	// Sessions are kept when the keys cannot be checked
+	keys.err = errors.New("unavailable")
+	assert.Equal(t, 0, a.endRevoked(r))
+	assert.Equal(t, 0, laptop.closed)
+}
+
+func TestNormalizeAppKeyLabel(t *testing.T) {
+	label, err := normalizeAppKeyLabel("  iPhone ")
+	assert.NoError(t, err)
+	assert.Equal(t, "iPhone", label)
+
+	_, err = normalizeAppKeyLabel(" ")
+	assert.Error(t, err)
+	_, err = normalizeAppKeyLabel(strings.Repeat("é", maxAppKeyLabel+1))
+	assert.Error(t, err)
+}
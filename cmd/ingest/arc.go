@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/pkg/errors"
+)
+
+// ARC (RFC 8617) lets receivers of mail we forward see how it was
+// authenticated when it reached us, as forwarding breaks SPF and often DKIM.
+
+// arcMaxInstance is the highest allowed instance of an ARC set (RFC 8617 §4.2.1)
+const arcMaxInstance = 50
+
+// arcSignedHeaders are signed by the ARC-Message-Signature when present
+var arcSignedHeaders = []string{"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding", "DKIM-Signature"}
+
+type arcSet struct {
+	aar, ams, seal string
+}
+
+// arcChain is the ARC chain of a message, sets[0] being instance 1
+type arcChain struct {
+	sets   []arcSet
+	result authres.ResultValue
+}
+
+// arcSeal adds an ARC set to the mail, attesting the authentication results we
+// recorded when the mail arrived and the results passed in. Mail that never
+// reached us from outside or that carries a chain someone else already
+// declared broken is returned as is.
+func arcSeal(ctx context.Context, dns resolver, opts *dkim.SignOptions, identity string, data []byte, now time.Time, extra ...authres.Result) ([]byte, error) {
+	fields, body := splitMessage(data)
+	chain := verifyARC(ctx, dns, fields, body)
+	results := ownResults(fields, identity)
+	if len(chain.sets) == 0 && len(results) == 0 {
+		return data, nil
+	}
+	if n := len(chain.sets); n >= arcMaxInstance || n > 0 && tagValue(chain.sets[n-1].seal, "cv") == string(authres.ResultFail) {
+		return data, nil
+	}
+
+	algo, err := arcAlgorithm(opts.Signer)
+	if err != nil {
+		return nil, err
+	}
+	instance := len(chain.sets) + 1
+	results = append(results, &authres.GenericResult{Method: "arc", Value: chain.result})
+	results = append(results, extra...)
+	aar := fmt.Sprintf("ARC-Authentication-Results: i=%d; %s\r\n", instance, authres.Format(identity, results))
+
+	var signed []string
+	for _, key := range arcSignedHeaders {
+		for _, field := range fields {
+			if strings.EqualFold(fieldName(field), key) {
+				signed = append(signed, key)
+				break
+			}
+		}
+	}
+	bh := sha256.Sum256(canonicalBody(body, false))
+	ams := fmt.Sprintf("ARC-Message-Signature: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		instance, algo, opts.Domain, opts.Selector, now.Unix(), strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+	sig, err := arcSign(opts.Signer, messageSigningInput(fields, signed, ams, false))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign ARC-Message-Signature")
+	}
+	ams += foldSignature(sig) + "\r\n"
+
+	seal := fmt.Sprintf("ARC-Seal: i=%d; a=%s; t=%d; cv=%s; d=%s; s=%s; b=", instance, algo, now.Unix(), chain.result, opts.Domain, opts.Selector)
+	sets := append(chain.sets, arcSet{aar: aar, ams: ams, seal: seal})
+	sig, err = arcSign(opts.Signer, sealSigningInput(sets))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign ARC-Seal")
+	}
+	seal += foldSignature(sig) + "\r\n"
+
+	out := make([]byte, 0, len(seal)+len(ams)+len(aar)+len(data))
+	out = append(out, seal...)
+	out = append(out, ams...)
+	out = append(out, aar...)
+	return append(out, data...), nil
+}
+
+// verifyARC validates the ARC chain of a message (RFC 8617 §5.2)
+func verifyARC(ctx context.Context, dns resolver, fields []string, body []byte) arcChain {
+	var sets []arcSet
+	fail := func() arcChain { return arcChain{sets: sets, result: authres.ResultFail} }
+	for _, field := range fields {
+		name := strings.ToLower(fieldName(field))
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+		i, err := arcInstance(field)
+		if err != nil || i < 1 || i > arcMaxInstance {
+			return fail()
+		}
+		for len(sets) < i {
+			sets = append(sets, arcSet{})
+		}
+		set := &sets[i-1]
+		var slot *string
+		switch name {
+		case "arc-seal":
+			slot = &set.seal
+		case "arc-message-signature":
+			slot = &set.ams
+		default:
+			slot = &set.aar
+		}
+		if *slot != "" {
+			return fail()
+		}
+		*slot = field
+	}
+	if len(sets) == 0 {
+		return arcChain{result: authres.ResultNone}
+	}
+
+	for i, set := range sets {
+		if set.seal == "" || set.ams == "" || set.aar == "" {
+			return fail()
+		}
+		cv := tagValue(set.seal, "cv")
+		if i == 0 && cv != string(authres.ResultNone) || i > 0 && cv != string(authres.ResultPass) {
+			return fail()
+		}
+	}
+	if err := verifyMessageSignature(ctx, dns, fields, body, sets[len(sets)-1].ams); err != nil {
+		return fail()
+	}
+	for i := len(sets); i > 0; i-- {
+		seal := parseTags(fieldValue(sets[i-1].seal))
+		if err := arcVerify(ctx, dns, seal, sealSigningInput(sets[:i])); err != nil {
+			return fail()
+		}
+	}
+	return arcChain{sets: sets, result: authres.ResultPass}
+}
+
+func verifyMessageSignature(ctx context.Context, dns resolver, fields []string, body []byte, ams string) error {
+	tags := parseTags(fieldValue(ams))
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	bh := sha256.Sum256(canonicalBody(body, bodyCanon == "simple"))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("arc: body hash mismatch")
+	}
+	signed := strings.Split(tags["h"], ":")
+	for i := range signed {
+		signed[i] = strings.TrimSpace(signed[i])
+	}
+	return arcVerify(ctx, dns, tags, messageSigningInput(fields, signed, strings.TrimRight(ams, "\r\n"), headerCanon == "simple"))
+}
+
+// messageSigningInput is the signed data of a message signature: the signed
+// headers picked bottom-up and then the signature header without its signature
+func messageSigningInput(fields []string, signed []string, sigField string, simple bool) []byte {
+	used := make([]bool, len(fields))
+	var out bytes.Buffer
+	for _, name := range signed {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				out.WriteString(canonicalHeader(fields[i], simple))
+				break
+			}
+		}
+	}
+	out.WriteString(strings.TrimRight(canonicalHeader(stripSignature(sigField), simple), "\r\n"))
+	return out.Bytes()
+}
+
+// sealSigningInput is the signed data of the ARC-Seal of the last set
+func sealSigningInput(sets []arcSet) []byte {
+	var out bytes.Buffer
+	for i, set := range sets {
+		out.WriteString(canonicalHeader(set.aar, false))
+		out.WriteString(canonicalHeader(set.ams, false))
+		if i < len(sets)-1 {
+			out.WriteString(canonicalHeader(set.seal, false))
+		} else {
+			out.WriteString(strings.TrimRight(canonicalHeader(stripSignature(set.seal), false), "\r\n"))
+		}
+	}
+	return out.Bytes()
+}
+
+func arcAlgorithm(signer crypto.Signer) (string, error) {
+	if signer == nil {
+		return "", errors.New("arc: no signing key")
+	}
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("arc: unsupported key type %T", signer.Public())
+}
+
+func arcSign(signer crypto.Signer, data []byte) (string, error) {
+	hash := sha256.Sum256(data)
+	opts := crypto.SignerOpts(crypto.SHA256)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	}
+	sig, err := signer.Sign(rand.Reader, hash[:], opts)
+	return base64.StdEncoding.EncodeToString(sig), err
+}
+
+func arcVerify(ctx context.Context, dns resolver, tags map[string]string, data []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return errors.Wrap(err, "arc: malformed signature")
+	}
+	key, err := lookupDKIMKey(ctx, dns, tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	switch tags["a"] {
+	case "rsa-sha256":
+		if pub, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig)
+		}
+	case "ed25519-sha256":
+		if pub, ok := key.(ed25519.PublicKey); ok {
+			if !ed25519.Verify(pub, hash[:], sig) {
+				return errors.New("arc: invalid signature")
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("arc: unsupported algorithm %q", tags["a"])
+	}
+	return fmt.Errorf("arc: key of %s does not match algorithm %q", tags["d"], tags["a"])
+}
+
+// lookupDKIMKey fetches the public key of the selector of the domain (RFC 6376 §3.6.2)
+func lookupDKIMKey(ctx context.Context, dns resolver, selector, domain string) (crypto.PublicKey, error) {
+	if selector == "" || domain == "" {
+		return nil, errors.New("arc: missing selector or domain")
+	}
+	txts, err := dns.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	}
+	tags := parseTags(strings.Join(txts, ""))
+	p, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(p) == 0 {
+		return nil, fmt.Errorf("arc: no valid key for %s._domainkey.%s", selector, domain)
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(p); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(p)
+	case "ed25519":
+		if len(p) != ed25519.PublicKeySize {
+			return nil, errors.New("arc: malformed ed25519 key")
+		}
+		return ed25519.PublicKey(p), nil
+	}
+	return nil, fmt.Errorf("arc: unsupported key type %q", tags["k"])
+}
+
+// ownResults are the results of the Authentication-Results headers we added
+func ownResults(fields []string, identity string) (results []authres.Result) {
+	for _, field := range fields {
+		if !strings.EqualFold(fieldName(field), "Authentication-Results") {
+			continue
+		}
+		id, res, err := authres.Parse(strings.TrimSpace(fieldValue(field)))
+		if err == nil && strings.EqualFold(id, identity) {
+			results = append(results, res...)
+		}
+	}
+	return results
+}
+
+// splitMessage returns the (unfolded) header fields including line endings and the body
+func splitMessage(data []byte) (fields []string, body []byte) {
+	for rest := data; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+		switch {
+		case len(bytes.TrimRight(line, "\r\n")) == 0:
+			return fields, rest
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) > 0:
+			fields[len(fields)-1] += string(line)
+		default:
+			fields = append(fields, string(line))
+		}
+	}
+	return fields, nil
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.TrimSpace(name)
+}
+
+func fieldValue(field string) string {
+	_, value, _ := strings.Cut(field, ":")
+	return value
+}
+
+// arcInstance is the i= tag of an ARC header
+func arcInstance(field string) (int, error) {
+	value := fieldValue(field)
+	if strings.EqualFold(fieldName(field), "ARC-Authentication-Results") {
+		value, _, _ = strings.Cut(value, ";")
+	}
+	return strconv.Atoi(parseTags(value)["i"])
+}
+
+// parseTags parses a tag=value list (RFC 6376 §3.2), dropping whitespace
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(value), "")
+	}
+	return tags
+}
+
+func tagValue(field, tag string) string {
+	return parseTags(fieldValue(field))[tag]
+}
+
+// stripSignature empties the b= tag of a signature header
+func stripSignature(field string) string {
+	name, value, _ := strings.Cut(field, ":")
+	tags := strings.Split(value, ";")
+	for i, tag := range tags {
+		if tagName, _, ok := strings.Cut(tag, "="); ok && strings.TrimSpace(tagName) == "b" {
+			tags[i] = tagName + "="
+		}
+	}
+	return name + ":" + strings.Join(tags, ";")
+}
+
+func canonicalHeader(field string, simple bool) string {
+	if simple {
+		return field
+	}
+	name, value, _ := strings.Cut(field, ":")
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ") + "\r\n"
+}
+
+func canonicalBody(body []byte, simple bool) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	if !simple {
+		for i := range lines {
+			lines[i] = strings.TrimRight(compressWSP(lines[i]), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if simple {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// compressWSP reduces every sequence of spaces and tabs to a single space
+func compressWSP(s string) string {
+	var out strings.Builder
+	space := false
+	for _, c := range s {
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			out.WriteByte(' ')
+			space = false
+		}
+		out.WriteRune(c)
+	}
+	if space {
+		out.WriteByte(' ')
+	}
+	return out.String()
+}
+
+// foldSignature breaks a base64 signature over multiple lines
+func foldSignature(sig string) string {
+	var out strings.Builder
+	for len(sig) > 72 {
+		out.WriteString(sig[:72] + "\r\n\t")
+		sig = sig[72:]
+	}
+	out.WriteString(sig)
+	return out.String()
+}
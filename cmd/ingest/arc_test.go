@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/assert"
+)
+
+// arcKey generates a key for the domain and publishes it in dns
+func arcKey(t *testing.T, dns fakeResolver, domain string) *dkim.SignOptions {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	dns.txt["arc._domainkey."+domain] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}
+	return &dkim.SignOptions{Domain: domain, Selector: "arc", Signer: key}
+}
+
+func TestArcSeal(t *testing.T) {
+	ctx := context.Background()
+	dns := fakeResolver{txt: map[string][]string{}}
+	first, second := arcKey(t, dns, "example.net"), arcKey(t, dns, "forwarder.example")
+	mail := []byte("Authentication-Results: mx.example.net; spf=pass smtp.mailfrom=example.org; dmarc=pass header.from=example.org\r\n" +
+		"From: Sender <a@example.org>\r\nTo: b@example.net\r\nSubject:  Folded\r\n\tsubject\r\n\r\nHello  there \r\n\r\n")
+	verify := func(data []byte) arcChain {
+		fields, body := splitMessage(data)
+		return verifyARC(ctx, dns, fields, body)
+	}
+	auth := &authres.AuthResult{Value: authres.ResultPass, Auth: "b@example.net"}
+
+	// Without anything to attest there is nothing to seal
+	plain := []byte("From: b@example.net\r\n\r\nHi\r\n")
+	out, err := arcSeal(ctx, dns, first, "mx.example.net", plain, time.Now(), auth)
+	assert.NoError(t, err)
+	assert.Equal(t, plain, out)
+	assert.Equal(t, authres.ResultValue(authres.ResultNone), verify(plain).result)
+
+	sealed, err := arcSeal(ctx, dns, first, "mx.example.net", mail, time.Now(), auth)
+	assert.NoError(t, err)
+	chain := verify(sealed)
+	assert.Equal(t, authres.ResultValue(authres.ResultPass), chain.result)
+	assert.Len(t, chain.sets, 1)
+	assert.Equal(t, "none", tagValue(chain.sets[0].seal, "cv"))
+	assert.Contains(t, chain.sets[0].aar, "i=1; mx.example.net; spf=pass smtp.mailfrom=example.org; dmarc=pass header.from=example.org; arc=none")
+	assert.Contains(t, chain.sets[0].aar, "auth=pass smtp.auth=b@example.net")
+
+	resealed, err := arcSeal(ctx, dns, second, "mx.forwarder.example", sealed, time.Now())
+	assert.NoError(t, err)
+	chain = verify(resealed)
+	assert.Equal(t, authres.ResultValue(authres.ResultPass), chain.result)
+	assert.Len(t, chain.sets, 2)
+	assert.Equal(t, "pass", tagValue(chain.sets[1].seal, "cv"))
+
+	// Modifying the body breaks the chain, which the next sealer records once
+	tampered := bytes.Replace(resealed, []byte("Hello"), []byte("Bye"), 1)
+	assert.Equal(t, authres.ResultValue(authres.ResultFail), verify(tampered).result)
+	failed, err := arcSeal(ctx, dns, first, "mx.example.net", tampered, time.Now())
+	assert.NoError(t, err)
+	chain = verify(failed)
+	assert.Len(t, chain.sets, 3)
+	assert.Equal(t, "fail", tagValue(chain.sets[2].seal, "cv"))
+	out, err = arcSeal(ctx, dns, first, "mx.example.net", failed, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, failed, out)
+}
+
+func TestVerifyMessageSignatureOfDKIM(t *testing.T) {
+	// DKIM-Signature shares its format and canonicalization with ARC-Message-Signature
+	dns := fakeResolver{txt: map[string][]string{}}
+	opts := arcKey(t, dns, "example.org")
+	for _, canon := range []dkim.Canonicalization{dkim.CanonicalizationRelaxed, dkim.CanonicalizationSimple} {
+		opts.HeaderCanonicalization, opts.BodyCanonicalization = canon, canon
+		var signed bytes.Buffer
+		msg := "From: a@example.org\r\nTo:  b@example.net\r\nSubject: Folded\r\n subject\r\n\r\nHello \t there  \r\n\r\n"
+		assert.NoError(t, dkim.Sign(&signed, strings.NewReader(msg), opts))
+
+		fields, body := splitMessage(signed.Bytes())
+		assert.NoError(t, verifyMessageSignature(context.Background(), dns, fields, body, fields[0]), canon)
+	}
+}
+
+func TestCanonicalBody(t *testing.T) {
+	// RFC 6376 §3.4.6
+	body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+	assert.Equal(t, " C\r\nD E\r\n", string(canonicalBody(body, false)))
+	assert.Equal(t, " C \r\nD \t E\r\n", string(canonicalBody(body, true)))
+	assert.Equal(t, "", string(canonicalBody(nil, false)))
+	assert.Equal(t, "\r\n", string(canonicalBody(nil, true)))
+}
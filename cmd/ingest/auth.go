@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+// The auth service checks the logins of SMTP and IMAP against the app keys.
+// Verified credentials are cached for a short time, so clients that log in
+// for every command do not hash and query Firestore each time. Failed logins
+// are counted per IP and per username; too many within the lockout period
+// lock the IP or username out until the period has passed. OAuth logins
+// are checked the same way, with their ID token instead of an app key.
+// The keys of live IMAP sessions are checked again after the cache period,
+// so a key revoked on one replica also ends its sessions on the others.
+
+var errLockedOut = errors.New("too many failed logins, try again later")
+
+// authBackend verifies passwords, returning the id of the matching key, tells
+// if a key still exists and finds the mailbox of the user of an ID token
+type authBackend interface {
+	CheckAppKey(mail, password string) (id string, err error)
+	AppKeyExists(mail, id string) (bool, error)
+	FindUser(webLogin string) (mail string, err error)
+}
+
+type authService struct {
+	keys   authBackend
+	logger *zap.Logger
+	// tokens verifies ID tokens, nil when OAuth logins are disabled
+	tokens *tokenVerifier
+	// ttl is how long verified credentials are cached
+	ttl time.Duration
+	// lockout is both the period failures are counted in and how long a lockout lasts
+	lockout       time.Duration
+	maxFailures   int
+	maxIPFailures int
+	now           func() time.Time
+	lastPrune     time.Time
+	mu            sync.Mutex
+	cache         map[[sha256.Size]byte]cachedLogin
+	failures      map[string]*failureCount
+}
+
+type cachedLogin struct {
+	username string
+	keyID    string
+	expires  time.Time
+}
+
+type failureCount struct {
+	count       int
+	since       time.Time
+	lockedUntil time.Time
+}
+
+func newAuthService(logger *zap.Logger, keys authBackend) *authService {
+	return &authService{
+		keys:          keys,
+		logger:        logger,
+		tokens:        newTokenVerifier(logger.Named("oauth")),
+		ttl:           *authCacheTTL,
+		lockout:       *authLockout,
+		maxFailures:   *authMaxFailures,
+		maxIPFailures: *authMaxIPFailures,
+		now:           time.Now,
+		cache:         make(map[[sha256.Size]byte]cachedLogin),
+		failures:      make(map[string]*failureCount),
+	}
+}
+
+// Authenticate checks the credentials of a client at ip and returns the id of
+// the app key. It returns backend.ErrInvalidCredentials for wrong credentials
+// and errLockedOut while the ip or username is locked out.
+func (a *authService) Authenticate(username, password string, ip net.IP) (string, error) {
+	now := a.now()
+	ipKey, userKey := "ip:"+ip.String(), "user:"+username
+	cacheKey := sha256.Sum256([]byte(username + "\x00" + password))
+
+	a.mu.Lock()
+	if a.lockedOut(ipKey, now) || a.lockedOut(userKey, now) {
+		a.mu.Unlock()
+		a.logger.Warn("Login while locked out", zap.String("username", username), zap.Stringer("ip", ip))
+		return "", errLockedOut
+	}
+	if login, ok := a.cache[cacheKey]; ok && now.Before(login.expires) {
+		a.mu.Unlock()
+		return login.keyID, nil
+	}
+	a.mu.Unlock()
+
+	id, err := a.keys.CheckAppKey(username, password)
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune(now)
+	if id == "" {
+		a.fail(ipKey, a.maxIPFailures, now)
+		a.fail(userKey, a.maxFailures, now)
+		a.logger.Warn("Login failed", zap.String("username", username), zap.Stringer("ip", ip))
+		return "", backend.ErrInvalidCredentials
+	}
+	delete(a.failures, userKey)
+	a.cache[cacheKey] = cachedLogin{username: username, keyID: id, expires: now.Add(a.ttl)}
+	a.logger.Info("Logged in", zap.String("username", username), zap.Stringer("ip", ip))
+	return id, nil
+}
+
+// AuthenticateToken checks the ID token of a client at ip and returns the
+// mailbox of its user. The username is optional, but must be that mailbox
+// when given. Errors are those of Authenticate.
+func (a *authService) AuthenticateToken(username, token string, ip net.IP) (string, error) {
+	if a.tokens == nil {
+		return "", backend.ErrInvalidCredentials
+	}
+	now := a.now()
+	ipKey := "ip:" + ip.String()
+	cacheKey := sha256.Sum256([]byte("\x00bearer\x00" + token))
+
+	a.mu.Lock()
+	if a.lockedOut(ipKey, now) {
+		a.mu.Unlock()
+		a.logger.Warn("Login while locked out", zap.String("username", username), zap.Stringer("ip", ip))
+		return "", errLockedOut
+	}
+	login, cached := a.cache[cacheKey]
+	cached = cached && now.Before(login.expires)
+	a.mu.Unlock()
+
+	if !cached {
+		var err error
+		login, err = a.tokenLogin(token)
+		if errors.Is(err, errInvalidToken) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.fail(ipKey, a.maxIPFailures, now)
+			a.logger.Warn("OAuth login failed", zap.String("username", username), zap.Stringer("ip", ip), zap.Error(err))
+			return "", backend.ErrInvalidCredentials
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prune(now)
+	if username != "" && !strings.EqualFold(username, login.username) {
+		a.fail(ipKey, a.maxIPFailures, now)
+		a.logger.Warn("OAuth login for another mailbox", zap.String("username", username), zap.String("mailbox", login.username), zap.Stringer("ip", ip))
+		return "", backend.ErrInvalidCredentials
+	}
+	if !cached {
+		if expires := now.Add(a.ttl); expires.Before(login.expires) {
+			login.expires = expires
+		}
+		a.cache[cacheKey] = login
+		a.logger.Info("Logged in with OAuth", zap.String("username", login.username), zap.Stringer("ip", ip))
+	}
+	return login.username, nil
+}
+
+// tokenLogin verifies the ID token and finds the mailbox of its email
+func (a *authService) tokenLogin(token string) (cachedLogin, error) {
+	claims, err := a.tokens.Verify(context.Background(), token)
+	if err != nil {
+		return cachedLogin{}, err
+	}
+	mailbox, err := a.keys.FindUser(claims.Email)
+	if err == iterator.Done {
+		return cachedLogin{}, errors.Wrapf(errInvalidToken, "no mailbox for %s", claims.Email)
+	}
+	return cachedLogin{username: mailbox, expires: unixTime(claims.Expires)}, err
+}
+
+// Forget drops the cached logins of a revoked app key
+func (a *authService) Forget(username, keyID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, login := range a.cache {
+		if login.username == username && login.keyID == keyID {
+			delete(a.cache, k)
+		}
+	}
+}
+
+func (a *authService) lockedOut(key string, now time.Time) bool {
+	f := a.failures[key]
+	return f != nil && now.Before(f.lockedUntil)
+}
+
+// fail counts a failure, locking out after max failures in the lockout period
+func (a *authService) fail(key string, max int, now time.Time) {
+	f := a.failures[key]
+	if f == nil || now.Sub(f.since) >= a.lockout {
+		f = &failureCount{since: now}
+		a.failures[key] = f
+	}
+	f.count++
+	if f.count >= max {
+		f.lockedUntil = now.Add(a.lockout)
+		f.count, f.since = 0, now
+		a.logger.Warn("Locked out after failed logins", zap.String("key", key), zap.Time("until", f.lockedUntil))
+	}
+}
+
+// prune removes expired entries, at most once per minute
+func (a *authService) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < time.Minute {
+		return
+	}
+	a.lastPrune = now
+	for k, login := range a.cache {
+		if !now.Before(login.expires) {
+			delete(a.cache, k)
+		}
+	}
+	for k, f := range a.failures {
+		if now.Sub(f.since) >= a.lockout && !now.Before(f.lockedUntil) {
+			delete(a.failures, k)
+		}
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// imapAuthError maps the errors of Authenticate to IMAP responses
+func imapAuthError(err error) error {
+	if errors.Is(err, errLockedOut) {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{Type: imap.StatusRespNo, Code: "UNAVAILABLE", Info: "Too many failed logins, try again later"}}
+	}
+	if errors.Is(err, backend.ErrInvalidCredentials) {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{Type: imap.StatusRespNo, Code: "AUTHENTICATIONFAILED", Info: "Invalid credentials"}}
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{Type: imap.StatusRespNo, Code: "UNAVAILABLE", Info: "Temporary authentication failure"}}
+}
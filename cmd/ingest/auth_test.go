@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+type fakeAppKeys struct {
+	keys  map[string]string
+	users map[string]string
+	err   error
+	calls int
+}
+
+func (f *fakeAppKeys) CheckAppKey(mail, password string) (string, error) {
+	f.calls++
+	if f.err != nil {
+		return "", f.err
+	}
+	return f.keys[mail+"/"+password], nil
+}
+
+func (f *fakeAppKeys) AppKeyExists(mail, id string) (bool, error) {
+	if f.err != nil {
+		return false, f.err
+	}
+	for k, v := range f.keys {
+		if strings.HasPrefix(k, mail+"/") && v == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeAppKeys) FindUser(webLogin string) (string, error) {
+	if f.err != nil {
+		return "", f.err
+	}
+	if mail, ok := f.users[webLogin]; ok {
+		return mail, nil
+	}
+	return "", iterator.Done
+}
+
+func newTestAuthService(keys authBackend) (*authService, *time.Time) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	a := newAuthService(zap.NewNop(), keys)
+	a.ttl, a.lockout, a.maxFailures, a.maxIPFailures = time.Minute, 15*time.Minute, 3, 5
+	a.now = func() time.Time { return now }
+	return a, &now
+}
+
+func TestAuthServiceCache(t *testing.T) {
+	keys := &fakeAppKeys{keys: map[string]string{"hermes@ptsm.q42.com/secret": "k1"}}
+	a, now := newTestAuthService(keys)
+	ip := net.ParseIP("192.0.2.1")
+
+	id, err := a.Authenticate("hermes@ptsm.q42.com", "secret", ip)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", id)
+	id, err = a.Authenticate("hermes@ptsm.q42.com", "secret", ip)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", id)
+	assert.Equal(t, 1, keys.calls, "cached login is not checked again")
+
+	// Expired after the ttl
+	*now = now.Add(time.Minute)
+	_, err = a.Authenticate("hermes@ptsm.q42.com", "secret", ip)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, keys.calls)
+
+	// Revoked keys are forgotten
+	a.Forget("hermes@ptsm.q42.com", "k1")
+	delete(keys.keys, "hermes@ptsm.q42.com/secret")
+	_, err = a.Authenticate("hermes@ptsm.q42.com", "secret", ip)
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+	assert.Equal(t, 3, keys.calls)
+}
+
+func TestAuthServiceLockout(t *testing.T) {
+	keys := &fakeAppKeys{keys: map[string]string{"hermes@ptsm.q42.com/secret": "k1"}}
+	a, now := newTestAuthService(keys)
+	ip := net.ParseIP("192.0.2.1")
+
+	for i := 0; i < 3; i++ {
+		_, err := a.Authenticate("hermes@ptsm.q42.com", "wrong", ip)
+		assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+	}
+	// The username is locked out, even with the right password and from another IP
+	_, err := a.Authenticate("hermes@ptsm.q42.com", "secret", net.ParseIP("192.0.2.2"))
+	assert.ErrorIs(t, err, errLockedOut)
+	assert.Equal(t, 3, keys.calls, "locked out logins are not checked")
+
+	*now = now.Add(15 * time.Minute)
+	id, err := a.Authenticate("hermes@ptsm.q42.com", "secret", ip)
+	assert.NoError(t, err)
+	assert.Equal(t, "k1", id)
+}
+
+func TestAuthServiceIPLockout(t *testing.T) {
+	a, now := newTestAuthService(&fakeAppKeys{keys: map[string]string{"athena@ptsm.q42.com/secret": "k2"}})
+	ip := net.ParseIP("2001:db8::1")
+
+	// Spread over usernames, so only the IP gets locked out
+	for _, user := range []string{"a", "b", "c", "d", "e"} {
+		_, err := a.Authenticate(user+"@ptsm.q42.com", "wrong", ip)
+		assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+	}
+	_, err := a.Authenticate("athena@ptsm.q42.com", "secret", ip)
+	assert.ErrorIs(t, err, errLockedOut)
+	_, err = a.Authenticate("athena@ptsm.q42.com", "secret", net.ParseIP("2001:db8::2"))
+	assert.NoError(t, err)
+
+	// Failures older than the lockout period are not counted
+	*now = now.Add(15 * time.Minute)
+	for i := 0; i < 2; i++ {
+		a.Authenticate("hermes@ptsm.q42.com", "wrong", ip)
+		*now = now.Add(10 * time.Minute)
+	}
+	_, err = a.Authenticate("hermes@ptsm.q42.com", "wrong", ip)
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+}
+
+func TestAuthServiceBackendError(t *testing.T) {
+	keys := &fakeAppKeys{err: errors.New("firestore unavailable")}
+	a, _ := newTestAuthService(keys)
+	ip := net.ParseIP("192.0.2.1")
+
+	for i := 0; i < 5; i++ {
+		_, err := a.Authenticate("hermes@ptsm.q42.com", "secret", ip)
+		assert.EqualError(t, err, "firestore unavailable")
+	}
+	assert.Empty(t, a.failures, "backend errors are not failed logins")
+}
+
+func TestImapAuthError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code imap.StatusRespCode
+	}{
+		{errLockedOut, "UNAVAILABLE"},
+		{backend.ErrInvalidCredentials, "AUTHENTICATIONFAILED"},
+		{errors.New("firestore unavailable"), "UNAVAILABLE"},
+	} {
+		var status *imap.ErrStatusResp
+		if assert.ErrorAs(t, imapAuthError(tc.err), &status) {
+			assert.Equal(t, imap.StatusRespNo, status.Resp.Type)
+			assert.Equal(t, tc.code, status.Resp.Code, tc.err.Error())
+		}
+	}
+}
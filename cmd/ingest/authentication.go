@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/chrj/smtpd"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// authVerdict is the outcome of authenticating an inbound mail
+type authVerdict struct {
+	SPF       spfResult
+	SPFDomain string
+	DKIM      []dkimResult
+	// Domain of the envelope sender
+	SenderDomain string
+	// Domain of the RFC5322.From header
+	FromDomain string
+	DMARC      authres.ResultValue
+	// Disposition is the DMARC policy to apply to the mail, empty if it passes
+	Disposition dmarc.Policy
+}
+
+type dkimResult struct {
+	Domain string
+	Pass   bool
+	Err    string
+}
+
+// authenticate checks SPF for the peer and the DKIM signatures of the mail
+func authenticate(ctx context.Context, dns resolver, peer smtpd.Peer, env smtpd.Envelope) authVerdict {
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	var ip net.IP
+	if addr, ok := peer.Addr.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	v := authVerdict{SenderDomain: strings.ToLower(env.Sender[strings.LastIndex(env.Sender, "@")+1:])}
+	if ip != nil {
+		v.SPF, v.SPFDomain = checkSPF(ctx, dns, ip, env.Sender, peer.HeloName)
+	} else {
+		v.SPF = SPFNone
+	}
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(env.Data), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return dns.LookupTXT(ctx, domain)
+		},
+	})
+	if err == nil {
+		for _, verification := range verifications {
+			res := dkimResult{Domain: strings.ToLower(verification.Domain), Pass: verification.Err == nil}
+			if verification.Err != nil {
+				res.Err = verification.Err.Error()
+			}
+			v.DKIM = append(v.DKIM, res)
+		}
+	}
+
+	v.FromDomain = fromDomain(env.Data)
+	v.DMARC, v.Disposition = v.checkDMARC(ctx, dns)
+	return v
+}
+
+// fromDomain is the domain of the (first) author in the From header
+func fromDomain(data []byte) string {
+	msg, err := mail.ReadMessage(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		return ""
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return ""
+	}
+	return strings.ToLower(from[0].Address[strings.LastIndex(from[0].Address, "@")+1:])
+}
+
+// checkDMARC evaluates the DMARC (RFC 7489) policy of the From domain,
+// falling back to the policy of the organizational domain
+func (v authVerdict) checkDMARC(ctx context.Context, dns resolver) (authres.ResultValue, dmarc.Policy) {
+	if v.FromDomain == "" {
+		return authres.ResultPermError, ""
+	}
+	opts := &dmarc.LookupOptions{LookupTXT: func(domain string) ([]string, error) {
+		return dns.LookupTXT(ctx, domain)
+	}}
+	rec, err := dmarc.LookupWithOptions(v.FromDomain, opts)
+	policy := dmarc.Policy("")
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		org, orgErr := publicsuffix.EffectiveTLDPlusOne(v.FromDomain)
+		if orgErr != nil || org == v.FromDomain {
+			return authres.ResultNone, ""
+		}
+		if rec, err = dmarc.LookupWithOptions(org, opts); err == nil {
+			policy = rec.SubdomainPolicy
+		}
+	}
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		return authres.ResultNone, ""
+	case dmarc.IsTempFail(err):
+		return authres.ResultTempError, ""
+	case err != nil:
+		return authres.ResultPermError, ""
+	}
+	if policy == "" {
+		policy = rec.Policy
+	}
+
+	if v.SPF == SPFPass && alignedDomains(v.SPFDomain, v.FromDomain, rec.SPFAlignment == dmarc.AlignmentStrict) {
+		return authres.ResultPass, ""
+	}
+	for _, res := range v.DKIM {
+		if res.Pass && alignedDomains(res.Domain, v.FromDomain, rec.DKIMAlignment == dmarc.AlignmentStrict) {
+			return authres.ResultPass, ""
+		}
+	}
+
+	// Policies are applied to a sample of the failing mail only
+	if rec.Percent != nil && rand.Intn(100) >= *rec.Percent {
+		policy = dmarc.PolicyNone
+	}
+	if policy == dmarc.PolicyNone {
+		policy = ""
+	}
+	return authres.ResultFail, policy
+}
+
+// SenderAuthenticated tells if the envelope sender is not forged: either SPF
+// passes, or a DKIM signature passes that is aligned with the sender domain.
+// Only then is it safe to send the sender a bounce.
+func (v authVerdict) SenderAuthenticated() bool {
+	if v.SPF == SPFPass && strings.EqualFold(v.SPFDomain, v.SenderDomain) {
+		return true
+	}
+	return v.dkimAligned(v.SenderDomain)
+}
+
+// dkimAligned tells if a passing DKIM signature is in relaxed alignment
+// (the same organizational domain) with the domain
+func (v authVerdict) dkimAligned(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, res := range v.DKIM {
+		if res.Pass && alignedDomains(res.Domain, domain, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// alignedDomains compares domains strictly, or relaxed by their organizational domain
+func alignedDomains(a, b string, strict bool) bool {
+	a, b = strings.ToLower(strings.TrimSuffix(a, ".")), strings.ToLower(strings.TrimSuffix(b, "."))
+	if a == b {
+		return true
+	}
+	if strict {
+		return false
+	}
+	orgA, errA := publicsuffix.EffectiveTLDPlusOne(a)
+	orgB, errB := publicsuffix.EffectiveTLDPlusOne(b)
+	return errA == nil && errB == nil && orgA == orgB
+}
+
+func (v authVerdict) dkimSummary() string {
+	if len(v.DKIM) == 0 {
+		return "none"
+	}
+	for _, res := range v.DKIM {
+		if res.Pass {
+			return "pass"
+		}
+	}
+	return "fail"
+}
+
+// header is the Authentication-Results header (RFC 8601) of our verdict
+func (v authVerdict) header(identity string) string {
+	results := []authres.Result{&authres.SPFResult{Value: authres.ResultValue(v.SPF), From: v.SPFDomain}}
+	if len(v.DKIM) == 0 {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultNone})
+	}
+	for _, res := range v.DKIM {
+		if res.Pass {
+			results = append(results, &authres.DKIMResult{Value: authres.ResultPass, Domain: res.Domain})
+		} else {
+			results = append(results, &authres.DKIMResult{Value: authres.ResultFail, Domain: res.Domain, Reason: res.Err})
+		}
+	}
+	results = append(results, &authres.DMARCResult{Value: v.DMARC, From: v.FromDomain})
+	return "Authentication-Results: " + authres.Format(identity, results) + "\r\n"
+}
+
+// stripAuthenticationResults removes Authentication-Results headers that claim
+// to be ours (RFC 8601 §5), so a sender can not forge our verdict
+func stripAuthenticationResults(data []byte, identity string) []byte {
+	out := make([]byte, 0, len(data))
+	drop := false
+	for rest := data; len(rest) > 0; {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line = rest[:i+1]
+		}
+		rest = rest[len(line):]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of the header
+			out = append(out, line...)
+			out = append(out, rest...)
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			drop = false
+			if name, value, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(string(bytes.TrimSpace(name)), "Authentication-Results") {
+				id, _, _ := bytes.Cut(value, []byte(";"))
+				drop = strings.EqualFold(string(bytes.TrimSpace(id)), identity)
+			}
+		}
+		if !drop {
+			out = append(out, line...)
+		}
+	}
+	return out
+}
+
+// Firestore representation to record on quarantined mail
+func (v authVerdict) data() map[string]interface{} {
+	return map[string]interface{}{
+		"spf":                 string(v.SPF),
+		"spfDomain":           v.SPFDomain,
+		"dkim":                v.dkimSummary(),
+		"dmarc":               string(v.DMARC),
+		"senderAuthenticated": v.SenderAuthenticated(),
+	}
+}
@@ -2,9 +2,20 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 var (
@@ -15,10 +26,12 @@ var (
 	logFormat        = flagset.String("log_format", "default", "Log output format")
 	logLevel         = flagset.String("log_level", "info", "Minimum log level to output")
 	hostName         = flagset.String("hostname", "mail.localhost.localdomain", "Server hostname")
-	domain           = flagset.String("domain", "localhost.localdomain", "Email domain name")
+	domain           = flagset.String("domain", "localhost.localdomain", "Email domain name, which also hosts the web pages and payment links")
+	domainsStr       = flagset.String("domains", "", "Additional email domains served, separated by spaces")
 	dkimSelector     = flagset.String("dkimSelector", "", "Used in the DKIM DNS entry to identify the key")
+	dkimKeysStr      = flagset.String("dkim_keys", "", "DKIM keys of served domains as domain=selector:keyfile, separated by spaces; other domains are signed with the TLS key and dkimSelector")
 	welcomeMsg       = flagset.String("welcome_msg", "", "Welcome message for SMTP session")
-	listenStr        = flagset.String("listen", "127.0.0.1:25 [::1]:25", "Address and port to listen for incoming SMTP")
+	listenStr        = flagset.String("listen", "smtp://:25 submission://:587 smtps://:465 imaps://:993 https://:443", "Listeners as proto://addr, proto one of smtp, submission, smtps, imap, imaps, https")
 	localCert        = flagset.String("local_cert", "", "SSL certificate for STARTTLS/TLS")
 	localKey         = flagset.String("local_key", "", "SSL private key for STARTTLS/TLS")
 	localForceTLS    = flagset.Bool("local_forcetls", false, "Force STARTTLS (needs local_cert and local_key)")
@@ -34,18 +47,381 @@ var (
 	allowedUsers     = flagset.String("allowed_users", "", "Path to file with valid users/passwords")
 	command          = flagset.String("command", "", "Path to pipe command")
 	remotesStr       = flagset.String("remotes", "", "Outgoing SMTP servers")
+	releaseSecret    = flagset.String("release_secret", "", "Shared secret the payment webhook uses to release paid mail")
+	unpaidRetention  = flagset.Duration("unpaid_retention", 30*24*time.Hour, "How long unpaid mail is kept, unless the mailbox sets retentionDays")
+	janitorInterval  = flagset.Duration("janitor_interval", time.Hour, "How often expired unpaid mail is purged")
+	expiryNotice     = flagset.Bool("expiry_notice", false, "Notify authenticated senders when their unpaid mail expired")
+	spoolDir         = flagset.String("spool", "spool", "Directory of the outbound mail queue")
+	queueLifetime    = flagset.Duration("queue_lifetime", 5*24*time.Hour, "How long outbound mail is retried before it is returned to the sender")
+	queueBackoff     = flagset.Duration("queue_backoff", time.Minute, "Delay before the first retry of outbound mail, doubled on every retry")
+	queueWorkers     = flagset.Int("queue_workers", 4, "Number of concurrent outbound deliveries")
+	outboundPorts    = flagset.String("outbound_ports", "25", "Ports tried in order when delivering to a mail exchanger")
+	tlsPolicyNames   = flagset.String("outbound_tls_policies", "dane mta-sts", "Policies that can require authenticated TLS for outbound mail (dane, mta-sts), opportunistic TLS otherwise")
+	daneResolver     = flagset.String("dane_resolver", "", "DNSSEC validating resolver (host:port) for DANE lookups, defaults to the first nameserver in /etc/resolv.conf")
+	dnsblZones       = flagset.String("dnsbl", "", "DNS blocklist zones checked for clients connecting to port 25")
+	mailStore        = flagset.String("mail_store", mailStoreDisk, "Where mailboxes are stored: disk (the mails directory), maildir (Maildir++ under maildir_root), memory (lost on restart) or firestore (shared by replicas)")
+	maildirRoot      = flagset.String("maildir_root", "/var/mail/ptsm", "Absolute directory of the Maildir++ mailboxes with -mail_store maildir")
+	shutdownGrace    = flagset.Duration("shutdown_grace", 30*time.Second, "How long sessions and outbound deliveries may finish after a shutdown signal")
+
+	// logins
+	authCacheTTL      = flagset.Duration("auth_cache_ttl", time.Minute, "How long verified SMTP/IMAP logins are cached")
+	authLockout       = flagset.Duration("auth_lockout", 15*time.Minute, "Period in which failed logins are counted, and how long a lockout lasts")
+	authMaxFailures   = flagset.Int("auth_max_failures", 5, "Failed logins of a username before it is locked out")
+	authMaxIPFailures = flagset.Int("auth_max_ip_failures", 20, "Failed logins from an IP before it is locked out")
+	oauthAudience     = flagset.String("oauth_audience", "", "Audience of the ID tokens accepted by OAUTHBEARER/XOAUTH2 logins, such as the Firebase project id; empty disables OAuth logins")
+	oauthIssuer       = flagset.String("oauth_issuer", "", "Issuer of the ID tokens, defaults to the Firebase issuer https://securetoken.google.com/<oauth_audience>")
+	oauthJWKS         = flagset.String("oauth_jwks", firebaseJWKS, "URL of the JSON Web Key Set that signs the ID tokens")
 
 	// additional flags
-	_           = flagset.String("config", "", "Path to config file (ini format)")
+	configFile  = flagset.String("config", "", "Path to config file (ini format)")
 	versionInfo = flagset.Bool("version", false, "Show version information")
 
 	// internal
-	listenAddrs       = []protoAddr{}
-	readTimeout       time.Duration
-	writeTimeout      time.Duration
-	dataTimeout       time.Duration
-	allowedNets       = []*net.IPNet{}
+	listenAddrs  = []protoAddr{}
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	dataTimeout  time.Duration
+	remotes      = []*Remote{}
+	// servedDomains are the lowercase domains mail is received for, the primary domain first
+	servedDomains []string
+	dkimKeys      = map[string]dkimKey{}
+
+	// hot holds the settings that are reloaded on SIGHUP
+	hot = &atomic.Pointer[hotConfig]{}
+	// logLevelValue is shared by all loggers, so the level can change at runtime
+	logLevelValue = zap.NewAtomicLevel()
+	// commandLine are the flags set on the command line, which win over the config file and environment
+	commandLine = map[string]bool{}
+)
+
+// Settings are read from, in increasing order of precedence: the flag
+// defaults, the ini file of -config, PTSM_<FLAG> environment variables and
+// the command line. The ini file has one "flag_name = value" per line;
+// [sections] only group settings and # or ; start a comment.
+const envPrefix = "PTSM_"
+
+// hotFlags take effect on SIGHUP, other settings require a restart
+var hotFlags = []string{"log_level", "allowed_nets", "allowed_sender", "allowed_recipients", "dnsbl"}
+
+type hotConfig struct {
+	allowedNets       []*net.IPNet
 	allowedSender     *regexp.Regexp
 	allowedRecipients *regexp.Regexp
-	// remotes           = []*Remote{}
-)
+	dnsblZones        []string
+}
+
+// settings returns the current hot-reloadable settings
+func settings() *hotConfig {
+	if c := hot.Load(); c != nil {
+		return c
+	}
+	return &hotConfig{}
+}
+
+// loadConfig merges all configuration sources and validates them
+func loadConfig(args []string) error {
+	// A fresh set sharing the values tells exactly which flags the command line set
+	cmd := flag.NewFlagSet(flagset.Name(), flag.ContinueOnError)
+	flagset.VisitAll(func(f *flag.Flag) { cmd.Var(f.Value, f.Name, f.Usage) })
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	commandLine = map[string]bool{}
+	cmd.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+
+	values, err := configValues()
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		if err := flagset.Set(name, value); err != nil {
+			return fmt.Errorf("invalid configuration: %s: %v", name, err)
+		}
+	}
+	return applyConfig()
+}
+
+// reloadConfig re-reads the config file and environment and applies the hot settings
+func reloadConfig(logger *zap.Logger) error {
+	values, err := configValues()
+	if err != nil {
+		return err
+	}
+	previous := map[string]string{}
+	for _, name := range hotFlags {
+		if commandLine[name] {
+			continue
+		}
+		f := flagset.Lookup(name)
+		previous[name] = f.Value.String()
+		value, ok := values[name]
+		if !ok {
+			// Removed from the config file
+			value = f.DefValue
+		}
+		if err = flagset.Set(name, value); err != nil {
+			err = fmt.Errorf("invalid configuration: %s: %v", name, err)
+			break
+		}
+	}
+	var cfg *hotConfig
+	var level zapcore.Level
+	if err == nil {
+		var problems configErrors
+		cfg, level = parseHotConfig(&problems)
+		err = problems.err()
+	}
+	if err != nil {
+		for name, value := range previous {
+			flagset.Set(name, value)
+		}
+		return err
+	}
+
+	for name, value := range values {
+		if !isHotFlag(name) && restartNeeded(flagset.Lookup(name), value) {
+			logger.Warn("Changed setting requires a restart", zap.String("setting", name))
+		}
+	}
+	hot.Store(cfg)
+	logLevelValue.SetLevel(level)
+	return nil
+}
+
+// restartNeeded tells whether the value of a flag in the config differs from
+// its current value. The value is parsed into a scratch flag of the same type,
+// so "60m" is the same as "1h" and "1" as "true".
+func restartNeeded(f *flag.Flag, value string) bool {
+	scratch := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+	if err := scratch.Set(value); err != nil {
+		return true
+	}
+	return scratch.String() != f.Value.String()
+}
+
+func isHotFlag(name string) bool {
+	for _, hotFlag := range hotFlags {
+		if hotFlag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// configValues merges the config file and environment, leaving out the flags set on the command line
+func configValues() (map[string]string, error) {
+	if value, ok := os.LookupEnv(envName("config")); ok && !commandLine["config"] {
+		*configFile = value
+	}
+	values := map[string]string{}
+	if *configFile != "" {
+		file, err := readIni(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		values = file
+	}
+	flagset.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			values[f.Name] = value
+		}
+	})
+	for name := range commandLine {
+		delete(values, name)
+	}
+	delete(values, "config")
+	return values, nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(flagName)
+}
+
+// readIni reads the settings of an ini file, rejecting unknown names
+func readIni(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read config file")
+	}
+	values := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '[' && line[len(line)-1] == ']' {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, i+1)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		if flagset.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, i+1, name)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// configErrors collects every invalid setting, so they can be fixed at once
+type configErrors []string
+
+func (e *configErrors) check(name string, err error) {
+	if err != nil {
+		*e = append(*e, fmt.Sprintf("%s: %v", name, err))
+	}
+}
+
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(e, "\n  "))
+}
+
+// applyConfig validates the settings and derives the internal configuration
+func applyConfig() error {
+	var problems configErrors
+	var err error
+	readTimeout, err = parseTimeout(*readTimeoutStr)
+	problems.check("read_timeout", err)
+	writeTimeout, err = parseTimeout(*writeTimeoutStr)
+	problems.check("write_timeout", err)
+	dataTimeout, err = parseTimeout(*dataTimeoutStr)
+	problems.check("data_timeout", err)
+	listenAddrs, err = parseListen(*listenStr)
+	problems.check("listen", err)
+	remotes, err = parseRemotes(*remotesStr)
+	problems.check("remotes", err)
+	_, err = parsePorts(*outboundPorts)
+	problems.check("outbound_ports", err)
+
+	if *logFormat != "default" && *logFormat != "json" {
+		problems.check("log_format", fmt.Errorf("unknown format %q, use default or json", *logFormat))
+	}
+	if *hostName == "" {
+		problems.check("hostname", errors.New("must not be empty"))
+	}
+	if *domain == "" {
+		problems.check("domain", errors.New("must not be empty"))
+	} else if servedDomains, err = parseDomains(*domain, *domainsStr); err != nil {
+		problems.check("domains", err)
+	} else {
+		dkimKeys, err = parseDKIMKeys(*dkimKeysStr, servedDomains)
+		problems.check("dkim_keys", err)
+	}
+	if (*localCert == "") != (*localKey == "") {
+		problems.check("local_cert", errors.New("local_cert and local_key must be set together"))
+	}
+	if *localForceTLS && *localCert == "" {
+		problems.check("local_forcetls", errors.New("requires local_cert and local_key"))
+	}
+	switch *mailStore {
+	case mailStoreDisk, mailStoreMemory, mailStoreFirestore:
+	case mailStoreMaildir:
+		if !filepath.IsAbs(*maildirRoot) {
+			problems.check("maildir_root", fmt.Errorf("%q is not an absolute path", *maildirRoot))
+		}
+	default:
+		problems.check("mail_store", fmt.Errorf("unknown store %q, use disk, maildir, memory or firestore", *mailStore))
+	}
+	if *maxConnections < -1 || *maxConnections == 0 {
+		problems.check("max_connections", errors.New("must be positive or -1"))
+	}
+	for name, value := range map[string]int{"max_message_size": *maxMessageSize, "max_recipients": *maxRecipients, "queue_workers": *queueWorkers, "auth_max_failures": *authMaxFailures, "auth_max_ip_failures": *authMaxIPFailures} {
+		if value <= 0 {
+			problems.check(name, errors.New("must be positive"))
+		}
+	}
+	for name, value := range map[string]time.Duration{"queue_lifetime": *queueLifetime, "queue_backoff": *queueBackoff, "unpaid_retention": *unpaidRetention, "janitor_interval": *janitorInterval, "shutdown_grace": *shutdownGrace, "auth_cache_ttl": *authCacheTTL, "auth_lockout": *authLockout} {
+		if value <= 0 {
+			problems.check(name, errors.New("must be positive"))
+		}
+	}
+
+	if *oauthAudience != "" {
+		problems.check("oauth_jwks", checkJWKSURL(*oauthJWKS))
+	}
+
+	cfg, level := parseHotConfig(&problems)
+	if err = problems.err(); err != nil {
+		return err
+	}
+	hot.Store(cfg)
+	logLevelValue.SetLevel(level)
+	return nil
+}
+
+// parseHotConfig parses the settings that can change at runtime
+func parseHotConfig(problems *configErrors) (*hotConfig, zapcore.Level) {
+	var err error
+	cfg := &hotConfig{dnsblZones: strings.Fields(*dnsblZones)}
+	cfg.allowedNets, err = parseNetworks(*allowedNetsStr)
+	problems.check("allowed_nets", err)
+	cfg.allowedSender, err = parseRegexp(*allowedSenderStr)
+	problems.check("allowed_sender", err)
+	cfg.allowedRecipients, err = parseRegexp(*allowedRecipStr)
+	problems.check("allowed_recipients", err)
+	level, err := zapcore.ParseLevel(*logLevel)
+	problems.check("log_level", err)
+	return cfg, level
+}
+
+func parseTimeout(str string) (time.Duration, error) {
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return d, nil
+}
+
+// parseRegexp compiles the pattern, an empty pattern allows everything
+func parseRegexp(str string) (*regexp.Regexp, error) {
+	if str == "" {
+		return nil, nil
+	}
+	return regexp.Compile(str)
+}
+
+// newLogger builds the logger from log_format and logfile, at the (reloadable) log_level
+func newLogger() (*zap.Logger, error) {
+	cfg := zap.NewDevelopmentConfig()
+	if *logFormat == "json" {
+		cfg = zap.NewProductionConfig()
+	}
+	cfg.Level = logLevelValue
+	if *logFile != "" {
+		cfg.OutputPaths = []string{*logFile}
+	}
+	return cfg.Build()
+}
+
+// parseNetworks parses space separated CIDR networks, a bare IP is a single host
+func parseNetworks(str string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Fields(str) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", field)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", field)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
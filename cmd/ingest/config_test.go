@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// restoreFlags resets the global configuration when the test ends
+func restoreFlags(t *testing.T) {
+	values := map[string]string{}
+	flagset.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	cfg, level := hot.Load(), logLevelValue.Level()
+	t.Cleanup(func() {
+		for name, value := range values {
+			flagset.Set(name, value)
+		}
+		commandLine = map[string]bool{}
+		hot.Store(cfg)
+		logLevelValue.SetLevel(level)
+	})
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "ingest.ini")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	restoreFlags(t)
+	path := writeConfig(t, `
+# mail server
+[smtp]
+hostname = mail.example.org
+domain = "example.org"
+read_timeout = 30s
+allowed_sender = ^.*@example\.org$
+log_level = warn
+
+[queue]
+queue_workers = 2
+`)
+	t.Setenv("PTSM_DOMAIN", "example.net")
+	t.Setenv("PTSM_QUEUE_WORKERS", "8")
+
+	err := loadConfig([]string{"-config", path, "-queue_workers", "3", "-write_timeout", "10s"})
+	assert.NoError(t, err)
+	assert.Equal(t, "mail.example.org", *hostName)
+	// The environment wins over the file, the command line over both
+	assert.Equal(t, "example.net", *domain)
+	assert.Equal(t, 3, *queueWorkers)
+	assert.Equal(t, 30*time.Second, readTimeout)
+	assert.Equal(t, 10*time.Second, writeTimeout)
+	assert.Equal(t, 5*time.Minute, dataTimeout)
+	assert.True(t, settings().allowedSender.MatchString("someone@example.org"))
+	assert.Nil(t, settings().allowedRecipients)
+	assert.Equal(t, zapcore.WarnLevel, logLevelValue.Level())
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	restoreFlags(t)
+	err := loadConfig([]string{"-read_timeout", "soon", "-allowed_sender", "(", "-allowed_nets", "10.0.0.0/33", "-log_level", "loud", "-oauth_audience", "ptsm-2022", "-oauth_jwks", "http://example.com/jwks", "-mail_store", "maildir", "-maildir_root", "mail"})
+	if assert.Error(t, err) {
+		// Every problem is reported at once
+		assert.Contains(t, err.Error(), "read_timeout: ")
+		assert.Contains(t, err.Error(), "allowed_sender: ")
+		assert.Contains(t, err.Error(), "allowed_nets: ")
+		assert.Contains(t, err.Error(), "log_level: ")
+		assert.Contains(t, err.Error(), "oauth_jwks: ")
+		assert.Contains(t, err.Error(), "maildir_root: ")
+	}
+
+	path := writeConfig(t, "hostnmae = mail.example.org\n")
+	err = loadConfig([]string{"-config", path})
+	assert.EqualError(t, err, path+`:1: unknown setting "hostnmae"`)
+
+	*configFile = ""
+	t.Setenv("PTSM_MAX_RECIPIENTS", "many")
+	err = loadConfig(nil)
+	assert.ErrorContains(t, err, "max_recipients: ")
+}
+
+func TestReloadConfig(t *testing.T) {
+	restoreFlags(t)
+	path := writeConfig(t, "allowed_nets = 192.0.2.0/24\nhostname = mail.example.org\n")
+	assert.NoError(t, loadConfig([]string{"-config", path, "-log_level", "debug"}))
+	assert.True(t, inNetworks(net.ParseIP("192.0.2.1"), settings().allowedNets))
+
+	// Hot settings change, the others and those of the command line keep their value
+	assert.NoError(t, os.WriteFile(path, []byte("allowed_nets = 198.51.100.0/24\nhostname = mail.example.net\nlog_level = error\n"), 0600))
+	assert.NoError(t, reloadConfig(zap.NewNop()))
+	assert.False(t, inNetworks(net.ParseIP("192.0.2.1"), settings().allowedNets))
+	assert.True(t, inNetworks(net.ParseIP("198.51.100.1"), settings().allowedNets))
+	assert.Equal(t, "mail.example.org", *hostName)
+	assert.Equal(t, zapcore.DebugLevel, logLevelValue.Level())
+
+	// An invalid file keeps the current settings
+	assert.NoError(t, os.WriteFile(path, []byte("allowed_nets = everyone\n"), 0600))
+	assert.Error(t, reloadConfig(zap.NewNop()))
+	assert.True(t, inNetworks(net.ParseIP("198.51.100.1"), settings().allowedNets))
+	assert.Equal(t, "198.51.100.0/24", *allowedNetsStr)
+}
+
+func TestRestartNeeded(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("interval", time.Hour, "")
+	fs.Bool("enabled", true, "")
+	fs.String("name", "a", "")
+
+	assert.False(t, restartNeeded(fs.Lookup("interval"), "60m"))
+	assert.True(t, restartNeeded(fs.Lookup("interval"), "2h"))
+	assert.True(t, restartNeeded(fs.Lookup("interval"), "soon"))
+	assert.False(t, restartNeeded(fs.Lookup("enabled"), "1"))
+	assert.True(t, restartNeeded(fs.Lookup("enabled"), "false"))
+	assert.False(t, restartNeeded(fs.Lookup("name"), "a"))
+	assert.True(t, restartNeeded(fs.Lookup("name"), "b"))
+
+	// The flag itself is left alone
+	assert.Equal(t, "1h0m0s", fs.Lookup("interval").Value.String())
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bcampbell/tameimap/store"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// The UID of a message on disk is the number its file name starts with, which
+// tameimap names new files by but forgets on a rescan, where it numbers the
+// files by their position. Files without a UID of their own are renamed to
+// one on open. The next UID of every folder is kept in the diskUIDFile of the
+// mailbox, so the UIDs of expunged messages are not given out again.
+const diskUIDFile = ".uidnext"
+
+// diskUIDValidity is the UIDVALIDITY of all disk folders. tameimap reports 1
+// for its positional UIDs, which clients and quarantine records must forget.
+const diskUIDValidity = 2
+
+// diskAppends serialises appends and the diskUIDFile of all mailboxes
+var diskAppends sync.Mutex
+
+// diskUser is a tameimap user under the root of the disk store
+type diskUser struct {
+	*store.User
+	dir string
+}
+
+// diskMailbox is a tameimap folder that implements appender
+type diskMailbox struct {
+	*store.Mailbox
+	user *diskUser
+}
+
+var _ backend.User = &diskUser{}
+var _ appender = &diskMailbox{}
+
+// newDiskStore stores mailboxes in tameimap directories under root, named by
+// mailboxKey. Each call rescans the directory, and as tameimap keeps flags in
+// memory only they do not last beyond the user they were set on.
+func newDiskStore(root string, logger *zap.Logger) MailStore {
+	return folderStore{logger: logger, open: func(mailbox string) (backend.User, error) {
+		dir := filepath.Join(root, mailboxKey(mailbox))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrap(err, "failed to make inbox")
+		}
+		if err := numberDiskFiles(dir); err != nil {
+			return nil, errors.Wrap(err, "failed to number messages")
+		}
+		u, err := store.NewUser(dir, mailboxKey(mailbox), "")
+		if err != nil {
+			return nil, err
+		}
+		mailboxes, err := u.ListMailboxes(false)
+		if err != nil {
+			return nil, err
+		}
+		for _, mb := range mailboxes {
+			messages := mb.(*store.Mailbox).Messages
+			for _, msg := range messages {
+				msg.Uid = fileUID(reflect.ValueOf(msg).Elem().FieldByName("filename").String())
+			}
+			sort.SliceStable(messages, func(i, j int) bool { return messages[i].Uid < messages[j].Uid })
+		}
+		return &diskUser{u, dir}, nil
+	}}
+}
+
+// GetMailbox implements backend.User
+func (u *diskUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mb, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &diskMailbox{mb.(*store.Mailbox), u}, nil
+}
+
+// CreateMailbox implements backend.User, tameimap needs the directory to exist
+func (u *diskUser) CreateMailbox(name string) error {
+	if err := os.MkdirAll(filepath.Join(u.dir, name), 0700); err != nil {
+		return err
+	}
+	return u.User.CreateMailbox(name)
+}
+
+// Status implements backend.Mailbox
+func (mb *diskMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := mb.Mailbox.Status(items)
+	if err != nil {
+		return nil, err
+	}
+	if status.UidValidity != 0 {
+		status.UidValidity = diskUIDValidity
+	}
+	if status.UidNext != 0 {
+		diskAppends.Lock()
+		next, err := readDiskUIDs(mb.user.dir)
+		diskAppends.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if next[mb.Name()] > status.UidNext {
+			status.UidNext = next[mb.Name()]
+		}
+	}
+	return status, nil
+}
+
+// CreateMessage implements backend.Mailbox
+func (mb *diskMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	diskAppends.Lock()
+	defer diskAppends.Unlock()
+	_, err := mb.create(flags, date, body)
+	return err
+}
+
+// CopyMessages implements backend.Mailbox, numbering the copies like CreateMessage
+func (mb *diskMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	dest, err := mb.user.GetMailbox(destName)
+	if err != nil {
+		return err
+	}
+	section := &imap.BodySectionName{Peek: true}
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mb.ListMessages(uid, seqset, []imap.FetchItem{imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}, ch)
+	}()
+	var messages []*imap.Message
+	for msg := range ch {
+		messages = append(messages, msg)
+	}
+	if err = <-done; err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		var literal imap.Literal
+		for _, l := range msg.Body {
+			literal = l
+		}
+		if literal == nil {
+			return errors.Errorf("no body for message %d in %s", msg.SeqNum, mb.Name())
+		}
+		if err = dest.CreateMessage(msg.Flags, msg.InternalDate, literal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// create stores a message under the next UID of the folder, diskAppends must be locked
+func (mb *diskMailbox) create(flags []string, date time.Time, body imap.Literal) (uint32, error) {
+	next, err := readDiskUIDs(mb.user.dir)
+	if err != nil {
+		return 0, err
+	}
+	var highest uint32
+	for _, msg := range mb.Messages {
+		if msg.Uid > highest {
+			highest = msg.Uid
+		}
+	}
+	// tameimap numbers a message one above the highest UID in the folder,
+	// which a placeholder raises to the next UID
+	n := len(mb.Messages)
+	placeholder := next[mb.Name()] > highest+1
+	if placeholder {
+		mb.Messages = append(mb.Messages, &store.Message{Uid: next[mb.Name()] - 1})
+	}
+	err = mb.Mailbox.CreateMessage(flags, date, body)
+	if placeholder {
+		mb.Messages = append(mb.Messages[:n], mb.Messages[n+1:]...)
+	}
+	if err != nil {
+		return 0, err
+	}
+	uid := mb.Messages[len(mb.Messages)-1].Uid
+	next[mb.Name()] = uid + 1
+	return uid, writeDiskUIDs(mb.user.dir, next)
+}
+
+// deleteMessage implements appender. tameimap only expunges by the \Deleted
+// flag, which other messages keep after the message is expunged alone.
+func (mb *diskMailbox) deleteMessage(uid uint32) error {
+	var found bool
+	var deleted []*store.Message
+	for _, msg := range mb.Messages {
+		if msg.Uid == uid {
+			found = true
+			msg.Flags = backendutil.UpdateFlags(msg.Flags, imap.AddFlags, []string{imap.DeletedFlag})
+		} else if hasFlag(msg.Flags, imap.DeletedFlag) {
+			deleted = append(deleted, msg)
+			msg.Flags = backendutil.UpdateFlags(msg.Flags, imap.RemoveFlags, []string{imap.DeletedFlag})
+		}
+	}
+	err := mb.Expunge()
+	for _, msg := range deleted {
+		msg.Flags = backendutil.UpdateFlags(msg.Flags, imap.AddFlags, []string{imap.DeletedFlag})
+	}
+	if !found {
+		return errors.Wrapf(errMailNotFound, "no message %d in %s", uid, mb.Name())
+	}
+	return err
+}
+
+// appendMessage implements appender
+func (mb *diskMailbox) appendMessage(flags []string, date time.Time, body []byte) (uint32, error) {
+	diskAppends.Lock()
+	defer diskAppends.Unlock()
+	return mb.create(flags, date, bytes.NewReader(body))
+}
+
+// fileUID is the UID a message file name starts with, or 0
+func fileUID(name string) uint32 {
+	prefix, _, _ := strings.Cut(name, "_")
+	uid, err := strconv.ParseUint(prefix, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(uid)
+}
+
+// numberDiskFiles renames the message files of the folders of the mailbox
+// directory that have no UID, or the UID of another file, to the next UID
+// of their folder
+func numberDiskFiles(dir string) error {
+	diskAppends.Lock()
+	defer diskAppends.Unlock()
+	next, err := readDiskUIDs(dir)
+	if err != nil {
+		return err
+	}
+	changed := false
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || path == dir {
+			return err
+		}
+		folder, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		folder = filepath.ToSlash(folder)
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		seen := map[uint32]bool{}
+		var unnumbered []string
+		highest := uint32(0)
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			uid := fileUID(e.Name())
+			if uid == 0 || seen[uid] {
+				unnumbered = append(unnumbered, e.Name())
+				continue
+			}
+			seen[uid] = true
+			if uid > highest {
+				highest = uid
+			}
+		}
+		if next[folder] <= highest {
+			next[folder], changed = highest+1, true
+		}
+		for _, name := range unnumbered {
+			if err = os.Rename(filepath.Join(path, name), filepath.Join(path, fmt.Sprintf("%d_%s", next[folder], name))); err != nil {
+				return err
+			}
+			next[folder]++
+		}
+		changed = changed || len(unnumbered) > 0
+		return nil
+	})
+	if err != nil || !changed {
+		return err
+	}
+	return writeDiskUIDs(dir, next)
+}
+
+// readDiskUIDs reads the next UID of the folders of a mailbox directory
+func readDiskUIDs(dir string) (map[string]uint32, error) {
+	next := map[string]uint32{}
+	data, err := os.ReadFile(filepath.Join(dir, diskUIDFile))
+	if os.IsNotExist(err) {
+		return next, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return next, json.Unmarshal(data, &next)
+}
+
+// writeDiskUIDs replaces the diskUIDFile of the mailbox directory
+func writeDiskUIDs(dir string, next map[string]uint32) error {
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, diskUIDFile+".tmp")
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, diskUIDFile))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DNS blocklists (RFC 5782) are queried for the reversed peer IP under each zone
+
+// dnsblListed returns the first zone that lists the ip
+func dnsblListed(ctx context.Context, dns resolver, logger *zap.Logger, ip net.IP, zones []string) (string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	for _, zone := range zones {
+		addrs, err := dns.LookupIPAddr(ctx, dnsblQuery(ip, zone))
+		if err != nil {
+			if !isNotFound(err) {
+				// Fail open: an unreachable list should not stop all mail
+				logger.Warn("Failed to query DNSBL", zap.String("zone", zone), zap.Stringer("ip", ip), zap.Error(err))
+			}
+			continue
+		}
+		for _, addr := range addrs {
+			// Listings are 127.0.0.0/8, except the 127.255.255.0/24 error codes
+			if ip4 := addr.IP.To4(); ip4 != nil && ip4[0] == 127 && !(ip4[1] == 255 && ip4[2] == 255) {
+				return zone, true
+			}
+		}
+	}
+	return "", false
+}
+
+// dnsblQuery is the name to look up: reversed octets for IPv4, reversed nibbles for IPv6
+func dnsblQuery(ip net.IP, zone string) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		labels = strings.Split(ip4.String(), ".")
+	} else {
+		labels = strings.Split(macroIP(ip), ".")
+	}
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".") + "." + strings.TrimSuffix(zone, ".")
+}
+
+// inNetworks tells if the ip is part of one of the networks
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/chrj/smtpd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDnsblQuery(t *testing.T) {
+	assert.Equal(t, "2.0.0.127.zen.example", dnsblQuery(net.ParseIP("127.0.0.2"), "zen.example"))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.zen.example", dnsblQuery(net.ParseIP("2001:db8::1"), "zen.example."))
+}
+
+func TestDnsblListed(t *testing.T) {
+	dns := fakeResolver{ip: map[string][]string{
+		"9.113.0.203.bl.example":   {"127.0.0.2"},
+		"10.113.0.203.bl.example":  {"127.255.255.254"},
+		"11.113.0.203.bl2.example": {"127.0.0.4"},
+	}}
+	zones := []string{"bl.example", "bl2.example"}
+	for _, tc := range []struct {
+		ip     string
+		zone   string
+		listed bool
+	}{
+		{"203.0.113.9", "bl.example", true},
+		{"203.0.113.10", "", false},
+		{"203.0.113.11", "bl2.example", true},
+		{"203.0.113.12", "", false},
+	} {
+		zone, listed := dnsblListed(context.Background(), dns, zap.NewNop(), net.ParseIP(tc.ip), zones)
+		assert.Equal(t, tc.listed, listed, tc.ip)
+		assert.Equal(t, tc.zone, zone, tc.ip)
+	}
+}
+
+func TestConnectionChecker(t *testing.T) {
+	defer hot.Store(hot.Load())
+	networks, _ := parseNetworks("192.0.2.0/24 203.0.113.10")
+	hot.Store(&hotConfig{allowedNets: networks, dnsblZones: []string{"bl.example"}})
+
+	dns := fakeResolver{ip: map[string][]string{
+		"9.113.0.203.bl.example":  {"127.0.0.2"},
+		"10.113.0.203.bl.example": {"127.0.0.2"},
+	}}
+	mx := wrap{logger: zap.NewNop(), dns: dns}
+	submission := wrap{logger: zap.NewNop(), dns: dns, submission: true}
+	peer := func(ip string) smtpd.Peer { return smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip)}} }
+
+	// Listed peers are rejected on port 25, unless they are in an allowed network
+	err := mx.connectionChecker(peer("203.0.113.9"))
+	assert.Equal(t, smtpd.Error{Code: 554, Message: "5.7.1 Service unavailable; client host [203.0.113.9] blocked using bl.example"}, err)
+	assert.NoError(t, mx.connectionChecker(peer("203.0.113.10")))
+	assert.NoError(t, mx.connectionChecker(peer("198.51.100.1")))
+
+	// Anyone may send to us on port 25, submission requires authentication or an allowed network
+	assert.NoError(t, mx.senderChecker(peer("198.51.100.1"), "someone@example.org"))
+	assert.Equal(t, smtpd.Error{Code: 530, Message: "5.7.0 Authentication required"}, submission.senderChecker(peer("198.51.100.1"), "someone@example.org"))
+	assert.NoError(t, submission.senderChecker(peer("192.0.2.1"), "someone@example.org"))
+	authenticated := peer("198.51.100.1")
+	authenticated.Username = "someone@example.org"
+	assert.NoError(t, submission.senderChecker(authenticated, "someone@example.org"))
+	assert.NoError(t, submission.senderChecker(authenticated, "alias@EXAMPLE.org"))
+	assert.Equal(t, errForeignSender, submission.senderChecker(authenticated, "someone@example.net"))
+	assert.True(t, submission.relayAllowed(peer("192.0.2.1")))
+	assert.False(t, mx.relayAllowed(peer("192.0.2.1")))
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks("127.0.0.0/8 ::1/128 192.0.2.1")
+	assert.NoError(t, err)
+	assert.Len(t, networks, 3)
+	assert.True(t, inNetworks(net.ParseIP("192.0.2.1"), networks))
+	assert.False(t, inNetworks(net.ParseIP("192.0.2.2"), networks))
+	assert.True(t, inNetworks(net.ParseIP("::1"), networks))
+
+	_, err = parseNetworks("localhost")
+	assert.Error(t, err)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// The server receives mail for -domain and the domains of -domains. The
+// primary -domain also hosts the web pages and payment links, and sends the
+// bounces and notices of the server. Mailboxes are told apart by their full
+// address, so alice@a.com and alice@b.com are different mailboxes.
+
+// dkimKey signs the outbound mail of a domain, configured with -dkim_keys
+type dkimKey struct {
+	selector string
+	signer   crypto.Signer
+}
+
+var domainPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)+$|^localhost$`)
+
+// parseDomains lists the primary and the additional space separated domains, lowercase and without duplicates
+func parseDomains(primary, additional string) ([]string, error) {
+	var domains []string
+	seen := map[string]bool{}
+	for _, field := range append([]string{primary}, strings.Fields(additional)...) {
+		name := strings.ToLower(strings.TrimSuffix(field, "."))
+		if !domainPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid domain %q", field)
+		}
+		if !seen[name] {
+			seen[name] = true
+			domains = append(domains, name)
+		}
+	}
+	return domains, nil
+}
+
+// parseDKIMKeys parses space separated domain=selector:keyfile entries of served domains
+func parseDKIMKeys(str string, domains []string) (map[string]dkimKey, error) {
+	keys := map[string]dkimKey{}
+	for _, field := range strings.Fields(str) {
+		name, key, ok := strings.Cut(field, "=")
+		selector, path, ok2 := strings.Cut(key, ":")
+		if !ok || !ok2 || selector == "" || path == "" {
+			return nil, fmt.Errorf("invalid key %q, expected domain=selector:keyfile", field)
+		}
+		name = strings.ToLower(name)
+		if !containsDomain(domains, name) {
+			return nil, fmt.Errorf("key for %q, which is not a served domain", name)
+		}
+		if _, ok := keys[name]; ok {
+			return nil, fmt.Errorf("more than one key for %q", name)
+		}
+		signer, err := readPrivateKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys[name] = dkimKey{selector, signer}
+	}
+	return keys, nil
+}
+
+// readPrivateKey reads a PEM encoded PKCS #8, PKCS #1 or EC private key
+func readPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key crypto.PrivateKey
+	if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("%s: unsupported private key", path)
+			}
+		}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported private key", path)
+	}
+	return signer, nil
+}
+
+func containsDomain(domains []string, name string) bool {
+	for _, d := range domains {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addressDomain is the lowercase domain of an address
+func addressDomain(address string) string {
+	idx := strings.LastIndex(address, "@")
+	if idx < 0 {
+		return ""
+	}
+	return strings.ToLower(address[idx+1:])
+}
+
+// isServedDomain tells whether the server receives mail for the exact domain
+func isServedDomain(domain string) bool {
+	return containsDomain(servedDomains, strings.ToLower(domain))
+}
+
+// mailboxKey is the name the stores keep a mailbox under: the lowercase
+// full address, escaped to be a single path element
+func mailboxKey(address string) string {
+	return url.PathEscape(strings.ToLower(address))
+}
+
+// payUser is the user in payment links: the local part for the primary
+// domain, as the links always were, the full address for other domains
+func payUser(address string) string {
+	if idx := strings.LastIndex(address, "@"); idx > 0 && strings.EqualFold(address[idx+1:], *domain) {
+		return address[:idx]
+	}
+	return address
+}
+
+// payAddress is the address of a user of a payment link
+func payAddress(user string) string {
+	if strings.Contains(user, "@") {
+		return user
+	}
+	return user + "@" + *domain
+}
+
+// migrateMailboxDirs renames the directories of mailboxes that were stored by
+// local part only, before there were multiple domains, to the keys of their
+// addresses at the primary domain
+func migrateMailboxDirs(root, primary string, logger *zap.Logger) error {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to migrate mailboxes")
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || strings.HasPrefix(name, ".") || strings.Contains(name, "@") {
+			continue
+		}
+		key := mailboxKey(name + "@" + primary)
+		target := filepath.Join(root, key)
+		if _, err := os.Stat(target); err == nil {
+			logger.Warn("Not migrating mailbox, its new directory exists", zap.String("dir", name), zap.String("mailbox", key))
+			continue
+		}
+		if err := os.Rename(filepath.Join(root, name), target); err != nil {
+			return errors.Wrap(err, "failed to migrate mailboxes")
+		}
+		logger.Info("Migrated mailbox directory", zap.String("dir", name), zap.String("mailbox", key))
+	}
+	return nil
+}
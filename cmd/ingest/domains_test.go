@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// restoreDomains resets the domains derived from the configuration when the test ends
+func restoreDomains(t *testing.T) {
+	restoreFlags(t)
+	domains, keys := servedDomains, dkimKeys
+	t.Cleanup(func() { servedDomains, dkimKeys = domains, keys })
+}
+
+func writeKey(t *testing.T) (string, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	return path, key
+}
+
+func TestServedDomains(t *testing.T) {
+	restoreDomains(t)
+	path, key := writeKey(t)
+	err := loadConfig([]string{"-domain", "Example.org", "-domains", "example.net example.org mail.example.com.", "-dkim_keys", "example.net=s2022:" + path})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.org", "example.net", "mail.example.com"}, servedDomains)
+
+	// Domains match exactly
+	assert.True(t, isServedDomain(addressDomain("alice@EXAMPLE.net")))
+	assert.False(t, isServedDomain(addressDomain("alice@evil-example.org")))
+	assert.False(t, isServedDomain(addressDomain("alice@sub.example.org")))
+	assert.False(t, isServedDomain(addressDomain("example.org")))
+
+	// A domain signs with its own key, others with the certificate for the primary domain
+	opts, err := dkimOpts(nil, "Example.net", zap.NewNop())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "example.net", opts.Domain)
+		assert.Equal(t, "s2022", opts.Selector)
+		assert.Equal(t, key.Public(), opts.Signer.Public())
+	}
+	assert.Contains(t, dkimRecord(opts.Signer), `"v=DKIM1; k=rsa; p=`)
+
+	err = loadConfig([]string{"-domains", "example.net ex@mple.org", "-dkim_keys", "example.net=s2022"})
+	assert.ErrorContains(t, err, "domains: ")
+	err = loadConfig([]string{"-domains", "example.net", "-dkim_keys", "example.com=s2022:" + path})
+	assert.ErrorContains(t, err, "dkim_keys: ")
+	err = loadConfig([]string{"-domains", "example.net", "-dkim_keys", "example.net=s2022:" + path + ".missing"})
+	assert.ErrorContains(t, err, "dkim_keys: ")
+}
+
+func TestMailboxKeys(t *testing.T) {
+	restoreDomains(t)
+	assert.NoError(t, loadConfig([]string{"-domain", "ptsm.q42.com", "-domains", "example.org"}))
+	assert.Equal(t, "alice@example.org", mailboxKey("Alice@Example.org"))
+	assert.Equal(t, "..%2Falice@example.org", mailboxKey("../alice@example.org"))
+
+	assert.Equal(t, "herman", payUser("herman@ptsm.q42.com"))
+	assert.Equal(t, "herman@example.org", payUser("herman@example.org"))
+	assert.Equal(t, "herman@ptsm.q42.com", payAddress("herman"))
+	assert.Equal(t, "herman@example.org", payAddress("herman@example.org"))
+
+	// Mailboxes of the same user at different domains are distinct
+	mails := newMaildirStore(t.TempDir(), zap.NewNop())
+	_, err := mails.Append("alice@ptsm.q42.com", "INBOX", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	list, err := mails.List("alice@example.org", "INBOX")
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+	list, err = mails.List("ALICE@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestMigrateMailboxDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"herman/new", "alice/new", "alice@ptsm.q42.com/new", "bob@example.org/new", ".trash"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0700))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "herman", "new", "1.eml"), []byte(body), 0600))
+
+	assert.NoError(t, migrateMailboxDirs(root, "ptsm.q42.com", zap.NewNop()))
+	assert.FileExists(t, filepath.Join(root, "herman@ptsm.q42.com", "new", "1.eml"))
+	assert.NoDirExists(t, filepath.Join(root, "herman"))
+	// Existing mailboxes are not overwritten
+	assert.DirExists(t, filepath.Join(root, "alice"))
+	assert.DirExists(t, filepath.Join(root, "bob@example.org"))
+	assert.DirExists(t, filepath.Join(root, ".trash"))
+
+	assert.NoError(t, migrateMailboxDirs(filepath.Join(root, "missing"), "ptsm.q42.com", zap.NewNop()))
+}
@@ -5,140 +5,244 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
-	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chrj/smtpd"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
-var (
-	ports = []int{465, 587, 2525, 25}
-)
-
-// TODO use a PubSub queue for this
-// copyright: https://github.com/nilslice/email/blob/master/email.go
+// emit queues the mail for delivery to the servers of the recipients
 func (w wrap) emit(ctx context.Context, env smtpd.Envelope) error {
-	if true {
-		for _, rec := range env.Recipients {
-			host := strings.Split(rec, "@")[1]
-			addrs, err := net.DefaultResolver.LookupMX(ctx, host)
-			sort.Slice(addrs, func(i, j int) bool { return addrs[i].Pref < addrs[j].Pref })
-			if err != nil {
-				return errors.Wrap(err, "failed to lookup mx")
-			}
-			if len(addrs) == 0 {
-				return errors.Wrap(err, "no mx servers")
-			}
-			// Hardcode 25 because this supports STARTLS too and does not block like 587 seems to do
-			// which does work with % openssl s_client -host smtp.gmail.com -port 587 -starttls smtp -crlf
-			err = smtp.SendMail(addrs[0].Host+":25", nil, env.Sender, env.Recipients, env.Data)
-			if err != nil {
-				return errors.Wrap(err, "failed to create outgoing connection")
-			}
-		}
-		return nil
+	if w.queue == nil {
+		return errors.New("no outbound queue")
 	}
+	_, err := w.queue.Enqueue(env)
+	return err
+}
 
-	// Way to complicated
-	for _, r := range env.Recipients {
-		addr, err := mail.ParseAddress(r)
-		if err != nil {
-			return errors.Wrap(err, "failed to parse address")
-		}
+// deliveryResult is the outcome of delivering a mail to one recipient
+type deliveryResult struct {
+	Recipient string
+	Err       error
+}
 
-		host := strings.Split(addr.Address, "@")[1]
-		addrs, err := net.DefaultResolver.LookupMX(ctx, host)
-		if err != nil {
-			return errors.Wrap(err, "failed to lookup mx")
-		}
+// deliverer sends mail directly to the mail exchangers of the recipient domains
+type deliverer struct {
+	logger   *zap.Logger
+	hostname string
+	dns      resolver
+	// ports are tried in order on every address: 465 uses implicit TLS,
+	// other ports upgrade with STARTTLS when the server offers it
+	ports []int
+	dial  func(ctx context.Context, network, address string) (net.Conn, error)
+	tls   *tlsPolicies
+}
 
-		c, err := newClient(ctx, addrs, ports)
-		if err != nil {
-			return errors.Wrap(err, "failed to create outgoing connection")
-		}
+func newDeliverer(logger *zap.Logger) (*deliverer, error) {
+	ports, err := parsePorts(*outboundPorts)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := newTLSPolicies(logger.Named("tls"), net.DefaultResolver)
+	if err != nil {
+		return nil, err
+	}
+	return &deliverer{
+		logger:   logger,
+		hostname: *hostName,
+		dns:      net.DefaultResolver,
+		ports:    ports,
+		dial:     (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		tls:      policies,
+	}, nil
+}
 
-		err = send(env, c, r)
-		if err != nil {
-			return errors.Wrap(err, "failed to send email")
+func parsePorts(str string) (ports []int, err error) {
+	for _, field := range strings.Fields(str) {
+		port, err := strconv.Atoi(field)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", field)
 		}
+		ports = append(ports, port)
+	}
+	if len(ports) == 0 {
+		return nil, errors.New("no outbound ports")
+	}
+	return ports, nil
+}
+
+// Deliver sends the mail per recipient domain, so one failing domain does not affect the others
+func (d *deliverer) Deliver(ctx context.Context, env smtpd.Envelope) []deliveryResult {
+	var results []deliveryResult
+	domains, byDomain := groupByDomain(env.Recipients)
+	for _, domain := range domains {
+		results = append(results, d.deliverDomain(ctx, domain, env.Sender, byDomain[domain], env.Data)...)
 	}
-	return nil
+	return results
 }
 
-func newClient(ctx context.Context, mx []*net.MX, ports []int) (*smtp.Client, error) {
-	sort.Slice(mx, func(i, j int) bool { return mx[i].Pref < mx[j].Pref })
-	opts := 0
-	for range mx {
-		for range ports {
-			opts++
+// groupByDomain groups the recipients by their (lowercase) domain, in order of appearance
+func groupByDomain(recipients []string) ([]string, map[string][]string) {
+	var domains []string
+	byDomain := make(map[string][]string)
+	for _, rec := range recipients {
+		domain := strings.ToLower(rec[strings.LastIndex(rec, "@")+1:])
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
 		}
+		byDomain[domain] = append(byDomain[domain], rec)
+	}
+	return domains, byDomain
+}
+
+func (d *deliverer) deliverDomain(ctx context.Context, domain, sender string, recipients []string, data []byte) []deliveryResult {
+	hosts, err := d.exchangers(ctx, domain)
+	if err != nil {
+		return failAll(recipients, err)
 	}
 
-	pos := 0
-	for i := range mx {
-		for j := range ports {
-			pos++
-			zap.S().Debugf("mx=%s port=%d", mx[i].Host, ports[j])
-			server := strings.TrimSuffix(mx[i].Host, ".")
-			hostPort := fmt.Sprintf("%s:%d", server, ports[j])
-			var client *smtp.Client
-			var err error
-			var conn net.Conn
-			if ports[j] == 465 {
-				conn, err = tls.Dial("tcp", hostPort, &tls.Config{})
+	mxSecure, err := d.tls.secureMX(ctx, domain)
+	if err != nil {
+		return failAll(recipients, err)
+	}
+	sts := d.tls.domainPolicy(ctx, domain)
+	lastErr := fmt.Errorf("no mail exchanger of %s could be reached", domain)
+	for _, host := range hosts {
+		if sts != nil && !sts.matches(host) {
+			d.logger.Warn("Skipping mail exchanger not allowed by MTA-STS policy", zap.String("domain", domain), zap.String("mx", host))
+			lastErr = fmt.Errorf("mta-sts: mail exchanger %s of %s is not in the policy", host, domain)
+			continue
+		}
+		addrs, err := d.dns.LookupIPAddr(ctx, host)
+		if err != nil {
+			d.logger.Debug("Failed to resolve mail exchanger", zap.String("mx", host), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		for _, addr := range addrs {
+			for _, port := range d.ports {
+				results, err := d.session(ctx, host, net.JoinHostPort(addr.IP.String(), strconv.Itoa(port)), port, mxSecure, sts, sender, recipients, data)
 				if err == nil {
-					client, err = smtp.NewClient(conn, server)
+					return results
 				}
-			} else {
-				client, err = smtp.Dial(hostPort)
-				if ports[j] == 587 && err == nil {
-					err = client.StartTLS(&tls.Config{})
-				}
-			}
-			if err != nil {
-				if j == len(ports)-1 {
-					return nil, err
+				lastErr = err
+				if !temporaryFailure(err) {
+					return failAll(recipients, err)
 				}
-				zap.S().With(zap.Error(err)).Warnf("failure sending, trying one of next %d options", opts-pos)
-				continue
+				d.logger.Debug("Failed to deliver, trying next option", zap.String("mx", host), zap.String("address", addr.IP.String()), zap.Int("port", port), zap.Error(err))
 			}
-
-			return client, nil
 		}
 	}
-
-	return nil, fmt.Errorf("couldn't connect to servers %v on any common port", mx)
+	return failAll(recipients, lastErr)
 }
 
-func send(env smtpd.Envelope, c *smtp.Client, r string) error {
-	if err := c.Mail(env.Sender); err != nil {
-		return err
+// exchangers lists the mail exchangers of the domain in order of preference,
+// or the domain itself when it has no MX records (RFC 5321 §5.1)
+func (d *deliverer) exchangers(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := d.dns.LookupMX(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return nil, errors.Wrap(err, "failed to lookup mx")
 	}
-
-	if err := c.Rcpt(r); err != nil {
-		return err
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		// Null MX (RFC 7505)
+		return nil, &textproto.Error{Code: 556, Msg: fmt.Sprintf("5.1.10 Domain %s does not accept mail", domain)}
 	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
 
-	msg, err := c.Data()
+// session delivers the mail in a single SMTP session. Failures of individual
+// recipients are reported in the results, failures of the session as error.
+func (d *deliverer) session(ctx context.Context, host, address string, port int, mxSecure bool, sts *stsPolicy, sender string, recipients []string, data []byte) ([]deliveryResult, error) {
+	tlsConfig, tlsRequired, err := d.tls.hostConfig(ctx, host, port, mxSecure, sts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	_, err = msg.Write(env.Data)
+	conn, err := d.dial(ctx, "tcp", address)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
 	}
-	err = msg.Close()
+	if port == 465 {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	c, err := smtp.NewClient(conn, host)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+
+	if err = c.Hello(d.hostname); err != nil {
+		return nil, err
 	}
-	err = c.Quit()
+	if ok, _ := c.Extension("STARTTLS"); ok && port != 465 {
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return nil, err
+		}
+	} else if !ok && port != 465 && tlsRequired {
+		return nil, errTLSRequired
+	}
+	return transaction(c, sender, recipients, data)
+}
+
+// transaction sends the mail over an established session
+func transaction(c *smtp.Client, sender string, recipients []string, data []byte) (results []deliveryResult, err error) {
+	if err = c.Mail(sender); err != nil {
+		return nil, err
+	}
+
+	accepted := 0
+	for _, rec := range recipients {
+		err := c.Rcpt(rec)
+		results = append(results, deliveryResult{Recipient: rec, Err: err})
+		if err == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		c.Quit()
+		return results, nil
+	}
+
+	w, err := c.Data()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	c.Quit()
+	return results, nil
+}
+
+func failAll(recipients []string, err error) []deliveryResult {
+	results := make([]deliveryResult, len(recipients))
+	for i, rec := range recipients {
+		results[i] = deliveryResult{Recipient: rec, Err: err}
 	}
-	return nil
+	return results
 }
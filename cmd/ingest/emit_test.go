@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"sync"
+	"testing"
+
+	"github.com/chrj/smtpd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// testMailServer accepts mail for everyone except unknown@ addresses
+func testMailServer(t *testing.T) (string, func() []smtpd.Envelope) {
+	var mu sync.Mutex
+	var received []smtpd.Envelope
+	server := &smtpd.Server{
+		Hostname: "mx.example.net",
+		RecipientChecker: func(peer smtpd.Peer, addr string) error {
+			if addr == "unknown@example.net" {
+				return smtpd.Error{Code: 550, Message: "5.1.1 No such user"}
+			}
+			return nil
+		},
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, env)
+			return nil
+		},
+	}
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(lsnr)
+	t.Cleanup(func() { server.Shutdown(false) })
+	return lsnr.Addr().String(), func() []smtpd.Envelope {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+}
+
+func TestDeliverer(t *testing.T) {
+	addr, received := testMailServer(t)
+	dns := fakeResolver{
+		ip: map[string][]string{
+			"mx1.example.net": {"192.0.2.1"},
+			"mx2.example.net": {"192.0.2.2"},
+			"example.org":     {"192.0.2.2"},
+		},
+		mx: map[string][]*net.MX{
+			"example.net":      {{Host: "mx2.example.net.", Pref: 20}, {Host: "mx1.example.net.", Pref: 10}},
+			"null.example":     {{Host: ".", Pref: 0}},
+			"unreachable.test": {{Host: "mx1.example.net.", Pref: 10}},
+		},
+	}
+	var dialed []string
+	d := &deliverer{
+		logger:   zap.NewNop(),
+		hostname: "mail.example.com",
+		dns:      dns,
+		ports:    []int{25},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			if address == "192.0.2.2:25" {
+				return net.Dial(network, addr)
+			}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "connection refused", IsTemporary: true}}
+		},
+	}
+
+	results := d.Deliver(context.Background(), smtpd.Envelope{
+		Sender:     "herman@example.com",
+		Recipients: []string{"a@example.net", "unknown@example.net", "b@null.example", "c@example.org", "d@nowhere.example", "e@EXAMPLE.net", "f@unreachable.test"},
+		Data:       []byte("Subject: Hi\r\n\r\nHello\r\n"),
+	})
+
+	errs := map[string]error{}
+	for _, res := range results {
+		errs[res.Recipient] = res.Err
+	}
+	assert.Len(t, errs, 7)
+	assert.NoError(t, errs["a@example.net"])
+	assert.NoError(t, errs["e@EXAMPLE.net"])
+	assert.Equal(t, 550, errs["unknown@example.net"].(*textproto.Error).Code)
+	assert.Equal(t, 556, errs["b@null.example"].(*textproto.Error).Code)
+	assert.NoError(t, errs["c@example.org"], "implicit MX")
+	assert.False(t, temporaryFailure(errs["d@nowhere.example"]))
+	assert.True(t, temporaryFailure(errs["f@unreachable.test"]))
+
+	// The preferred MX is tried first
+	assert.Equal(t, []string{"192.0.2.1:25", "192.0.2.2:25", "192.0.2.2:25", "192.0.2.1:25"}, dialed)
+
+	mails := received()
+	assert.Len(t, mails, 2)
+	assert.Equal(t, []string{"a@example.net", "e@EXAMPLE.net"}, mails[0].Recipients)
+	assert.Equal(t, []string{"c@example.org"}, mails[1].Recipients)
+}
+
+func TestGroupByDomain(t *testing.T) {
+	domains, byDomain := groupByDomain([]string{"a@b.example", "c@d.example", "e@B.example"})
+	assert.Equal(t, []string{"b.example", "d.example"}, domains)
+	assert.Equal(t, []string{"a@b.example", "e@B.example"}, byDomain["b.example"])
+}
@@ -2,49 +2,17 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"path"
-	"sort"
-	"strings"
 	"time"
 	"unicode/utf8"
 
 	"cloud.google.com/go/firestore"
-	"github.com/bcampbell/tameimap/store"
 	"github.com/chrj/smtpd"
-	"github.com/emersion/go-imap"
-	"github.com/emersion/go-imap/backend"
-	"github.com/emersion/go-imap/backend/memory"
 	"go.uber.org/zap"
 	"google.golang.org/api/iterator"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func FirestoreAuthenticator(ctx context.Context, logger *zap.Logger, peer smtpd.Peer, username, password string) error {
-	db, err := firestore.NewClient(ctx, firestore.DetectProjectID)
-	if err != nil {
-		return err
-	}
-	it := db.Collection("mailboxes").Doc(username).Collection("appkeys").Documents(ctx)
-	for {
-		doc, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		data := doc.Data()
-		if data["version"] == "v1" && data["key"] == password {
-			logger.Info("Logged in", zap.String("username", username))
-			return nil
-		}
-	}
-	logger.Warn("Login not found", zap.String("username", username))
-	return fmt.Errorf("not found")
-}
-
 func FirestoreBackend(ctx context.Context) (firestoreBackend, error) {
 	db, err := firestore.NewClient(ctx, firestore.DetectProjectID)
 	if err != nil {
@@ -62,15 +30,6 @@ func (b firestoreBackend) FindUser(webLogin string) (mail string, err error) {
 	return doc.Ref.ID, nil
 }
 
-func (b firestoreBackend) AddAppKey(mail string, key string) (err error) {
-	_, _, err = b.db.Collection("mailboxes").Doc(mail).Collection("appkeys").Add(b.ctx, map[string]interface{}{
-		"key":     key,
-		"date":    time.Now(),
-		"version": "v1",
-	})
-	return err
-}
-
 func (b firestoreBackend) Exists(mail string) (exists bool, err error) {
 	_, err = b.db.Collection("mailboxes").Doc(mail).Get(b.ctx)
 	if err == nil {
@@ -87,30 +46,9 @@ type firestoreBackend struct {
 	ctx context.Context
 }
 
-// Login implements backend.Backend
-func (b firestoreBackend) Login(connInfo *imap.ConnInfo, username string, password string) (backend.User, error) {
-	docs := b.db.Collection("mailboxes").Doc(username).Collection("appkeys").Documents(b.ctx)
-	for {
-		doc, err := docs.Next()
-		if err == iterator.Done {
-			break
-		}
-		data := doc.Data()
-		if data["version"] == "v1" && data["key"] == password {
-			var u backend.User
-			u, err := store.NewUser(path.Join("mails", emailUserName(username)), emailUserName(username), password)
-			u = &loggingBackendUser{u, zap.L()}
-			if err != nil {
-				return nil, err
-			}
-			return u, nil
-		}
-	}
-	return nil, backend.ErrInvalidCredentials
-}
-
-func (b firestoreBackend) QuarantineEmail(receipientEmail string, id string, env smtpd.Envelope) (err error) {
-	data := map[string]interface{}{"sender": env.Sender, "date": time.Now(), "subject": mustGetSubject(env)}
+func (b firestoreBackend) QuarantineEmail(receipientEmail string, id string, stored StoredMessage, env smtpd.Envelope, verdict authVerdict) (err error) {
+	data := map[string]interface{}{"sender": env.Sender, "date": time.Now(), "subject": mustGetSubject(env), "auth": verdict.data(),
+		"uid": stored.UID, "uidValidity": stored.UIDValidity}
 	if utf8.ValidString(string(env.Data)) {
 		data["data"] = string(env.Data)
 	}
@@ -118,143 +56,104 @@ func (b firestoreBackend) QuarantineEmail(receipientEmail string, id string, env
 	return err
 }
 
-var _ backend.Backend = firestoreBackend{}
-
-type firestoreUserBackend struct {
-	db        *firestore.Client
-	ctx       context.Context
-	email     string
-	mailboxes map[string][]*memory.Message
-}
-
-// CreateMailbox implements backend.User
-func (u firestoreUserBackend) CreateMailbox(name string) error {
-	return fmt.Errorf("not implemented")
-}
-
-// DeleteMailbox implements backend.User
-func (u firestoreUserBackend) DeleteMailbox(name string) error {
-	return fmt.Errorf("not implemented")
-}
-
-// GetMailbox implements backend.User
-func (u firestoreUserBackend) GetMailbox(name string) (backend.Mailbox, error) {
-	_, hasMailbox := u.mailboxes[name]
-	if !hasMailbox {
-		return nil, fmt.Errorf("not found")
+// Allowlisted implements paymentStore
+func (b firestoreBackend) Allowlisted(recipient, sender string) (bool, error) {
+	list, err := b.Allowlist(recipient)
+	if err != nil {
+		return false, err
 	}
-	// return m, nil
-	return nil, nil
+	return allowlisted(list, sender), nil
 }
 
-// ListMailboxes implements backend.User
-func (u firestoreUserBackend) ListMailboxes(subscribed bool) (out []backend.Mailbox, err error) {
-	for _, _ = range u.mailboxes {
-		// out = append(out, m)
+// ThreadPaid implements paymentStore
+func (b firestoreBackend) ThreadPaid(recipient, sender string, messageIDs []string) (bool, error) {
+	threads := b.db.Collection("mailboxes").Doc(recipient).Collection("threads")
+	refs := make([]*firestore.DocumentRef, len(messageIDs))
+	for i, id := range messageIDs {
+		refs[i] = threads.Doc(threadKey(id))
 	}
-	sort.Slice(out, func(i, j int) bool { return strings.Compare(out[i].Name(), out[j].Name()) >= 0 })
-	return out, nil
-}
-
-// Logout implements backend.User
-func (u firestoreUserBackend) Logout() error {
-	return nil
-}
-
-// RenameMailbox implements backend.User
-func (u firestoreUserBackend) RenameMailbox(existingName string, newName string) error {
-	return fmt.Errorf("not implemented")
-}
-
-// Username implements backend.User
-func (u firestoreUserBackend) Username() string {
-	return u.email
-}
-
-var _ backend.User = firestoreUserBackend{}
-
-type firebaseUserMailbox []*memory.Message
-
-// Check implements backend.Mailbox
-func (*firebaseUserMailbox) Check() error {
-	panic("unimplemented")
-}
-
-// CopyMessages implements backend.Mailbox
-func (*firebaseUserMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
-	panic("unimplemented")
-}
-
-// CreateMessage implements backend.Mailbox
-func (*firebaseUserMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
-	panic("unimplemented")
-}
-
-// Expunge implements backend.Mailbox
-func (*firebaseUserMailbox) Expunge() error {
-	panic("unimplemented")
-}
-
-// Info implements backend.Mailbox
-func (*firebaseUserMailbox) Info() (*imap.MailboxInfo, error) {
-	panic("unimplemented")
+	docs, err := b.db.GetAll(b.ctx, refs)
+	if err != nil {
+		return false, err
+	}
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		var thread struct {
+			Correspondents []string `firestore:"correspondents"`
+		}
+		if err = doc.DataTo(&thread); err != nil {
+			return false, err
+		}
+		for _, c := range thread.Correspondents {
+			if c == correspondent(sender) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
 }
 
-// ListMessages implements backend.Mailbox
-func (*firebaseUserMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
-	panic("unimplemented")
+// MarkThreadSent implements paymentStore
+func (b firestoreBackend) MarkThreadSent(mailbox, messageID string, recipients []string) error {
+	correspondents := make([]interface{}, len(recipients))
+	for i, rec := range recipients {
+		correspondents[i] = correspondent(rec)
+	}
+	_, err := b.db.Collection("mailboxes").Doc(mailbox).Collection("threads").Doc(threadKey(messageID)).Set(b.ctx, map[string]interface{}{
+		"messageId":      messageID,
+		"date":           time.Now(),
+		"correspondents": firestore.ArrayUnion(correspondents...),
+	}, firestore.MergeAll)
+	return err
 }
 
-// Name implements backend.Mailbox
-func (*firebaseUserMailbox) Name() string {
-	panic("unimplemented")
+// Pricing implements paymentStore
+func (b firestoreBackend) Pricing(recipient string) (Pricing, error) {
+	doc, err := b.db.Collection("mailboxes").Doc(recipient).Get(b.ctx)
+	if err != nil {
+		return Pricing{}, err
+	}
+	if _, err = doc.DataAt("pricing"); err != nil {
+		return DefaultPricing, nil
+	}
+	var data struct {
+		Pricing Pricing `firestore:"pricing"`
+	}
+	err = doc.DataTo(&data)
+	return data.Pricing, err
 }
 
-// SearchMessages implements backend.Mailbox
-func (*firebaseUserMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
-	panic("unimplemented")
+func (b firestoreBackend) SetPricing(mailbox string, p Pricing) error {
+	_, err := b.db.Collection("mailboxes").Doc(mailbox).Update(b.ctx, []firestore.Update{{Path: "pricing", Value: p}})
+	return err
 }
 
-// SetSubscribed implements backend.Mailbox
-func (*firebaseUserMailbox) SetSubscribed(subscribed bool) error {
-	panic("unimplemented")
+// RepeatSender implements paymentStore
+func (b firestoreBackend) RepeatSender(recipient, sender string) (bool, error) {
+	_, err := b.db.Collection("balance").Doc(sender).Collection("transactions").
+		Where("recipient", "==", recipient).Limit(1).Documents(b.ctx).Next()
+	if err == iterator.Done {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-// Status implements backend.Mailbox
-func (*firebaseUserMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
-	panic("unimplemented")
+// Debit implements paymentStore
+func (b firestoreBackend) Debit(sender, recipient, messageID, bodyHash string, amount int64) error {
+	return b.Ledger().Debit(sender, recipient, messageID, bodyHash, amount)
 }
 
-// UpdateMessagesFlags implements backend.Mailbox
-func (*firebaseUserMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
-	panic("unimplemented")
+// asInt64 reads numbers, which Firestore stores as either integer or double
+func asInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
 }
 
-var _ backend.Mailbox = &firebaseUserMailbox{}
-
-var body = "From: contact@example.org\r\n" +
-	"To: contact@example.org\r\n" +
-	"Subject: A little message, just for you\r\n" +
-	"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
-	"Message-ID: <0000000@localhost/>\r\n" +
-	"Content-Type: text/plain\r\n" +
-	"\r\n" +
-	"Hi there :)"
-
-func unused(b *firestoreBackend) {
-	var username string
-	// TODO implement full spec
-	_ = firestoreUserBackend{b.db, b.ctx, username, map[string][]*memory.Message{
-		"INBOX": {
-			{
-				Uid:   6,
-				Date:  time.Now(),
-				Flags: []string{"\\Seen"},
-				Size:  uint32(len(body)),
-				Body:  []byte(body),
-			},
-		},
-	}}
-
-	_, _ = memory.New().Login(nil, "username", "password")
-}
+var _ paymentStore = firestoreBackend{}
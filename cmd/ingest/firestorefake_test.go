@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeFirestore keeps documents in memory for the tests of the stores, when
+// the emulator is not running. It has the reads, writes and queries the
+// stores use, and runs transactions without isolation.
+type fakeFirestore struct {
+	pb.UnimplementedFirestoreServer
+	mu   sync.Mutex
+	docs map[string]*pb.Document
+	// queried counts the documents returned by queries
+	queried int
+}
+
+// newFakeFirestore serves a fakeFirestore and returns a client of it
+func newFakeFirestore(t *testing.T) (*firestore.Client, *fakeFirestore) {
+	fake := &fakeFirestore{docs: map[string]*pb.Document{}}
+	srv := grpc.NewServer()
+	pb.RegisterFirestoreServer(srv, fake)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := firestore.NewClient(context.Background(), "ptsm-test", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+// returned is the number of documents returned by queries since the last call
+func (f *fakeFirestore) returned() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.queried
+	f.queried = 0
+	return n
+}
+
+func (f *fakeFirestore) BatchGetDocuments(req *pb.BatchGetDocumentsRequest, stream pb.Firestore_BatchGetDocumentsServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range req.Documents {
+		res := &pb.BatchGetDocumentsResponse{ReadTime: timestamppb.Now()}
+		if doc, ok := f.docs[name]; ok {
+			res.Result = &pb.BatchGetDocumentsResponse_Found{Found: doc}
+		} else {
+			res.Result = &pb.BatchGetDocumentsResponse_Missing{Missing: name}
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeFirestore) BeginTransaction(ctx context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	return &pb.BeginTransactionResponse{Transaction: []byte("fake")}, nil
+}
+
+func (f *fakeFirestore) Rollback(ctx context.Context, req *pb.RollbackRequest) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, nil
+}
+
+// Commit applies all writes or none, checking their preconditions
+func (f *fakeFirestore) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := timestamppb.Now()
+	written := map[string]*pb.Document{}
+	current := func(name string) *pb.Document {
+		if doc, ok := written[name]; ok {
+			return doc
+		}
+		return f.docs[name]
+	}
+	res := &pb.CommitResponse{CommitTime: now}
+	for _, w := range req.Writes {
+		if len(w.UpdateTransforms) > 0 {
+			return nil, status.Error(codes.Unimplemented, "transforms")
+		}
+		name := w.GetUpdate().GetName()
+		if w.GetDelete() != "" {
+			name = w.GetDelete()
+		}
+		cur := current(name)
+		if cd := w.CurrentDocument; cd != nil {
+			if exists, ok := cd.ConditionType.(*pb.Precondition_Exists); !ok {
+				return nil, status.Error(codes.Unimplemented, "update time precondition")
+			} else if exists.Exists && cur == nil {
+				return nil, status.Errorf(codes.NotFound, "no document %s", name)
+			} else if !exists.Exists && cur != nil {
+				return nil, status.Errorf(codes.AlreadyExists, "document %s exists", name)
+			}
+		}
+		if w.GetDelete() != "" {
+			written[name] = nil
+		} else {
+			doc := &pb.Document{Name: name, Fields: map[string]*pb.Value{}, CreateTime: now, UpdateTime: now}
+			if cur != nil {
+				doc.CreateTime = cur.CreateTime
+				if w.UpdateMask != nil {
+					for k, v := range cur.Fields {
+						doc.Fields[k] = v
+					}
+				}
+			}
+			if w.UpdateMask == nil {
+				for k, v := range w.GetUpdate().Fields {
+					doc.Fields[k] = v
+				}
+			}
+			for _, path := range w.GetUpdateMask().GetFieldPaths() {
+				if v, ok := w.GetUpdate().Fields[path]; ok {
+					doc.Fields[path] = v
+				} else {
+					delete(doc.Fields, path)
+				}
+			}
+			written[name] = doc
+		}
+		res.WriteResults = append(res.WriteResults, &pb.WriteResult{UpdateTime: now})
+	}
+	for name, doc := range written {
+		if doc == nil {
+			delete(f.docs, name)
+		} else {
+			f.docs[name] = doc
+		}
+	}
+	return res, nil
+}
+
+// collection lists the documents in a collection, ordered by name
+func (f *fakeFirestore) collection(parent, id string) []*pb.Document {
+	var docs []*pb.Document
+	for name, doc := range f.docs {
+		if i := strings.LastIndexByte(name, '/'); name[:i] == parent+"/"+id {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+	return docs
+}
+
+func (f *fakeFirestore) ListDocuments(ctx context.Context, req *pb.ListDocumentsRequest) (*pb.ListDocumentsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := &pb.ListDocumentsResponse{}
+	for _, doc := range f.collection(req.Parent, req.CollectionId) {
+		res.Documents = append(res.Documents, &pb.Document{Name: doc.Name, CreateTime: doc.CreateTime, UpdateTime: doc.UpdateTime})
+	}
+	return res, nil
+}
+
+func (f *fakeFirestore) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	q := req.GetStructuredQuery()
+	if len(q.From) != 1 || q.From[0].AllDescendants || q.StartAt != nil || q.EndAt != nil {
+		return status.Error(codes.Unimplemented, "query")
+	}
+	f.mu.Lock()
+	var docs []*pb.Document
+	for _, doc := range f.collection(req.Parent, q.From[0].CollectionId) {
+		ok, err := fakeMatch(q.Where, doc)
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		if ok {
+			docs = append(docs, doc)
+		}
+	}
+	f.mu.Unlock()
+
+	// Ordered by the fields, then by name in the direction of the last field
+	orders := q.OrderBy
+	descending := len(orders) > 0 && orders[len(orders)-1].Direction == pb.StructuredQuery_DESCENDING
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, order := range orders {
+			c := fakeCompare(fakeField(docs[i], order.Field.FieldPath), fakeField(docs[j], order.Field.FieldPath))
+			if order.Direction == pb.StructuredQuery_DESCENDING {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return docs[i].Name < docs[j].Name != descending
+	})
+	if int(q.Offset) < len(docs) {
+		docs = docs[q.Offset:]
+	} else {
+		docs = nil
+	}
+	if q.Limit != nil && int(q.Limit.Value) < len(docs) {
+		docs = docs[:q.Limit.Value]
+	}
+
+	f.mu.Lock()
+	f.queried += len(docs)
+	f.mu.Unlock()
+	for _, doc := range docs {
+		if q.Select != nil {
+			projected := &pb.Document{Name: doc.Name, Fields: map[string]*pb.Value{}, CreateTime: doc.CreateTime, UpdateTime: doc.UpdateTime}
+			for _, field := range q.Select.Fields {
+				if v, ok := doc.Fields[field.FieldPath]; ok {
+					projected.Fields[field.FieldPath] = v
+				}
+			}
+			doc = projected
+		}
+		if err := stream.Send(&pb.RunQueryResponse{Document: doc, ReadTime: timestamppb.Now()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fakeField is a top-level field or the name of a document
+func fakeField(doc *pb.Document, path string) *pb.Value {
+	if path == "__name__" {
+		return &pb.Value{ValueType: &pb.Value_ReferenceValue{ReferenceValue: doc.Name}}
+	}
+	return doc.Fields[path]
+}
+
+func fakeMatch(filter *pb.StructuredQuery_Filter, doc *pb.Document) (bool, error) {
+	switch filter := filter.GetFilterType().(type) {
+	case nil:
+		return true, nil
+	case *pb.StructuredQuery_Filter_CompositeFilter:
+		for _, sub := range filter.CompositeFilter.Filters {
+			if ok, err := fakeMatch(sub, doc); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case *pb.StructuredQuery_Filter_FieldFilter:
+		v := fakeField(doc, filter.FieldFilter.Field.FieldPath)
+		if v == nil || fakeRank(v) != fakeRank(filter.FieldFilter.Value) {
+			// Fields of other types never match
+			return false, nil
+		}
+		c := fakeCompare(v, filter.FieldFilter.Value)
+		switch filter.FieldFilter.Op {
+		case pb.StructuredQuery_FieldFilter_LESS_THAN:
+			return c < 0, nil
+		case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+			return c <= 0, nil
+		case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+			return c > 0, nil
+		case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+			return c >= 0, nil
+		case pb.StructuredQuery_FieldFilter_EQUAL:
+			return c == 0, nil
+		}
+	}
+	return false, status.Errorf(codes.Unimplemented, "filter %v", filter)
+}
+
+// fakeRank orders the types of values as Firestore does
+func fakeRank(v *pb.Value) int {
+	switch v.GetValueType().(type) {
+	case *pb.Value_BooleanValue:
+		return 1
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return 2
+	case *pb.Value_TimestampValue:
+		return 3
+	case *pb.Value_StringValue:
+		return 4
+	case *pb.Value_BytesValue:
+		return 5
+	case *pb.Value_ReferenceValue:
+		return 6
+	}
+	return 0
+}
+
+func fakeCompare(a, b *pb.Value) int {
+	if ra, rb := fakeRank(a), fakeRank(b); ra != rb {
+		return ra - rb
+	}
+	number := func(v *pb.Value) float64 {
+		if i, ok := v.ValueType.(*pb.Value_IntegerValue); ok {
+			return float64(i.IntegerValue)
+		}
+		return v.GetDoubleValue()
+	}
+	switch a.GetValueType().(type) {
+	case *pb.Value_BooleanValue:
+		if a.GetBooleanValue() == b.GetBooleanValue() {
+			return 0
+		} else if b.GetBooleanValue() {
+			return -1
+		}
+		return 1
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		if x, y := number(a), number(b); x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case *pb.Value_TimestampValue:
+		if x, y := a.GetTimestampValue().AsTime(), b.GetTimestampValue().AsTime(); x.Before(y) {
+			return -1
+		} else if x.After(y) {
+			return 1
+		}
+		return 0
+	case *pb.Value_StringValue:
+		return strings.Compare(a.GetStringValue(), b.GetStringValue())
+	case *pb.Value_BytesValue:
+		return bytes.Compare(a.GetBytesValue(), b.GetBytesValue())
+	case *pb.Value_ReferenceValue:
+		return strings.Compare(a.GetReferenceValue(), b.GetReferenceValue())
+	}
+	return 0
+}
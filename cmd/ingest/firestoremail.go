@@ -0,0 +1,1038 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-message"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Mailboxes in Firestore are shared by all replicas, unlike those on the
+// local disk. The folders of a mailbox are documents in its "folders"
+// collection, holding the UIDVALIDITY, the next UID and the number of (unseen)
+// messages. Messages are documents in the "messages" collection of their
+// folder, with the flags and the id of their body, and are read by range of
+// uids or sequence numbers rather than all at once. Bodies are split over the
+// "chunks" of a document in "bodies", as a document can hold at most 1 MiB.
+
+const (
+	// firestoreChunkSize is the size of the chunks of a body
+	firestoreChunkSize = 512 * 1024
+	// firestoreBatchSize is the maximum number of writes in a batch
+	firestoreBatchSize = 500
+	// firestoreTxSize is the number of messages written in a transaction,
+	// leaving a write for their folder
+	firestoreTxSize = firestoreBatchSize - 1
+)
+
+// errMailboxExists has the message of tameimap, which ensureMailbox relies on
+var errMailboxExists = errors.New("Mailbox already exists")
+
+type folderDoc struct {
+	Name        string    `firestore:"name"`
+	UIDValidity uint32    `firestore:"uidValidity"`
+	UIDNext     uint32    `firestore:"uidNext"`
+	Subscribed  bool      `firestore:"subscribed"`
+	Created     time.Time `firestore:"created"`
+	// Messages and Unseen count the messages of the folder, they are kept by
+	// the transactions that add and remove messages. Folders stored before
+	// there were counts are counted when they are first read.
+	Messages uint32 `firestore:"messages"`
+	Unseen   uint32 `firestore:"unseen"`
+	Counted  bool   `firestore:"counted"`
+}
+
+type messageDoc struct {
+	UID   uint32    `firestore:"uid"`
+	Date  time.Time `firestore:"date"`
+	Size  uint32    `firestore:"size"`
+	Flags []string  `firestore:"flags"`
+	// Seen and Deleted follow the flags, to query on them
+	Seen    bool `firestore:"seen"`
+	Deleted bool `firestore:"deleted"`
+	// Body is the id of the body document
+	Body string `firestore:"body"`
+}
+
+// setFlags sets the flags along with Seen and Deleted
+func (m *messageDoc) setFlags(flags []string) {
+	if flags == nil {
+		flags = []string{}
+	}
+	m.Flags = flags
+	m.Seen = hasFlag(flags, imap.SeenFlag)
+	m.Deleted = hasFlag(flags, imap.DeletedFlag)
+}
+
+type bodyDoc struct {
+	Size    int       `firestore:"size"`
+	Chunks  int       `firestore:"chunks"`
+	Created time.Time `firestore:"created"`
+}
+
+type firestoreUser struct {
+	db    *firestore.Client
+	ctx   context.Context
+	email string
+}
+
+type firestoreMailbox struct {
+	user *firestoreUser
+	name string
+	ref  *firestore.DocumentRef
+}
+
+// storedMessage is a message document with its reference
+type storedMessage struct {
+	ref *firestore.DocumentRef
+	messageDoc
+}
+
+var _ backend.User = &firestoreUser{}
+var _ appender = &firestoreMailbox{}
+
+func (b firestoreBackend) mailUser(email string) *firestoreUser {
+	return &firestoreUser{b.db, b.ctx, email}
+}
+
+func (u *firestoreUser) folders() *firestore.CollectionRef {
+	return u.db.Collection("mailboxes").Doc(u.email).Collection("folders")
+}
+
+func (u *firestoreUser) bodies() *firestore.CollectionRef {
+	return u.db.Collection("mailboxes").Doc(u.email).Collection("bodies")
+}
+
+// folderName is the canonical name, INBOX is case-insensitive
+func folderName(name string) string {
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	return name
+}
+
+// folderID is the document id of a folder, which cannot contain a slash or be "." or ".."
+func folderID(name string) string {
+	return strings.ReplaceAll(url.PathEscape(folderName(name)), ".", "%2E")
+}
+
+func (u *firestoreUser) mailbox(name string) *firestoreMailbox {
+	name = folderName(name)
+	return &firestoreMailbox{user: u, name: name, ref: u.folders().Doc(folderID(name))}
+}
+
+// Username implements backend.User
+func (u *firestoreUser) Username() string {
+	return u.email
+}
+
+// ListMailboxes implements backend.User
+func (u *firestoreUser) ListMailboxes(subscribed bool) (out []backend.Mailbox, err error) {
+	docs, err := u.folders().OrderBy("name", firestore.Asc).Documents(u.ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		var folder folderDoc
+		if err = doc.DataTo(&folder); err != nil {
+			return nil, err
+		}
+		if subscribed && !folder.Subscribed {
+			continue
+		}
+		out = append(out, &firestoreMailbox{user: u, name: folder.Name, ref: doc.Ref})
+	}
+	return out, nil
+}
+
+// GetMailbox implements backend.User
+func (u *firestoreUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mb := u.mailbox(name)
+	if _, err := mb.folder(); err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// CreateMailbox implements backend.User
+func (u *firestoreUser) CreateMailbox(name string) error {
+	mb := u.mailbox(name)
+	_, err := mb.ref.Create(u.ctx, folderDoc{Name: mb.name, UIDValidity: newUIDValidity(), UIDNext: 1, Created: time.Now(), Counted: true})
+	if status.Code(err) == codes.AlreadyExists {
+		return errMailboxExists
+	}
+	return err
+}
+
+// DeleteMailbox implements backend.User
+func (u *firestoreUser) DeleteMailbox(name string) error {
+	mb := u.mailbox(name)
+	if mb.name == "INBOX" {
+		return errors.New("Cannot delete INBOX")
+	}
+	if _, err := mb.folder(); err != nil {
+		return err
+	}
+	messages, err := readMessages(mb.messageDocs().Documents(u.ctx))
+	if err != nil {
+		return err
+	}
+	if err = mb.removeMessages(messages); err != nil {
+		return err
+	}
+	_, err = mb.ref.Delete(u.ctx)
+	return err
+}
+
+// RenameMailbox implements backend.User. Its children are renamed along, but
+// renaming INBOX moves its messages to the new mailbox and leaves INBOX empty
+// (RFC 3501 §6.3.5).
+func (u *firestoreUser) RenameMailbox(existingName, newName string) error {
+	from, to := u.mailbox(existingName), u.mailbox(newName)
+	if _, err := from.folder(); err != nil {
+		return err
+	}
+	if from.name == "INBOX" {
+		if err := u.CreateMailbox(to.name); err != nil {
+			return err
+		}
+		return u.moveAll(from, to)
+	}
+
+	renames := map[string]string{from.name: to.name}
+	mailboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	for _, mb := range mailboxes {
+		if strings.HasPrefix(mb.Name(), from.name+"/") {
+			renames[mb.Name()] = to.name + strings.TrimPrefix(mb.Name(), from.name)
+		}
+	}
+	for existing, renamed := range renames {
+		if err = u.CreateMailbox(renamed); err != nil {
+			return err
+		}
+		if err = u.moveAll(u.mailbox(existing), u.mailbox(renamed)); err != nil {
+			return err
+		}
+		if _, err = u.mailbox(existing).ref.Delete(u.ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveAll moves the messages to another folder, keeping their uids and counts
+func (u *firestoreUser) moveAll(from, to *firestoreMailbox) error {
+	folder, err := from.folder()
+	if err != nil {
+		return err
+	}
+	messages, err := readMessages(from.messageDocs().Documents(u.ctx))
+	if err != nil {
+		return err
+	}
+	var unseen uint32
+	batch := newFirestoreBatch(u.db, u.ctx)
+	for _, msg := range messages {
+		batch.Create(to.messageRef(msg.UID), msg.messageDoc)
+		batch.Delete(msg.ref)
+		if !msg.Seen {
+			unseen++
+		}
+	}
+	batch.Update(to.ref, []firestore.Update{
+		{Path: "uidNext", Value: folder.UIDNext},
+		{Path: "messages", Value: len(messages)},
+		{Path: "unseen", Value: unseen},
+	})
+	batch.Update(from.ref, []firestore.Update{{Path: "messages", Value: 0}, {Path: "unseen", Value: 0}})
+	return batch.Commit()
+}
+
+// Logout implements backend.User
+func (u *firestoreUser) Logout() error {
+	return nil
+}
+
+// newUIDValidity changes every second, so a mailbox recreated with the same name gets another
+func newUIDValidity() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// folder reads the folder document, backend.ErrNoSuchMailbox if it does not
+// exist. A folder without counts is counted first.
+func (mb *firestoreMailbox) folder() (*folderDoc, error) {
+	folder, err := folderData(mb.ref.Get(mb.user.ctx))
+	if err != nil || folder.Counted {
+		return folder, err
+	}
+	if err = mb.count(); err != nil {
+		return nil, err
+	}
+	return folderData(mb.ref.Get(mb.user.ctx))
+}
+
+// txFolder reads the folder document in a transaction
+func (mb *firestoreMailbox) txFolder(tx *firestore.Transaction) (*folderDoc, error) {
+	return folderData(tx.Get(mb.ref))
+}
+
+func folderData(doc *firestore.DocumentSnapshot, err error) (*folderDoc, error) {
+	if status.Code(err) == codes.NotFound {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	if err != nil {
+		return nil, err
+	}
+	folder := &folderDoc{}
+	return folder, doc.DataTo(folder)
+}
+
+// count sets the counts of a folder stored before there were counts, and the
+// Seen and Deleted fields of its messages. The counts are taken in a
+// transaction, which is retried when messages are added or removed meanwhile.
+func (mb *firestoreMailbox) count() error {
+	messages, err := readMessages(mb.messageDocs().Documents(mb.user.ctx))
+	if err != nil {
+		return err
+	}
+	batch := newFirestoreBatch(mb.user.db, mb.user.ctx)
+	for _, msg := range messages {
+		msg.setFlags(msg.Flags)
+		batch.Update(msg.ref, []firestore.Update{{Path: "seen", Value: msg.Seen}, {Path: "deleted", Value: msg.Deleted}})
+	}
+	if err = batch.Commit(); err != nil {
+		return err
+	}
+	return mb.user.db.RunTransaction(mb.user.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		docs, err := tx.Documents(mb.messageDocs().Select("seen")).GetAll()
+		if err != nil {
+			return err
+		}
+		var unseen int
+		for _, doc := range docs {
+			if seen, _ := doc.DataAt("seen"); seen != true {
+				unseen++
+			}
+		}
+		return tx.Update(mb.ref, []firestore.Update{
+			{Path: "messages", Value: len(docs)},
+			{Path: "unseen", Value: unseen},
+			{Path: "counted", Value: true},
+		})
+	})
+}
+
+// view runs f in a read-only transaction, so that the counts of the folder
+// agree with the messages f reads
+func (mb *firestoreMailbox) view(f func(tx *firestore.Transaction, folder *folderDoc) error) error {
+	if _, err := mb.folder(); err != nil {
+		return err
+	}
+	return mb.user.db.RunTransaction(mb.user.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		folder, err := mb.txFolder(tx)
+		if err != nil {
+			return err
+		}
+		return f(tx, folder)
+	}, firestore.ReadOnly)
+}
+
+func (mb *firestoreMailbox) messageDocs() *firestore.CollectionRef {
+	return mb.ref.Collection("messages")
+}
+
+func (mb *firestoreMailbox) messageRef(uid uint32) *firestore.DocumentRef {
+	return mb.messageDocs().Doc(fmt.Sprintf("%010d", uid))
+}
+
+// readMessages reads the message documents of a query
+func readMessages(it *firestore.DocumentIterator) ([]storedMessage, error) {
+	docs, err := it.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]storedMessage, len(docs))
+	for i, doc := range docs {
+		messages[i].ref = doc.Ref
+		if err = doc.DataTo(&messages[i].messageDoc); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// selected lists the messages in the seqset in uid order, by uid or sequence
+// number, with their sequence numbers if withSeqNums is set
+func (mb *firestoreMailbox) selected(uid bool, seqset *imap.SeqSet, withSeqNums bool) (messages []storedMessage, seqNums []uint32, err error) {
+	err = mb.view(func(tx *firestore.Transaction, folder *folderDoc) error {
+		messages, seqNums, err = mb.inSet(tx, folder, uid, seqset, withSeqNums)
+		return err
+	})
+	return messages, seqNums, err
+}
+
+// inSet reads only the messages in the ranges of the seqset
+func (mb *firestoreMailbox) inSet(tx *firestore.Transaction, folder *folderDoc, uid bool, seqset *imap.SeqSet, withSeqNums bool) ([]storedMessage, []uint32, error) {
+	var messages []storedMessage
+	seqNums := map[uint32]uint32{}
+	for _, seq := range seqset.Set {
+		var inRange []storedMessage
+		var first uint32
+		var err error
+		if uid {
+			inRange, first, err = mb.uidRange(tx, folder, seq, withSeqNums)
+		} else {
+			inRange, first, err = mb.seqRange(tx, folder, seq)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, msg := range inRange {
+			if _, ok := seqNums[msg.UID]; !ok {
+				messages = append(messages, msg)
+			}
+			seqNums[msg.UID] = first + uint32(i)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].UID < messages[j].UID })
+	ordered := make([]uint32, len(messages))
+	for i, msg := range messages {
+		ordered[i] = seqNums[msg.UID]
+	}
+	return messages, ordered, nil
+}
+
+// seqRange reads a range of sequence numbers, from the end of the folder when
+// that is closer, and returns the sequence number of the first
+func (mb *firestoreMailbox) seqRange(tx *firestore.Transaction, folder *folderDoc, seq imap.Seq) ([]storedMessage, uint32, error) {
+	start, stop := seq.Start, seq.Stop
+	if start == 0 {
+		// "*" is the last message
+		start = folder.Messages
+	}
+	if stop == 0 || stop > folder.Messages {
+		stop = folder.Messages
+	}
+	if start == 0 || start > stop {
+		return nil, 0, nil
+	}
+	n := int(stop - start + 1)
+	if folder.Messages-stop >= start-1 {
+		messages, err := readMessages(tx.Documents(mb.messageDocs().OrderBy("uid", firestore.Asc).Offset(int(start - 1)).Limit(n)))
+		return messages, start, err
+	}
+	messages, err := readMessages(tx.Documents(mb.messageDocs().OrderBy("uid", firestore.Desc).Offset(int(folder.Messages - stop)).Limit(n)))
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, start, err
+}
+
+// uidRange reads a range of uids. The sequence number of the first message
+// follows from the count of the folder and the number of messages after the
+// range, which are read as references only.
+func (mb *firestoreMailbox) uidRange(tx *firestore.Transaction, folder *folderDoc, seq imap.Seq, withSeqNums bool) ([]storedMessage, uint32, error) {
+	q := mb.messageDocs().Where("uid", ">=", seq.Start)
+	switch {
+	case seq.Start == 0:
+		// "*" is the last message
+		q = mb.messageDocs().OrderBy("uid", firestore.Desc).Limit(1)
+	case seq.Stop != 0:
+		q = q.Where("uid", "<=", seq.Stop).OrderBy("uid", firestore.Asc)
+	default:
+		q = q.OrderBy("uid", firestore.Asc)
+	}
+	messages, err := readMessages(tx.Documents(q))
+	if err != nil || len(messages) == 0 || !withSeqNums {
+		return messages, 0, err
+	}
+	var after []*firestore.DocumentSnapshot
+	if seq.Start != 0 && seq.Stop != 0 {
+		after, err = tx.Documents(mb.messageDocs().Where("uid", ">", seq.Stop).Select()).GetAll()
+	}
+	return messages, seqNumFrom(folder, len(messages)+len(after)), err
+}
+
+// seqNumFrom is the sequence number of the first of the last n messages
+func seqNumFrom(folder *folderDoc, n int) uint32 {
+	if n > int(folder.Messages) {
+		return 1
+	}
+	return folder.Messages - uint32(n) + 1
+}
+
+// load reads the body when it is needed
+func (mb *firestoreMailbox) load(msg storedMessage, withBody bool) (*memory.Message, error) {
+	m := &memory.Message{Uid: msg.UID, Date: msg.Date, Size: msg.Size, Flags: msg.Flags}
+	if !withBody {
+		return m, nil
+	}
+	var err error
+	m.Body, err = mb.user.readBody(msg.Body)
+	return m, err
+}
+
+// Name implements backend.Mailbox
+func (mb *firestoreMailbox) Name() string {
+	return mb.name
+}
+
+// Info implements backend.Mailbox
+func (mb *firestoreMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: mb.name}, nil
+}
+
+// Status implements backend.Mailbox, with the counts of the folder
+func (mb *firestoreMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	s := imap.NewMailboxStatus(mb.name, items)
+	s.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	s.PermanentFlags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag, `\*`}
+	err := mb.view(func(tx *firestore.Transaction, folder *folderDoc) (err error) {
+		for _, item := range items {
+			switch item {
+			case imap.StatusMessages:
+				s.Messages = folder.Messages
+			case imap.StatusUidNext:
+				s.UidNext = folder.UIDNext
+			case imap.StatusUidValidity:
+				s.UidValidity = folder.UIDValidity
+			case imap.StatusRecent:
+				s.Recent = 0
+			case imap.StatusUnseen:
+				s.Unseen = folder.Unseen
+				s.UnseenSeqNum, err = mb.firstUnseen(tx, folder)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// firstUnseen is the sequence number of the first unseen message, which is
+// the first by document id as that follows the uid
+func (mb *firestoreMailbox) firstUnseen(tx *firestore.Transaction, folder *folderDoc) (uint32, error) {
+	if folder.Unseen == 0 {
+		return 0, nil
+	}
+	unseen, err := readMessages(tx.Documents(mb.messageDocs().Where("seen", "==", false).Limit(1)))
+	if err != nil || len(unseen) == 0 {
+		return 0, err
+	}
+	from, err := tx.Documents(mb.messageDocs().Where("uid", ">=", unseen[0].UID).Select()).GetAll()
+	return seqNumFrom(folder, len(from)), err
+}
+
+// SetSubscribed implements backend.Mailbox
+func (mb *firestoreMailbox) SetSubscribed(subscribed bool) error {
+	_, err := mb.ref.Update(mb.user.ctx, []firestore.Update{{Path: "subscribed", Value: subscribed}})
+	if status.Code(err) == codes.NotFound {
+		return backend.ErrNoSuchMailbox
+	}
+	return err
+}
+
+// Check implements backend.Mailbox
+func (mb *firestoreMailbox) Check() error {
+	return nil
+}
+
+// ListMessages implements backend.Mailbox
+func (mb *firestoreMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	messages, seqNums, err := mb.selected(uid, seqset, true)
+	if err != nil {
+		return err
+	}
+	withBody := fetchNeedsBody(items)
+	for i, msg := range messages {
+		m, err := mb.load(msg, withBody)
+		if err != nil {
+			return err
+		}
+		fetched, err := m.Fetch(seqNums[i], items)
+		if err != nil {
+			continue
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+// SearchMessages implements backend.Mailbox
+func (mb *firestoreMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	var messages []storedMessage
+	var seqNums []uint32
+	err := mb.view(func(tx *firestore.Transaction, folder *folderDoc) (err error) {
+		messages, seqNums, err = mb.candidates(tx, folder, criteria, !uid || searchesSeqNums(criteria))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	withBody := searchNeedsBody(criteria)
+	var ids []uint32
+	for i, msg := range messages {
+		m, err := mb.load(msg, withBody)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if withBody {
+			ok, err = m.Match(seqNums[i], criteria)
+		} else {
+			// Matching on uid, dates and flags only
+			e, _ := message.New(message.Header{}, bytes.NewReader(nil))
+			ok, err = backendutil.Match(e, seqNums[i], m.Uid, m.Date, m.Flags, criteria)
+		}
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.UID)
+		} else {
+			ids = append(ids, seqNums[i])
+		}
+	}
+	return ids, nil
+}
+
+// candidates reads the messages that can match the criteria: those in its
+// uid or sequence set, or else those with its \Seen and \Deleted flags. The
+// sequence numbers of the latter are taken from the references of all
+// messages, only when withSeqNums is set.
+func (mb *firestoreMailbox) candidates(tx *firestore.Transaction, folder *folderDoc, c *imap.SearchCriteria, withSeqNums bool) ([]storedMessage, []uint32, error) {
+	if c.Uid != nil {
+		return mb.inSet(tx, folder, true, c.Uid, withSeqNums)
+	}
+	if c.SeqNum != nil {
+		return mb.inSet(tx, folder, false, c.SeqNum, true)
+	}
+	q := mb.messageDocs().Query
+	for _, f := range []struct{ field, flag string }{{"seen", imap.SeenFlag}, {"deleted", imap.DeletedFlag}} {
+		if hasFlag(c.WithFlags, f.flag) {
+			q = q.Where(f.field, "==", true)
+		} else if hasFlag(c.WithoutFlags, f.flag) {
+			q = q.Where(f.field, "==", false)
+		}
+	}
+	// Ordered by document id, which follows the uid
+	messages, err := readMessages(tx.Documents(q))
+	seqNums := make([]uint32, len(messages))
+	if err != nil || !withSeqNums {
+		return messages, seqNums, err
+	}
+	refs, err := tx.Documents(mb.messageDocs().Select()).GetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	index := make(map[string]uint32, len(refs))
+	for i, ref := range refs {
+		index[ref.Ref.ID] = uint32(i + 1)
+	}
+	for i, msg := range messages {
+		seqNums[i] = index[msg.ref.ID]
+	}
+	return messages, seqNums, nil
+}
+
+// CreateMessage implements backend.Mailbox
+func (mb *firestoreMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	_, err = mb.appendMessage(flags, date, data)
+	return err
+}
+
+// appendMessage implements appender, it stores the body, then the message with the next uid of the folder.
+// The transaction makes concurrent appends on other replicas take other uids.
+func (mb *firestoreMailbox) appendMessage(flags []string, date time.Time, data []byte) (uid uint32, err error) {
+	bodyID, err := mb.user.writeBody(data)
+	if err != nil {
+		return 0, err
+	}
+	err = mb.user.db.RunTransaction(mb.user.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		folder, err := mb.txFolder(tx)
+		if err != nil {
+			return err
+		}
+		uid = folder.UIDNext
+		msg := messageDoc{UID: uid, Date: date, Size: uint32(len(data)), Body: bodyID}
+		msg.setFlags(flags)
+		if err = tx.Create(mb.messageRef(uid), msg); err != nil {
+			return err
+		}
+		updates := []firestore.Update{{Path: "uidNext", Value: uid + 1}, {Path: "messages", Value: folder.Messages + 1}}
+		if !msg.Seen {
+			updates = append(updates, firestore.Update{Path: "unseen", Value: folder.Unseen + 1})
+		}
+		return tx.Update(mb.ref, updates)
+	})
+	if err != nil {
+		if errBody := mb.user.deleteBody(bodyID); errBody != nil {
+			return 0, errors.Wrapf(err, "also failed to delete body: %v", errBody)
+		}
+		return 0, err
+	}
+	return uid, nil
+}
+
+// UpdateMessagesFlags implements backend.Mailbox
+func (mb *firestoreMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	messages, _, err := mb.selected(uid, seqset, false)
+	if err != nil {
+		return err
+	}
+	for len(messages) > 0 {
+		chunk := messages
+		if len(chunk) > firestoreTxSize {
+			chunk = chunk[:firestoreTxSize]
+		}
+		if err = mb.updateFlags(chunk, operation, flags); err != nil {
+			return err
+		}
+		messages = messages[len(chunk):]
+	}
+	return nil
+}
+
+// updateFlags updates the flags of the messages and the unseen count of the
+// folder in a transaction, skipping messages that were removed meanwhile
+func (mb *firestoreMailbox) updateFlags(messages []storedMessage, operation imap.FlagsOp, flags []string) error {
+	return mb.user.db.RunTransaction(mb.user.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		folder, err := mb.txFolder(tx)
+		if err != nil {
+			return err
+		}
+		docs, err := tx.GetAll(messageRefs(messages))
+		if err != nil {
+			return err
+		}
+		unseen := folder.Unseen
+		for _, doc := range docs {
+			if !doc.Exists() {
+				continue
+			}
+			var msg messageDoc
+			if err = doc.DataTo(&msg); err != nil {
+				return err
+			}
+			seen := msg.Seen
+			msg.setFlags(backendutil.UpdateFlags(msg.Flags, operation, flags))
+			if seen && !msg.Seen {
+				unseen++
+			} else if !seen && msg.Seen && unseen > 0 {
+				unseen--
+			}
+			err = tx.Update(doc.Ref, []firestore.Update{
+				{Path: "flags", Value: msg.Flags},
+				{Path: "seen", Value: msg.Seen},
+				{Path: "deleted", Value: msg.Deleted},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Update(mb.ref, []firestore.Update{{Path: "unseen", Value: unseen}})
+	})
+}
+
+func messageRefs(messages []storedMessage) []*firestore.DocumentRef {
+	refs := make([]*firestore.DocumentRef, len(messages))
+	for i, msg := range messages {
+		refs[i] = msg.ref
+	}
+	return refs
+}
+
+// CopyMessages implements backend.Mailbox
+func (mb *firestoreMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	dest := mb.user.mailbox(destName)
+	if _, err := dest.folder(); err != nil {
+		return err
+	}
+	messages, _, err := mb.selected(uid, seqset, false)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		data, err := mb.user.readBody(msg.Body)
+		if err != nil {
+			return err
+		}
+		if _, err = dest.appendMessage(msg.Flags, msg.Date, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expunge implements backend.Mailbox
+func (mb *firestoreMailbox) Expunge() error {
+	if _, err := mb.folder(); err != nil {
+		return err
+	}
+	messages, err := readMessages(mb.messageDocs().Where("deleted", "==", true).Documents(mb.user.ctx))
+	if err != nil {
+		return err
+	}
+	return mb.removeMessages(messages)
+}
+
+// deleteMessage implements appender
+func (mb *firestoreMailbox) deleteMessage(uid uint32) error {
+	doc, err := mb.messageRef(uid).Get(mb.user.ctx)
+	if status.Code(err) == codes.NotFound {
+		return errors.Wrapf(errMailNotFound, "no message %d in %s", uid, mb.name)
+	}
+	if err != nil {
+		return err
+	}
+	msg := storedMessage{ref: doc.Ref}
+	if err = doc.DataTo(&msg.messageDoc); err != nil {
+		return err
+	}
+	return mb.removeMessages([]storedMessage{msg})
+}
+
+// removeMessages deletes the messages, then their bodies
+func (mb *firestoreMailbox) removeMessages(messages []storedMessage) error {
+	for len(messages) > 0 {
+		chunk := messages
+		if len(chunk) > firestoreTxSize {
+			chunk = chunk[:firestoreTxSize]
+		}
+		removed, err := mb.removeChunk(chunk)
+		if err != nil {
+			return err
+		}
+		for _, msg := range removed {
+			if err = mb.user.deleteBody(msg.Body); err != nil {
+				return err
+			}
+		}
+		messages = messages[len(chunk):]
+	}
+	return nil
+}
+
+// removeChunk deletes the messages and counts them off the folder in a
+// transaction, returning those that were not removed meanwhile
+func (mb *firestoreMailbox) removeChunk(messages []storedMessage) (removed []storedMessage, err error) {
+	err = mb.user.db.RunTransaction(mb.user.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		removed = nil
+		folder, err := mb.txFolder(tx)
+		if err != nil {
+			return err
+		}
+		docs, err := tx.GetAll(messageRefs(messages))
+		if err != nil {
+			return err
+		}
+		count, unseen := folder.Messages, folder.Unseen
+		for _, doc := range docs {
+			if !doc.Exists() {
+				continue
+			}
+			msg := storedMessage{ref: doc.Ref}
+			if err = doc.DataTo(&msg.messageDoc); err != nil {
+				return err
+			}
+			if err = tx.Delete(doc.Ref); err != nil {
+				return err
+			}
+			removed = append(removed, msg)
+			if count > 0 {
+				count--
+			}
+			if !msg.Seen && unseen > 0 {
+				unseen--
+			}
+		}
+		return tx.Update(mb.ref, []firestore.Update{{Path: "messages", Value: count}, {Path: "unseen", Value: unseen}})
+	})
+	return removed, err
+}
+
+// writeBody stores the body in chunks and returns its id
+func (u *firestoreUser) writeBody(data []byte) (string, error) {
+	ref := u.bodies().NewDoc()
+	chunks := (len(data) + firestoreChunkSize - 1) / firestoreChunkSize
+	for i := 0; i < chunks; i++ {
+		chunk := data[i*firestoreChunkSize:]
+		if len(chunk) > firestoreChunkSize {
+			chunk = chunk[:firestoreChunkSize]
+		}
+		if _, err := ref.Collection("chunks").Doc(fmt.Sprintf("%04d", i)).Set(u.ctx, map[string]interface{}{"data": chunk}); err != nil {
+			return "", err
+		}
+	}
+	_, err := ref.Set(u.ctx, bodyDoc{Size: len(data), Chunks: chunks, Created: time.Now()})
+	return ref.ID, err
+}
+
+func (u *firestoreUser) readBody(id string) ([]byte, error) {
+	ref := u.bodies().Doc(id)
+	docs, err := ref.Collection("chunks").OrderBy(firestore.DocumentID, firestore.Asc).Documents(u.ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, doc := range docs {
+		chunk, err := doc.DataAt("data")
+		if err != nil {
+			return nil, err
+		}
+		b, _ := chunk.([]byte)
+		data = append(data, b...)
+	}
+	return data, nil
+}
+
+func (u *firestoreUser) deleteBody(id string) error {
+	ref := u.bodies().Doc(id)
+	refs, err := ref.Collection("chunks").DocumentRefs(u.ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	batch := newFirestoreBatch(u.db, u.ctx)
+	for _, chunk := range refs {
+		batch.Delete(chunk)
+	}
+	batch.Delete(ref)
+	return batch.Commit()
+}
+
+// fetchNeedsBody tells if the items need more than the message document
+func fetchNeedsBody(items []imap.FetchItem) bool {
+	for _, item := range items {
+		switch item {
+		case imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchUid:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// searchNeedsBody tells if the criteria match on headers, text or size
+func searchNeedsBody(c *imap.SearchCriteria) bool {
+	if c == nil {
+		return false
+	}
+	if len(c.Header) > 0 || len(c.Body) > 0 || len(c.Text) > 0 || !c.SentSince.IsZero() || !c.SentBefore.IsZero() || c.Larger > 0 || c.Smaller > 0 {
+		return true
+	}
+	for _, not := range c.Not {
+		if searchNeedsBody(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if searchNeedsBody(or[0]) || searchNeedsBody(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchesSeqNums tells if the criteria match on sequence numbers
+func searchesSeqNums(c *imap.SearchCriteria) bool {
+	if c == nil {
+		return false
+	}
+	if c.SeqNum != nil {
+		return true
+	}
+	for _, not := range c.Not {
+		if searchesSeqNums(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if searchesSeqNums(or[0]) || searchesSeqNums(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// firestoreBatch commits writes in batches of at most firestoreBatchSize
+type firestoreBatch struct {
+	db    *firestore.Client
+	ctx   context.Context
+	batch *firestore.WriteBatch
+	n     int
+	err   error
+}
+
+func newFirestoreBatch(db *firestore.Client, ctx context.Context) *firestoreBatch {
+	return &firestoreBatch{db: db, ctx: ctx, batch: db.Batch()}
+}
+
+func (b *firestoreBatch) Create(ref *firestore.DocumentRef, data interface{}) {
+	b.batch.Create(ref, data)
+	b.wrote()
+}
+
+func (b *firestoreBatch) Update(ref *firestore.DocumentRef, updates []firestore.Update) {
+	b.batch.Update(ref, updates)
+	b.wrote()
+}
+
+func (b *firestoreBatch) Delete(ref *firestore.DocumentRef) {
+	b.batch.Delete(ref)
+	b.wrote()
+}
+
+func (b *firestoreBatch) wrote() {
+	if b.n++; b.n == firestoreBatchSize {
+		if b.err == nil {
+			_, b.err = b.batch.Commit(b.ctx)
+		}
+		b.batch, b.n = b.db.Batch(), 0
+	}
+}
+
+// Commit writes the remaining batch, or returns the error of an earlier one
+func (b *firestoreBatch) Commit() error {
+	if b.err != nil || b.n == 0 {
+		return b.err
+	}
+	_, err := b.batch.Commit(b.ctx)
+	return err
+}
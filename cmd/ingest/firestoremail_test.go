@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+var body = "From: contact@example.org\r\n" +
+	"To: contact@example.org\r\n" +
+	"Subject: A little message, just for you\r\n" +
+	"Date: Wed, 11 May 2016 14:31:59 +0000\r\n" +
+	"Message-ID: <0000000@localhost/>\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hi there :)"
+
+// newFirestoreUser opens a mailbox in the Firestore emulator when
+// FIRESTORE_EMULATOR_HOST is set, or else in a fakeFirestore. Start the
+// emulator with gcloud emulators firestore start --host-port=localhost:8081
+// and set FIRESTORE_EMULATOR_HOST=localhost:8081.
+func newFirestoreUser(t *testing.T) *firestoreUser {
+	ctx := context.Background()
+	var db *firestore.Client
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		db, _ = newFakeFirestore(t)
+	} else {
+		var err error
+		if db, err = firestore.NewClient(ctx, "ptsm-test"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+	}
+	email := fmt.Sprintf("test-%d@ptsm.q42.com", time.Now().UnixNano())
+	return firestoreBackend{db, ctx}.mailUser(email)
+}
+
+func fetchAll(t *testing.T, mb backend.Mailbox, uid bool, seqset string, items ...imap.FetchItem) []*imap.Message {
+	set, err := imap.ParseSeqSet(seqset)
+	assert.NoError(t, err)
+	ch := make(chan *imap.Message, 100)
+	assert.NoError(t, mb.ListMessages(uid, set, items, ch))
+	var messages []*imap.Message
+	for m := range ch {
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func TestFirestoreMailboxes(t *testing.T) {
+	u := newFirestoreUser(t)
+
+	_, err := u.GetMailbox("INBOX")
+	assert.Equal(t, backend.ErrNoSuchMailbox, err)
+	assert.NoError(t, u.CreateMailbox("INBOX"))
+	assert.Equal(t, errMailboxExists, u.CreateMailbox("inbox"))
+	assert.NoError(t, u.CreateMailbox("Archive"))
+	assert.NoError(t, u.CreateMailbox("Archive/2022"))
+	assert.NoError(t, u.CreateMailbox("Lists.go"))
+
+	mb, err := u.GetMailbox("Archive")
+	assert.NoError(t, err)
+	assert.NoError(t, mb.SetSubscribed(true))
+	mailboxes, err := u.ListMailboxes(true)
+	assert.NoError(t, err)
+	if assert.Len(t, mailboxes, 1) {
+		assert.Equal(t, "Archive", mailboxes[0].Name())
+	}
+
+	archive, _ := u.GetMailbox("Archive/2022")
+	assert.NoError(t, archive.CreateMessage([]string{imap.SeenFlag}, time.Now(), strings.NewReader(body)))
+
+	// Children are renamed along, keeping their messages
+	assert.NoError(t, u.RenameMailbox("Archive", "Old"))
+	mailboxes, err = u.ListMailboxes(false)
+	assert.NoError(t, err)
+	var names []string
+	for _, mb := range mailboxes {
+		names = append(names, mb.Name())
+	}
+	assert.Equal(t, []string{"INBOX", "Lists.go", "Old", "Old/2022"}, names)
+	old, err := u.GetMailbox("Old/2022")
+	assert.NoError(t, err)
+	assert.Len(t, fetchAll(t, old, false, "1:*", imap.FetchUid), 1)
+
+	assert.Error(t, u.DeleteMailbox("INBOX"))
+	assert.NoError(t, u.DeleteMailbox("Old/2022"))
+	assert.Equal(t, backend.ErrNoSuchMailbox, u.DeleteMailbox("Old/2022"))
+}
+
+func TestFirestoreMessages(t *testing.T) {
+	u := newFirestoreUser(t)
+	assert.NoError(t, u.CreateMailbox("INBOX"))
+	assert.NoError(t, u.CreateMailbox("Archive"))
+	mb, _ := u.GetMailbox("INBOX")
+
+	// Bodies larger than a chunk are split
+	large := body + "\r\n" + strings.Repeat("x", 2*firestoreChunkSize)
+	for _, data := range []string{body, large} {
+		assert.NoError(t, mb.CreateMessage(nil, time.Now(), strings.NewReader(data)))
+	}
+	uid, err := mb.(*firestoreMailbox).appendMessage(nil, time.Now(), []byte(strings.Replace(body, "A little message", "Another message", 1)))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), uid)
+
+	status, err := mb.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), status.Messages)
+	assert.Equal(t, uint32(4), status.UidNext)
+	assert.NotZero(t, status.UidValidity)
+	assert.Equal(t, uint32(3), status.Unseen)
+
+	messages := fetchAll(t, mb, true, "2", imap.FetchUid, imap.FetchRFC822Size, "BODY[]")
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, uint32(len(large)), messages[0].Size)
+		for _, literal := range messages[0].Body {
+			assert.Equal(t, len(large), literal.Len())
+		}
+	}
+
+	// Flags
+	seqset, _ := imap.ParseSeqSet("1:2")
+	assert.NoError(t, mb.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.SeenFlag, imap.FlaggedFlag}))
+	seqset, _ = imap.ParseSeqSet("2")
+	assert.NoError(t, mb.UpdateMessagesFlags(true, seqset, imap.RemoveFlags, []string{imap.FlaggedFlag}))
+	messages = fetchAll(t, mb, false, "1:*", imap.FetchFlags)
+	if assert.Len(t, messages, 3) {
+		assert.ElementsMatch(t, []string{imap.SeenFlag, imap.FlaggedFlag}, messages[0].Flags)
+		assert.Equal(t, []string{imap.SeenFlag}, messages[1].Flags)
+		assert.Empty(t, messages[2].Flags)
+	}
+
+	// Search on flags and on headers
+	ids, err := mb.SearchMessages(true, &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{3}, ids)
+	criteria := &imap.SearchCriteria{Header: map[string][]string{"Subject": {"another"}}}
+	ids, err = mb.SearchMessages(false, criteria)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{3}, ids)
+
+	// Copies get the next uids of the destination
+	seqset, _ = imap.ParseSeqSet("1,3")
+	assert.NoError(t, mb.CopyMessages(false, seqset, "Archive"))
+	archive, _ := u.GetMailbox("Archive")
+	messages = fetchAll(t, archive, false, "1:*", imap.FetchUid, imap.FetchFlags, imap.FetchEnvelope)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, uint32(1), messages[0].Uid)
+		assert.Equal(t, "Another message, just for you", messages[1].Envelope.Subject)
+	}
+	assert.Equal(t, backend.ErrNoSuchMailbox, mb.CopyMessages(false, seqset, "Nonexistent"))
+
+	// Expunge renumbers the sequence, but keeps the uids
+	seqset, _ = imap.ParseSeqSet("1")
+	assert.NoError(t, mb.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}))
+	assert.NoError(t, mb.Expunge())
+	messages = fetchAll(t, mb, false, "1:*", imap.FetchUid)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, uint32(1), messages[0].SeqNum)
+		assert.Equal(t, uint32(2), messages[0].Uid)
+	}
+	uid, err = mb.(*firestoreMailbox).appendMessage(nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4), uid, "uids are not reused")
+}
+
+func TestFirestoreRanges(t *testing.T) {
+	db, fake := newFakeFirestore(t)
+	u := firestoreBackend{db, context.Background()}.mailUser("ranges@ptsm.q42.com")
+	assert.NoError(t, u.CreateMailbox("INBOX"))
+	mb, _ := u.GetMailbox("INBOX")
+	for i := 0; i < 10; i++ {
+		var flags []string
+		if i < 4 {
+			flags = []string{imap.SeenFlag}
+		}
+		assert.NoError(t, mb.CreateMessage(flags, time.Now(), strings.NewReader(body)))
+	}
+
+	status, err := mb.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(10), status.Messages)
+	assert.Equal(t, uint32(6), status.Unseen)
+	assert.Equal(t, uint32(5), status.UnseenSeqNum)
+
+	// Only the messages in the range are read
+	fake.returned()
+	messages := fetchAll(t, mb, false, "9:*", imap.FetchUid)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, uint32(9), messages[0].SeqNum)
+		assert.Equal(t, uint32(10), messages[1].Uid)
+	}
+	assert.Equal(t, 2, fake.returned())
+
+	// Expunged messages renumber the sequence
+	seqset, _ := imap.ParseSeqSet("2,5")
+	assert.NoError(t, mb.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.DeletedFlag}))
+	assert.NoError(t, mb.Expunge())
+	messages = fetchAll(t, mb, true, "3:4,4:6,*", imap.FetchUid)
+	var seqNums, uids []uint32
+	for _, m := range messages {
+		seqNums = append(seqNums, m.SeqNum)
+		uids = append(uids, m.Uid)
+	}
+	assert.Equal(t, []uint32{3, 4, 6, 10}, uids)
+	assert.Equal(t, []uint32{2, 3, 4, 8}, seqNums)
+	messages = fetchAll(t, mb, false, "*", imap.FetchUid)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, uint32(8), messages[0].SeqNum)
+		assert.Equal(t, uint32(10), messages[0].Uid)
+	}
+
+	status, err = mb.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(8), status.Messages)
+	assert.Equal(t, uint32(5), status.Unseen)
+	assert.Equal(t, uint32(4), status.UnseenSeqNum)
+
+	ids, err := mb.SearchMessages(false, &imap.SearchCriteria{WithoutFlags: []string{imap.SeenFlag}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{4, 5, 6, 7, 8}, ids)
+	seqset, _ = imap.ParseSeqSet("2:3")
+	ids, err = mb.SearchMessages(true, &imap.SearchCriteria{SeqNum: seqset})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{3, 4}, ids)
+}
+
+func TestFirestoreCount(t *testing.T) {
+	db, _ := newFakeFirestore(t)
+	u := firestoreBackend{db, context.Background()}.mailUser("count@ptsm.q42.com")
+	ctx := context.Background()
+
+	// A folder stored before there were counts
+	mb := u.mailbox("INBOX")
+	_, err := mb.ref.Set(ctx, map[string]interface{}{"name": "INBOX", "uidValidity": 1, "uidNext": 4})
+	assert.NoError(t, err)
+	for uid, flags := range map[uint32][]string{1: {imap.SeenFlag}, 2: {}, 3: {imap.DeletedFlag}} {
+		_, err = mb.messageRef(uid).Set(ctx, map[string]interface{}{"uid": uid, "flags": flags, "body": "none"})
+		assert.NoError(t, err)
+	}
+
+	status, err := mb.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUnseen})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3), status.Messages)
+	assert.Equal(t, uint32(2), status.Unseen)
+	assert.Equal(t, uint32(2), status.UnseenSeqNum)
+	folder, err := mb.folder()
+	assert.NoError(t, err)
+	assert.True(t, folder.Counted)
+
+	ids, err := mb.SearchMessages(true, &imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{3}, ids)
+}
+
+func TestFolderID(t *testing.T) {
+	assert.Equal(t, "INBOX", folderID("inbox"))
+	assert.Equal(t, "Archive%2F2022", folderID("Archive/2022"))
+	assert.Equal(t, "%2E%2E", folderID(".."))
+}
+
+func TestSearchNeedsBody(t *testing.T) {
+	assert.False(t, searchNeedsBody(&imap.SearchCriteria{WithFlags: []string{imap.SeenFlag}}))
+	assert.True(t, searchNeedsBody(&imap.SearchCriteria{Text: []string{"invoice"}}))
+	assert.True(t, searchNeedsBody(&imap.SearchCriteria{Not: []*imap.SearchCriteria{{Larger: 1000}}}))
+	assert.False(t, fetchNeedsBody([]imap.FetchItem{imap.FetchUid, imap.FetchFlags}))
+	assert.True(t, fetchNeedsBody([]imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}))
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 
@@ -12,37 +14,57 @@ import (
 	"golang.org/x/crypto/acme/autocert"
 )
 
-func startHttpServer(ctx context.Context, logger *zap.Logger) (tlsConfig *tls.Config, err error) {
-	r, err := NewProvisionServer(logger)
+// startHttpServer serves the provisioning API on the https listeners as part of servers
+func startHttpServer(ctx, drain context.Context, logger *zap.Logger, lns listeners, servers *shutdownGroup, auth *authService, mails MailStore) (tlsConfig *tls.Config, err error) {
+	r, err := NewProvisionServer(logger, auth, mails)
 	if err != nil {
 		return nil, err
 	}
 
-	s := http.Server{Addr: ":443", Handler: cors.Default().Handler(r), ErrorLog: zap.NewStdLog(logger)}
-	go func() {
-		<-ctx.Done()
-		s.Shutdown(context.Background())
-	}()
+	c := cors.New(cors.Options{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	})
+	s := &http.Server{Handler: c.Handler(r), ErrorLog: zap.NewStdLog(logger)}
 
-	c, err := makeTLSConfig(logger)
-	s.TLSConfig = c
-	r.TLSConfig = c
+	tc, err := makeTLSConfig(logger)
+	s.TLSConfig = tc
+	r.TLSConfig = tc
 	if err != nil {
 		return nil, err
 	}
 
 	// Start the server
-	go func() {
-		logger.Info("Starting HTTPS server on :443")
-		if err = s.ListenAndServeTLS("", ""); err != nil {
-			logger.Fatal(err.Error(), zap.Error(err))
-		}
-	}()
+	servers.Go("http", func() error { return serveHttp(ctx, drain, logger, s, lns["https"]) })
 
-	return &tls.Config{GetCertificate: c.GetCertificate}, err
+	return &tls.Config{GetCertificate: tc.GetCertificate}, err
 
 }
 
+// serveHttp serves until ctx is done, then lets the requests finish until drain is done
+func serveHttp(ctx, drain context.Context, logger *zap.Logger, s *http.Server, lns []net.Listener) (err error) {
+	failed := make(chan error, len(lns))
+	for _, ln := range lns {
+		logger.Info("Starting HTTPS server", zap.Stringer("address", ln.Addr()))
+		go func(ln net.Listener) {
+			if err := s.ServeTLS(ln, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				failed <- err
+			}
+		}(ln)
+	}
+
+	select {
+	case <-ctx.Done():
+	case err = <-failed:
+		logger.Error("Server failed", zap.Error(err))
+	}
+	if shutdownErr := s.Shutdown(drain); shutdownErr != nil {
+		s.Close()
+		return fmt.Errorf("requests were cut off after the grace period: %v", shutdownErr)
+	}
+	return err
+}
+
 func makeTLSConfig(logger *zap.Logger) (c *tls.Config, err error) {
 	// Load TLS certs from fixed files
 	if *localCert != "" && *localKey != "" {
@@ -4,14 +4,17 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
-	"log"
 	"net"
 	"os"
 	"reflect"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
 	"github.com/emersion/go-imap/server"
 	"github.com/emersion/go-sasl"
 	"go.uber.org/zap"
@@ -19,97 +22,231 @@ import (
 
 const (
 	ImapDebug = 0
-	ImapAddr  = ":993"
 )
 
 func GetUnexportedField(field reflect.Value) interface{} {
 	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface()
 }
 
-func startImapServers(ctx context.Context, logger *zap.Logger, tlsConfig *tls.Config) {
-	be, err := FirestoreBackend(ctx)
-	if err != nil {
-		zap.L().Fatal(err.Error(), zap.Error(err))
-	}
+// mailBackend opens the mailboxes of IMAP logins. The login extension and
+// the AUTHENTICATE mechanisms handle logins before the server would call it.
+type mailBackend struct {
+	auth  *authService
+	mails MailStore
+}
 
-	// Create a new server
-	s := server.New(be)
-	s.Addr = ImapAddr // 143 is the insecure port
-	s.AllowInsecureAuth = true
-	if ImapDebug > 0 {
-		s.Debug = os.Stderr
+// Login implements backend.Backend
+func (b mailBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	if _, err := b.auth.Authenticate(username, password, addrIP(connInfo.RemoteAddr)); err != nil {
+		return nil, err
 	}
+	return b.mails.User(username)
+}
 
-	s.EnableAuth(sasl.Plain, func(conn server.Conn) sasl.Server {
-		return sasl.NewPlainServer(func(identity, username, password string) error {
-			logger.Info("sasl.Plain Auth", zap.String("username", username))
-			if identity != "" && identity != username {
-				return errors.New("identities not supported")
-			}
+// startImapServers serves until ctx is done, then waits until drain is done for clients to log out
+func startImapServers(ctx, drain context.Context, logger *zap.Logger, tlsConfig *tls.Config, lns listeners, auth *authService, mails MailStore) error {
+	// session opens the mailboxes of an authenticated user
+	session := func(conn server.Conn, username, keyID string) error {
+		user, err := mails.User(username)
+		if err != nil {
+			logger.Error(err.Error(), zap.Error(err))
+			return err
+		}
 
-			user, err := be.Login(conn.Info(), username, password)
-			if err != nil {
-				logger.Error(err.Error(), zap.Error(err))
-				return err
-			}
+		if _, err = ensureMailbox(user, "INBOX", logger); err != nil {
+			logger.Error(err.Error(), zap.Error(err))
+			return err
+		}
+		if _, err = ensureMailbox(user, "UNPAID", logger); err != nil {
+			logger.Error(err.Error(), zap.Error(err))
+			return err
+		}
+		if _, err = ensureMailbox(user, "Drafts", logger); err != nil {
+			logger.Error(err.Error(), zap.Error(err))
+			return err
+		}
 
-			if _, err = ensureMailbox(user, "INBOX", logger); err != nil {
-				logger.Error(err.Error(), zap.Error(err))
-				return err
-			}
-			if _, err = ensureMailbox(user, "UNPAID", logger); err != nil {
-				logger.Error(err.Error(), zap.Error(err))
-				return err
-			}
-			if _, err = ensureMailbox(user, "Drafts", logger); err != nil {
+		if keyID != "" {
+			// Revoking the app key ends this session
+			user = &revocableUser{user, appKeySessions.add(username, keyID, conn)}
+		}
+
+		ctx := conn.Context()
+		ctx.State = imap.AuthenticatedState
+		ctx.User = &loggingBackendUser{user, logger}
+		return nil
+	}
+
+	// login authenticates the connection, for LOGIN and AUTHENTICATE PLAIN alike
+	login := func(conn server.Conn, username, password string) error {
+		logger.Info("Login", zap.String("username", username))
+		keyID, err := auth.Authenticate(username, password, addrIP(conn.Info().RemoteAddr))
+		if err != nil {
+			if !errors.Is(err, errLockedOut) && !errors.Is(err, backend.ErrInvalidCredentials) {
 				logger.Error(err.Error(), zap.Error(err))
-				return err
 			}
+			return imapAuthError(err)
+		}
+		return session(conn, username, keyID)
+	}
 
-			ctx := conn.Context()
-			ctx.State = imap.AuthenticatedState
-			ctx.User = &loggingBackendUser{user, logger}
-			return nil
-		})
-	})
-
-	s.EnableAuth(sasl.OAuthBearer, func(conn server.Conn) sasl.Server {
-		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
-			logger.Info("sasl.OAuthBearer Auth", zap.String("username", opts.Username))
-			// TODO check this token!
-			_ = opts.Token
-			if strings.HasSuffix(opts.Username, ".q42.nl") {
-				ctx := conn.Context()
-				ctx.State = imap.AuthenticatedState
-				user, err := be.Login(conn.Info(), opts.Username, opts.Token)
-				if err != nil {
-					return &sasl.OAuthBearerError{Status: err.Error()}
+	// newServer creates a server, which only allows logins without TLS when
+	// asked to
+	newServer := func(allowInsecureAuth bool) *server.Server {
+		s := server.New(mailBackend{auth, mails})
+		s.AllowInsecureAuth = allowInsecureAuth
+		// Offers STARTTLS on the imap listeners
+		s.TLSConfig = tlsConfig
+		if ImapDebug > 0 {
+			s.Debug = os.Stderr
+		}
+		s.Enable(loginExtension{login})
+
+		s.EnableAuth(sasl.Plain, func(conn server.Conn) sasl.Server {
+			return sasl.NewPlainServer(func(identity, username, password string) error {
+				if identity != "" && identity != username {
+					return errors.New("identities not supported")
 				}
-				ctx.User = user
-				return nil
+				return login(conn, username, password)
+			})
+		})
+
+		if auth.tokens != nil {
+			for _, mechanism := range []string{sasl.OAuthBearer, xoauth2} {
+				mechanism := mechanism
+				s.EnableAuth(mechanism, func(conn server.Conn) sasl.Server {
+					return newOAuthServer(mechanism, func(username, token string) error {
+						logger.Info("OAuth login", zap.String("mechanism", mechanism), zap.String("username", username))
+						mailbox, err := auth.AuthenticateToken(username, token, addrIP(conn.Info().RemoteAddr))
+						if err != nil {
+							if !errors.Is(err, errLockedOut) && !errors.Is(err, backend.ErrInvalidCredentials) {
+								logger.Error(err.Error(), zap.Error(err))
+							}
+							return imapAuthError(err)
+						}
+						return session(conn, mailbox, "")
+					})
+				})
 			}
-			return &sasl.OAuthBearerError{
-				Status:  "invalid_request",
-				Schemes: "bearer",
+		}
+		return s
+	}
+	secure := newServer(false)
+	servers := []*server.Server{secure}
+	var local *server.Server
+
+	tlsConfig.InsecureSkipVerify = true
+	var wg sync.WaitGroup
+	// Keys revoked on another replica end their sessions here within the
+	// cache period, as they stop new logins
+	go auth.watchRevoked(ctx, appKeySessions, auth.ttl)
+
+	var stopping int32
+	failed := make(chan error, len(lns["imap"])+len(lns["imaps"]))
+	for _, protocol := range []string{"imap", "imaps"} {
+		for _, ln := range lns[protocol] {
+			logger.Info("Starting IMAP server", zap.String("protocol", protocol), zap.Stringer("address", ln.Addr()))
+			s := secure
+			if protocol == "imaps" {
+				ln = tls.NewListener(ln, tlsConfig)
+			} else if localAddr(ln.Addr()) {
+				// Plain imap on loopback or allowed_nets may log in without STARTTLS
+				if local == nil {
+					local = newServer(true)
+					servers = append(servers, local)
+				}
+				s = local
 			}
-		})
-	})
+			wg.Add(1)
+			go func(s *server.Server, ln net.Listener, protocol string) {
+				defer wg.Done()
+				if err := s.Serve(debugListener{ln, logger.With(zap.String("ln", protocol))}); err != nil && atomic.LoadInt32(&stopping) == 0 {
+					failed <- err
+				}
+			}(s, ln, protocol)
+		}
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-failed:
+		logger.Error("Server failed", zap.Error(err))
+	}
 
-	go func() {
-		<-ctx.Done()
+	// Stop accepting, give the clients until the end of the grace period to log out
+	atomic.StoreInt32(&stopping, 1)
+	lns.closeProtocols("imap", "imaps")
+	wg.Wait()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for imapSessions(servers) > 0 && drain.Err() == nil {
+		select {
+		case <-ticker.C:
+		case <-drain.Done():
+		}
+	}
+	if n := imapSessions(servers); n > 0 {
+		// Clients reconnect, so closing idle sessions is not a failure
+		logger.Info("Closing IMAP sessions after the grace period", zap.Int("sessions", n))
+	}
+	for _, s := range servers {
 		s.Close()
-	}()
+	}
+	return err
+}
 
-	logger.Info("Starting IMAP server at " + ImapAddr)
-	ln, err := net.Listen("tcp", ImapAddr)
-	if err != nil {
-		log.Fatal(err)
+func imapSessions(servers []*server.Server) (n int) {
+	for _, s := range servers {
+		s.ForEachConn(func(server.Conn) { n++ })
 	}
-	tlsConfig.InsecureSkipVerify = true
-	tlsListener := tls.NewListener(ln, tlsConfig)
-	if err := s.Serve(debugListener{tlsListener, logger.With(zap.String("ln", "tls"))}); err != nil {
-		log.Fatal(err)
+	return n
+}
+
+// loginExtension replaces the LOGIN command, which otherwise goes to the
+// backend directly, without the connection or the rate limits of the auth service
+type loginExtension struct {
+	login func(conn server.Conn, username, password string) error
+}
+
+func (loginExtension) Capabilities(server.Conn) []string {
+	return nil
+}
+
+func (e loginExtension) Command(name string) server.HandlerFactory {
+	if name != "LOGIN" {
+		return nil
+	}
+	return func() server.Handler { return &loginCommand{login: e.login} }
+}
+
+type loginCommand struct {
+	commands.Login
+	login func(conn server.Conn, username, password string) error
+}
+
+func (cmd *loginCommand) Handle(conn server.Conn) error {
+	if conn.Context().State != imap.NotAuthenticatedState {
+		return server.ErrAlreadyAuthenticated
+	}
+	// Like AUTHENTICATE PLAIN, only over TLS unless insecure auth is allowed
+	canAuth := false
+	for _, c := range conn.Capabilities() {
+		canAuth = canAuth || c == "AUTH=PLAIN"
+	}
+	if !canAuth {
+		return server.ErrAuthDisabled
+	}
+	if err := cmd.login(conn, cmd.Username, cmd.Password); err != nil {
+		return err
+	}
+
+	// Tell the capabilities of the authenticated state
+	var caps []interface{}
+	for _, c := range conn.Capabilities() {
+		caps = append(caps, imap.RawString(c))
 	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{Type: imap.StatusRespOk, Code: imap.CodeCapability, Arguments: caps}}
 }
 
 type debugListener struct {
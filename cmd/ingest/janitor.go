@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/chrj/smtpd"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/api/iterator"
+)
+
+// janitor purges unpaid mail from the UNPAID mailboxes and Firestore
+// once it is older than the retention of the mailbox
+type janitor struct {
+	w       wrap
+	records expiredQuarantine
+}
+
+// expiredQuarantine finds and removes the quarantine records of unpaid mail
+type expiredQuarantine interface {
+	// ExpiredMail lists the unpaid records of the mailbox from before the cutoff
+	ExpiredMail(recipient string, cutoff time.Time) ([]quarantinedMail, error)
+	DeleteQuarantined(recipient, id string) error
+}
+
+var _ expiredQuarantine = firestoreBackend{}
+
+// quarantinedMail is a quarantine record
+type quarantinedMail struct {
+	ID                  string
+	Stored              StoredMessage
+	Sender              string
+	Subject             string
+	Date                time.Time
+	SenderAuthenticated bool
+}
+
+func startJanitor(ctx context.Context, logger *zap.Logger, getSigner func(signDomain string) (*dkim.Signer, error), queue *outboundQueue, mails MailStore) error {
+	be, err := FirestoreBackend(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error starting firestore")
+	}
+	j := janitor{wrap{logger: logger, fb: &be, getSigner: getSigner, queue: queue, mails: mails}, be}
+
+	logger.Info("Starting janitor", zap.Duration("interval", *janitorInterval), zap.Duration("retention", *unpaidRetention))
+	ticker := time.NewTicker(*janitorInterval)
+	defer ticker.Stop()
+	for {
+		if err := j.purge(time.Now()); err != nil {
+			logger.Error("Failed to purge unpaid mail", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// purge removes all unpaid mail that expired before now
+func (j janitor) purge(now time.Time) error {
+	it := j.w.fb.db.Collection("mailboxes").Documents(j.w.fb.ctx)
+	for {
+		doc, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		retention := *unpaidRetention
+		days, _ := doc.DataAt("retentionDays")
+		if d := asInt64(days); d > 0 {
+			retention = time.Duration(d) * 24 * time.Hour
+		}
+		if err = j.purgeMailbox(doc.Ref.ID, retention, now); err != nil {
+			j.w.logger.Error("Failed to purge mailbox", zap.String("mailbox", doc.Ref.ID), zap.Error(err))
+		}
+	}
+}
+
+// purgeMailbox removes the mail of each expired record from UNPAID and then
+// the record, so that mail that is paid for meanwhile is left alone
+func (j janitor) purgeMailbox(mailbox string, retention time.Duration, now time.Time) error {
+	expired, err := j.records.ExpiredMail(mailbox, now.Add(-retention))
+	if err != nil {
+		return err
+	}
+	for _, mail := range expired {
+		err = j.w.mails.Delete(mailbox, "UNPAID", mail.Stored.UID, mail.Stored.UIDValidity)
+		if errors.Is(err, errMailNotFound) {
+			// Deleted by the user, or the folder was renumbered and the mail
+			// can no longer be told apart
+			j.w.logger.Warn("Expired mail not found", zap.String("mailbox", mailbox), zap.String("id", mail.ID), zap.Error(err))
+		} else if err != nil {
+			// The record stays, so the next run tries again
+			j.w.logger.Error("Failed to purge unpaid mail", zap.String("mailbox", mailbox), zap.String("id", mail.ID), zap.Error(err))
+			continue
+		}
+		if err = j.records.DeleteQuarantined(mailbox, mail.ID); err != nil {
+			return err
+		}
+		j.w.logger.Info("Purged unpaid mail",
+			zap.String("event", "purge"),
+			zap.String("mailbox", mailbox),
+			zap.String("id", mail.ID),
+			zap.Uint32("uid", mail.Stored.UID),
+			zap.String("sender", mail.Sender),
+			zap.Time("date", mail.Date),
+			zap.Duration("retention", retention))
+
+		// Only senders that passed authentication get a notice, the sender of
+		// forged mail is a bystander and a notice to it would be backscatter
+		if *expiryNotice && mail.Sender != "" && mail.SenderAuthenticated {
+			if err = j.notify(mailbox, mail.ID, mail.Sender, mail.Subject, mail.Date, retention); err != nil {
+				j.w.logger.Warn("Failed to send expiry notice", zap.String("mailbox", mailbox), zap.String("sender", mail.Sender), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// notify tells the sender the mail expired and was not delivered
+func (j janitor) notify(mailbox, id, sender, subject string, sent time.Time, retention time.Duration) error {
+	view := template.Must(template.ParseFS(templateResources, "resources/expired.txt"))
+	buf := bytes.NewBuffer(nil)
+	err := view.ExecuteTemplate(buf, "expired.txt", map[string]interface{}{
+		"Uid":             id,
+		"Domain":          *domain,
+		"From":            "info@" + *domain,
+		"To":              sender,
+		"Recipients":      mailbox,
+		"OriginalSubject": subject,
+		"Date":            time.Now().Format(time.RFC1123Z),
+		"Sent":            sent.Format(time.RFC1123Z),
+		"Retention":       fmt.Sprintf("%d days", int(retention.Hours()/24)),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+	return j.w.emit(ctx, smtpd.Envelope{
+		Sender:     "info@" + *domain,
+		Recipients: []string{sender},
+		Data:       buf.Bytes(),
+	})
+}
+
+// ExpiredMail implements expiredQuarantine
+func (b firestoreBackend) ExpiredMail(recipient string, cutoff time.Time) (expired []quarantinedMail, err error) {
+	it := b.db.Collection("mailboxes").Doc(recipient).Collection("emails").Where("date", "<", cutoff).Documents(b.ctx)
+	for {
+		doc, err := it.Next()
+		if err == iterator.Done {
+			return expired, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var data struct {
+			Paid        bool      `firestore:"paid"`
+			UID         uint32    `firestore:"uid"`
+			UIDValidity uint32    `firestore:"uidValidity"`
+			Sender      string    `firestore:"sender"`
+			Subject     string    `firestore:"subject"`
+			Date        time.Time `firestore:"date"`
+			Auth        struct {
+				SenderAuthenticated bool `firestore:"senderAuthenticated"`
+			} `firestore:"auth"`
+		}
+		if err = doc.DataTo(&data); err != nil {
+			return nil, err
+		}
+		if data.Paid {
+			continue
+		}
+		// Without a uid only the record can be purged
+		uid, _ := recordUID(doc.Ref.ID, data.UID)
+		expired = append(expired, quarantinedMail{
+			ID:                  doc.Ref.ID,
+			Stored:              StoredMessage{UID: uid, UIDValidity: data.UIDValidity},
+			Sender:              data.Sender,
+			Subject:             data.Subject,
+			Date:                data.Date,
+			SenderAuthenticated: data.Auth.SenderAuthenticated,
+		})
+	}
+}
+
+// DeleteQuarantined implements expiredQuarantine
+func (b firestoreBackend) DeleteQuarantined(recipient, id string) error {
+	_, err := b.db.Collection("mailboxes").Doc(recipient).Collection("emails").Doc(id).Delete(b.ctx)
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// memoryRecords keeps the quarantine records of one mailbox in memory
+type memoryRecords struct {
+	records []quarantinedMail
+	paid    map[string]bool
+}
+
+func (r *memoryRecords) ExpiredMail(recipient string, cutoff time.Time) (expired []quarantinedMail, err error) {
+	for _, mail := range r.records {
+		if mail.Date.Before(cutoff) && !r.paid[mail.ID] {
+			expired = append(expired, mail)
+		}
+	}
+	return expired, nil
+}
+
+func (r *memoryRecords) DeleteQuarantined(recipient, id string) error {
+	for i, mail := range r.records {
+		if mail.ID == id {
+			r.records = append(r.records[:i], r.records[i+1:]...)
+			return nil
+		}
+	}
+	return errMailNotFound
+}
+
+func TestPurgeMailbox(t *testing.T) {
+	mails := newMemoryStore(zap.NewNop())
+	records := &memoryRecords{paid: map[string]bool{}}
+	j := janitor{wrap{logger: zap.NewNop(), mails: mails}, records}
+	now := time.Now()
+
+	assert.NoError(t, j.purgeMailbox("herman@ptsm.q42.com", 24*time.Hour, now), "without an UNPAID folder nothing expires")
+
+	// Expired and fresh mail alternate, the mail dates are not looked at
+	for i := 1; i <= 6; i++ {
+		stored, err := mails.Append("herman@ptsm.q42.com", "UNPAID", nil, now, []byte(body))
+		assert.NoError(t, err)
+		date := now
+		if i%2 == 1 {
+			date = now.Add(-48 * time.Hour)
+		}
+		records.records = append(records.records, quarantinedMail{ID: string(rune('a' + i - 1)), Stored: stored, Date: date})
+	}
+	// Paid mail waits for its release, the user deleted another expired mail
+	records.paid["e"] = true
+	assert.NoError(t, mails.Delete("herman@ptsm.q42.com", "UNPAID", 3, 0))
+	// A record of before the folder was renumbered no longer finds its mail
+	records.records = append(records.records, quarantinedMail{ID: "old", Stored: StoredMessage{UID: 4, UIDValidity: 1}, Date: now.Add(-48 * time.Hour)})
+	// Mail the user marked \Deleted is not expunged along
+	assert.NoError(t, mails.SetFlags("herman@ptsm.q42.com", "UNPAID", 2, []string{imap.DeletedFlag}))
+
+	assert.NoError(t, j.purgeMailbox("herman@ptsm.q42.com", 24*time.Hour, now))
+	var ids []string
+	for _, mail := range records.records {
+		ids = append(ids, mail.ID)
+	}
+	assert.Equal(t, []string{"b", "d", "e", "f"}, ids)
+	list, err := mails.List("herman@ptsm.q42.com", "UNPAID")
+	assert.NoError(t, err)
+	var uids []uint32
+	for _, msg := range list {
+		uids = append(uids, msg.UID)
+	}
+	assert.Equal(t, []uint32{2, 4, 5, 6}, uids)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ledger keeps the prepaid balance of senders at balance/{sender}, with every
+// change recorded at balance/{sender}/transactions/{id}. These are the same
+// documents the web functions and the Stripe webhook use.
+type ledger struct {
+	db  *firestore.Client
+	ctx context.Context
+}
+
+func (b firestoreBackend) Ledger() ledger {
+	return ledger{b.db, b.ctx}
+}
+
+func (l ledger) balanceRef(user string) *firestore.DocumentRef {
+	return l.db.Collection("balance").Doc(user)
+}
+
+// Balance returns the balance of the user in cents
+func (l ledger) Balance(user string) (int64, error) {
+	doc, err := l.balanceRef(user).Get(l.ctx)
+	if status.Code(err) == codes.NotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	balance, _ := doc.DataAt("balance")
+	return asInt64(balance), nil
+}
+
+// Debit subtracts the price of a mail from the balance of the sender.
+// A mail is charged only once per recipient, so a client that retries the
+// delivery is not charged again. The mail is told by its Message-ID and the
+// hash of its body, as the sender could otherwise resend new content under a
+// paid Message-ID for free. Returns ErrInsufficientBalance if the sender can
+// not pay.
+func (l ledger) Debit(sender, recipient, messageID, bodyHash string, amount int64) error {
+	ref := l.balanceRef(sender)
+	txRef := ref.Collection("transactions").Doc(debitKey(sender, recipient, messageID, bodyHash))
+	return l.db.RunTransaction(l.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		_, err := tx.Get(txRef)
+		if err == nil {
+			// Already charged
+			return nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrInsufficientBalance
+		}
+		if err != nil {
+			return err
+		}
+		balance, _ := doc.DataAt("balance")
+		if asInt64(balance) < amount {
+			return ErrInsufficientBalance
+		}
+
+		err = tx.Update(ref, []firestore.Update{{Path: "balance", Value: firestore.Increment(-amount)}})
+		if err != nil {
+			return err
+		}
+		return tx.Create(txRef, map[string]interface{}{
+			"added":     firestore.ServerTimestamp,
+			"minus":     amount,
+			"source":    "mail",
+			"recipient": recipient,
+			"messageId": messageID,
+			"bodyHash":  bodyHash,
+		})
+	})
+}
+
+// Credit adds to the balance of the user. The transaction id makes crediting
+// idempotent, like the Stripe webhook does with the payment intent id.
+func (l ledger) Credit(user, transactionID, source string, amount int64) error {
+	if transactionID == "" {
+		return errors.New("missing transaction id")
+	}
+	ref := l.balanceRef(user)
+	txRef := ref.Collection("transactions").Doc(transactionID)
+	return l.db.RunTransaction(l.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		_, err := tx.Get(txRef)
+		if err == nil {
+			// Already credited
+			return nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		_, err = tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			err = tx.Create(ref, map[string]interface{}{
+				"balance": amount,
+				"added":   firestore.ServerTimestamp,
+			})
+		} else if err == nil {
+			err = tx.Update(ref, []firestore.Update{{Path: "balance", Value: firestore.Increment(amount)}})
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Create(txRef, map[string]interface{}{
+			"added":  firestore.ServerTimestamp,
+			"plus":   amount,
+			"source": source,
+		})
+	})
+}
+
+// debitKey is the transaction id of charging a mail to a recipient
+func debitKey(sender, recipient, messageID, bodyHash string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(sender) + "\n" + strings.ToLower(recipient) + "\n" + messageID + "\n" + bodyHash))
+	return "mail-" + hex.EncodeToString(sum[:])
+}
+
+// bodyHash is the hex sha256 of the body of a mail. The headers are left out,
+// as those this server adds, like Received, differ on every delivery.
+func bodyHash(data []byte) string {
+	if idx := bytes.Index(data, []byte("\r\n\r\n")); idx >= 0 {
+		data = data[idx+4:]
+	} else if idx := bytes.Index(data, []byte("\n\n")); idx >= 0 {
+		data = data[idx+2:]
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
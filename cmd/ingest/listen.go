@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Listeners come from -listen, as proto://addr entries, and from systemd
+// socket activation, where FileDescriptorName= of each socket is its protocol.
+// Plain imap listeners on loopback or allowed_nets addresses allow logins
+// without STARTTLS.
+var listenProtocols = []string{"smtp", "submission", "smtps", "imap", "imaps", "https"}
+
+type protoAddr struct {
+	protocol string
+	address  string
+}
+
+// submission tells if the protocol only accepts authenticated clients or allowed networks
+func (p protoAddr) submission() bool {
+	return p.protocol == "submission" || p.protocol == "smtps"
+}
+
+// parseListen parses space separated proto://addr entries, a bare address is smtp
+func parseListen(str string) ([]protoAddr, error) {
+	var addrs []protoAddr
+	for _, field := range strings.Fields(str) {
+		listen := protoAddr{protocol: "smtp", address: field}
+		if protocol, address, ok := strings.Cut(field, "://"); ok {
+			listen = protoAddr{protocol: protocol, address: address}
+		}
+		if !knownProtocol(listen.protocol) {
+			return nil, fmt.Errorf("%s: unknown protocol %q, use one of %s", field, listen.protocol, strings.Join(listenProtocols, ", "))
+		}
+		if _, port, err := net.SplitHostPort(listen.address); err != nil {
+			return nil, fmt.Errorf("%s: %v", field, err)
+		} else if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+			return nil, fmt.Errorf("%s: invalid port %q", field, port)
+		}
+		addrs = append(addrs, listen)
+	}
+	return addrs, nil
+}
+
+func knownProtocol(protocol string) bool {
+	for _, known := range listenProtocols {
+		if known == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// localAddr tells if the listener address is on loopback or in allowed_nets,
+// where clients may log in without TLS
+func localAddr(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok || tcp.IP.IsUnspecified() {
+		return false
+	}
+	return tcp.IP.IsLoopback() || inNetworks(tcp.IP, settings().allowedNets)
+}
+
+// listeners are the open sockets by protocol
+type listeners map[string][]net.Listener
+
+// openListeners opens the -listen addresses and adds the sockets passed by
+// systemd. The sockets of systemd replace the default -listen addresses.
+func openListeners(addrs []protoAddr) (listeners, error) {
+	lns, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(lns) > 0 && *listenStr == flagset.Lookup("listen").DefValue {
+		return lns, nil
+	}
+	for _, listen := range addrs {
+		ln, err := net.Listen("tcp", listen.address)
+		if err != nil {
+			lns.Close()
+			return nil, errors.Wrapf(err, "failed to listen for %s", listen.protocol)
+		}
+		lns[listen.protocol] = append(lns[listen.protocol], ln)
+	}
+	return lns, nil
+}
+
+// Close closes all listeners
+func (lns listeners) Close() {
+	for _, protocol := range lns {
+		for _, ln := range protocol {
+			ln.Close()
+		}
+	}
+}
+
+// closeProtocols closes the listeners of the protocols
+func (lns listeners) closeProtocols(protocols ...string) {
+	for _, protocol := range protocols {
+		for _, ln := range lns[protocol] {
+			ln.Close()
+		}
+	}
+}
+
+// systemd passes activated sockets from file descriptor 3 on (sd_listen_fds(3))
+const systemdFirstFD = 3
+
+// systemdListeners returns the sockets passed by systemd, if any
+func systemdListeners() (listeners, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners{}, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return listeners{}, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make([]*os.File, count)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(systemdFirstFD+i), fmt.Sprintf("LISTEN_FD_%d", systemdFirstFD+i))
+	}
+	// Children must not inherit the sockets
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return fileListeners(names, files)
+}
+
+// fileListeners turns the socket files into listeners for the protocol of their name
+func fileListeners(names []string, files []*os.File) (listeners, error) {
+	lns := listeners{}
+	for i, file := range files {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		if !knownProtocol(name) {
+			lns.Close()
+			return nil, fmt.Errorf("socket activation: set FileDescriptorName= of socket %d to one of %s, not %q", i, strings.Join(listenProtocols, ", "), name)
+		}
+		ln, err := net.FileListener(file)
+		// The listener has its own copy of the descriptor
+		file.Close()
+		if err != nil {
+			lns.Close()
+			return nil, errors.Wrapf(err, "socket activation: socket %d (%s)", i, name)
+		}
+		lns[name] = append(lns[name], ln)
+	}
+	return lns, nil
+}
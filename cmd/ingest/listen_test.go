@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListen(t *testing.T) {
+	addrs, err := parseListen("127.0.0.1:2525 submission://:2587 smtps://[::1]:2465 imap://:2143 imaps://:2993 https://localhost:8443")
+	assert.NoError(t, err)
+	assert.Equal(t, []protoAddr{
+		{"smtp", "127.0.0.1:2525"},
+		{"submission", ":2587"},
+		{"smtps", "[::1]:2465"},
+		{"imap", ":2143"},
+		{"imaps", ":2993"},
+		{"https", "localhost:8443"},
+	}, addrs)
+	assert.False(t, addrs[0].submission())
+	assert.True(t, addrs[1].submission())
+	assert.True(t, addrs[2].submission())
+
+	for _, invalid := range []string{"pop3://:110", "smtp://localhost", "smtp://:smtp", "imaps://:99999"} {
+		_, err := parseListen(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestOpenListeners(t *testing.T) {
+	lns, err := openListeners([]protoAddr{{"smtp", "127.0.0.1:0"}, {"imap", "127.0.0.1:0"}})
+	assert.NoError(t, err)
+	defer lns.Close()
+	assert.Len(t, lns["smtp"], 1)
+	assert.Len(t, lns["imap"], 1)
+	assert.Len(t, lns["https"], 0)
+
+	// A port in use fails, without leaking the others
+	_, err = openListeners([]protoAddr{{"smtp", "127.0.0.1:0"}, {"smtps", lns["smtp"][0].Addr().String()}})
+	assert.ErrorContains(t, err, "failed to listen for smtps")
+}
+
+func TestFileListeners(t *testing.T) {
+	socket := func() *os.File {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer ln.Close()
+		file, err := ln.(*net.TCPListener).File()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return file
+	}
+
+	files := []*os.File{socket(), socket()}
+	lns, err := fileListeners([]string{"smtp", "https"}, files)
+	assert.NoError(t, err)
+	defer lns.Close()
+	assert.Len(t, lns["smtp"], 1)
+	assert.Len(t, lns["https"], 1)
+
+	// Accepts connections on the passed socket
+	go func() {
+		if conn, err := lns["smtp"][0].Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", lns["smtp"][0].Addr().String())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	// Sockets without a known name are an error
+	_, err = fileListeners(nil, []*os.File{socket()})
+	assert.ErrorContains(t, err, `not "unknown"`)
+}
+
+func TestLocalAddr(t *testing.T) {
+	assert.True(t, localAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 143}))
+	assert.True(t, localAddr(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 143}))
+	assert.False(t, localAddr(&net.TCPAddr{IP: net.IPv4zero, Port: 143}), "all addresses include public ones")
+	assert.False(t, localAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 143}))
+	assert.False(t, localAddr(&net.UnixAddr{Name: "/run/imap.sock", Net: "unix"}))
+}
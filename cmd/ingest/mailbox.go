@@ -1,9 +1,6 @@
 package main
 
 import (
-	"time"
-
-	"github.com/bcampbell/tameimap/store"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
 	"go.uber.org/zap"
@@ -71,20 +68,3 @@ func include(list []string, needle string) []string {
 	}
 	return append(list, needle)
 }
-
-func (m *loggingBackendMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) (err error) {
-	defer func() {
-		if mbox, isStore := m.Mailbox.(*store.Mailbox); err == nil && isStore {
-			err = noErrMailCreated{mbox.Messages[len(mbox.Messages)-1]}
-		}
-	}()
-	return m.Mailbox.CreateMessage(flags, date, body)
-}
-
-type noErrMailCreated struct {
-	*store.Message
-}
-
-func (noErrMailCreated) Error() string {
-	return "not an error: mail created"
-}
@@ -0,0 +1,928 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-message"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Maildir++ keeps every message in a file of its own, so mailboxes can be
+// served by or migrated to Dovecot and other standard tools. INBOX is the
+// maildir of the mailbox itself, other folders are maildirs named after the
+// folder with a leading dot and dots between its levels (Archive/2022 is
+// .Archive.2022). Messages are written to tmp and renamed into new, so
+// readers never see a partial message. Flags are the suffix of the file name
+// once it moved to cur (:2,FS is \Flagged and \Seen). The UIDs and the
+// UIDVALIDITY of a folder are kept in its dovecot-uidlist, which is only
+// changed while holding Dovecot's dotlock.
+
+const (
+	maildirDirMode  = 0700
+	maildirFileMode = 0600
+
+	maildirUIDListFile       = "dovecot-uidlist"
+	maildirSubscriptionsFile = "subscriptions"
+	// maildirLockTimeout bounds the wait for the dotlock of a folder
+	maildirLockTimeout = 10 * time.Second
+	// maildirStaleLock is the age after which a dotlock was left by a crash
+	maildirStaleLock = 2 * time.Minute
+)
+
+// maildirFlags are the flags with their letters, in the ASCII order of the suffix
+var maildirFlags = []struct {
+	letter byte
+	flag   string
+}{
+	{'D', imap.DraftFlag},
+	{'F', imap.FlaggedFlag},
+	{'R', imap.AnsweredFlag},
+	{'S', imap.SeenFlag},
+	{'T', imap.DeletedFlag},
+}
+
+var errMaildirName = errors.New("mailbox names cannot contain a dot or empty levels")
+
+// maildirDeliveries makes the names of files delivered in the same microsecond unique
+var maildirDeliveries uint32
+
+// maildirLockRefresh is how often a held dotlock is touched, so that it only
+// gets older than maildirStaleLock when its holder is gone
+var maildirLockRefresh = maildirStaleLock / 4
+
+// maildirSubscribing guards the subscriptions files
+var maildirSubscribing sync.Mutex
+
+type maildirUser struct {
+	email string
+	dir   string
+}
+
+type maildirMailbox struct {
+	user *maildirUser
+	name string
+	dir  string
+}
+
+// maildirMessage is a message file, its base name is the part before the flags
+type maildirMessage struct {
+	uid  uint32
+	base string
+	// sub is "new" or "cur"
+	sub   string
+	flags []string
+}
+
+// maildirUIDList is the dovecot-uidlist of a folder, in version 3
+type maildirUIDList struct {
+	validity uint32
+	next     uint32
+	uids     map[string]uint32
+}
+
+var _ backend.User = &maildirUser{}
+var _ appender = &maildirMailbox{}
+
+// newMaildirStore stores mailboxes as Maildir++ directories under root, named by mailboxKey
+func newMaildirStore(root string, logger *zap.Logger) MailStore {
+	return folderStore{logger: logger, open: func(mailbox string) (backend.User, error) {
+		u := &maildirUser{mailbox, filepath.Join(root, mailboxKey(mailbox))}
+		// The mailbox itself is the INBOX maildir
+		if err := u.mailbox("INBOX").create(); err != nil {
+			return nil, errors.Wrap(err, "failed to make inbox")
+		}
+		return u, nil
+	}}
+}
+
+// maildirFolder is the directory of a folder below the mailbox
+func maildirFolder(name string) (string, error) {
+	if name == "INBOX" {
+		return "", nil
+	}
+	for _, level := range strings.Split(name, "/") {
+		if level == "" || strings.Contains(level, ".") {
+			return "", errMaildirName
+		}
+	}
+	return "." + strings.ReplaceAll(name, "/", "."), nil
+}
+
+func (u *maildirUser) mailbox(name string) *maildirMailbox {
+	name = folderName(name)
+	folder, err := maildirFolder(name)
+	if err != nil {
+		return &maildirMailbox{user: u, name: name}
+	}
+	return &maildirMailbox{user: u, name: name, dir: filepath.Join(u.dir, folder)}
+}
+
+// exists tells if the folder is a maildir, backend.ErrNoSuchMailbox if not
+func (mb *maildirMailbox) exists() error {
+	if mb.dir == "" {
+		return errMaildirName
+	}
+	_, err := os.Stat(filepath.Join(mb.dir, "cur"))
+	if os.IsNotExist(err) {
+		return backend.ErrNoSuchMailbox
+	}
+	return err
+}
+
+// create makes the maildir of the folder, Maildir++ marks folders with a maildirfolder file
+func (mb *maildirMailbox) create() error {
+	if mb.dir == "" {
+		return errMaildirName
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(mb.dir, sub), maildirDirMode); err != nil {
+			return err
+		}
+	}
+	if mb.name == "INBOX" {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(mb.dir, "maildirfolder"), nil, maildirFileMode)
+}
+
+// Username implements backend.User
+func (u *maildirUser) Username() string {
+	return u.email
+}
+
+// ListMailboxes implements backend.User
+func (u *maildirUser) ListMailboxes(subscribed bool) (out []backend.Mailbox, err error) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{"INBOX"}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") && len(entry.Name()) > 1 && entry.Name() != ".." {
+			names = append(names, strings.ReplaceAll(entry.Name()[1:], ".", "/"))
+		}
+	}
+	var subscriptions map[string]bool
+	if subscribed {
+		if subscriptions, err = u.subscriptions(); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range names {
+		if subscribed && !subscriptions[name] {
+			continue
+		}
+		if mb := u.mailbox(name); mb.exists() == nil {
+			out = append(out, mb)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// GetMailbox implements backend.User
+func (u *maildirUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mb := u.mailbox(name)
+	if err := mb.exists(); err != nil {
+		return nil, err
+	}
+	return mb, nil
+}
+
+// CreateMailbox implements backend.User
+func (u *maildirUser) CreateMailbox(name string) error {
+	mb := u.mailbox(name)
+	err := mb.exists()
+	if err == nil {
+		return errMailboxExists
+	}
+	if err != backend.ErrNoSuchMailbox {
+		return err
+	}
+	return mb.create()
+}
+
+// DeleteMailbox implements backend.User
+func (u *maildirUser) DeleteMailbox(name string) error {
+	mb := u.mailbox(name)
+	if mb.name == "INBOX" {
+		return errors.New("Cannot delete INBOX")
+	}
+	if err := mb.exists(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(mb.dir); err != nil {
+		return err
+	}
+	return u.subscribe(mb.name, false)
+}
+
+// RenameMailbox implements backend.User. Its children are renamed along, but
+// renaming INBOX moves its messages to the new mailbox and leaves INBOX empty
+// (RFC 3501 §6.3.5).
+func (u *maildirUser) RenameMailbox(existingName, newName string) error {
+	from, to := u.mailbox(existingName), u.mailbox(newName)
+	if err := from.exists(); err != nil {
+		return err
+	}
+	if from.name == "INBOX" {
+		if err := u.CreateMailbox(to.name); err != nil {
+			return err
+		}
+		return from.moveAll(to)
+	}
+	switch err := to.exists(); err {
+	case nil:
+		return errMailboxExists
+	case backend.ErrNoSuchMailbox:
+	default:
+		return err
+	}
+
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return err
+	}
+	subscribed, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+	prefix, renamed := filepath.Base(from.dir), filepath.Base(to.dir)
+	for _, entry := range entries {
+		if entry.Name() != prefix && !strings.HasPrefix(entry.Name(), prefix+".") {
+			continue
+		}
+		target := renamed + strings.TrimPrefix(entry.Name(), prefix)
+		if err = os.Rename(filepath.Join(u.dir, entry.Name()), filepath.Join(u.dir, target)); err != nil {
+			return err
+		}
+		name := strings.ReplaceAll(entry.Name()[1:], ".", "/")
+		if subscribed[name] {
+			if err = u.subscribe(name, false); err != nil {
+				return err
+			}
+			if err = u.subscribe(strings.ReplaceAll(target[1:], ".", "/"), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Logout implements backend.User
+func (u *maildirUser) Logout() error {
+	return nil
+}
+
+// subscriptions reads the subscriptions file, one folder per line
+func (u *maildirUser) subscriptions() (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(u.dir, maildirSubscriptionsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	subscribed := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			subscribed[line] = true
+		}
+	}
+	return subscribed, nil
+}
+
+// subscribe adds or removes a folder from the subscriptions file
+func (u *maildirUser) subscribe(name string, subscribed bool) error {
+	maildirSubscribing.Lock()
+	defer maildirSubscribing.Unlock()
+	names, err := u.subscriptions()
+	if err != nil || names[name] == subscribed {
+		return err
+	}
+	if subscribed {
+		names[name] = true
+	} else {
+		delete(names, name)
+	}
+	var list []string
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	var buf bytes.Buffer
+	for _, name := range list {
+		buf.WriteString(name + "\n")
+	}
+	return writeFileAtomic(filepath.Join(u.dir, maildirSubscriptionsFile), buf.Bytes())
+}
+
+// Name implements backend.Mailbox
+func (mb *maildirMailbox) Name() string {
+	return mb.name
+}
+
+// Info implements backend.Mailbox
+func (mb *maildirMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: mb.name}, nil
+}
+
+// Status implements backend.Mailbox
+func (mb *maildirMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	list, messages, err := mb.messages()
+	if err != nil {
+		return nil, err
+	}
+
+	s := imap.NewMailboxStatus(mb.name, items)
+	s.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	s.PermanentFlags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	for i, msg := range messages {
+		if !hasFlag(msg.flags, imap.SeenFlag) {
+			s.UnseenSeqNum = uint32(i + 1)
+			break
+		}
+	}
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			s.Messages = uint32(len(messages))
+		case imap.StatusUidNext:
+			s.UidNext = list.next
+		case imap.StatusUidValidity:
+			s.UidValidity = list.validity
+		case imap.StatusRecent:
+			for _, msg := range messages {
+				if msg.sub == "new" {
+					s.Recent++
+				}
+			}
+		case imap.StatusUnseen:
+			for _, msg := range messages {
+				if !hasFlag(msg.flags, imap.SeenFlag) {
+					s.Unseen++
+				}
+			}
+		}
+	}
+	return s, nil
+}
+
+// SetSubscribed implements backend.Mailbox
+func (mb *maildirMailbox) SetSubscribed(subscribed bool) error {
+	return mb.user.subscribe(mb.name, subscribed)
+}
+
+// Check implements backend.Mailbox
+func (mb *maildirMailbox) Check() error {
+	return nil
+}
+
+// ListMessages implements backend.Mailbox
+func (mb *maildirMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	messages, seqNums, err := mb.selected(uid, seqset)
+	if err != nil {
+		return err
+	}
+	withBody := fetchNeedsBody(items)
+	for i, msg := range messages {
+		m, err := mb.load(msg, withBody)
+		if os.IsNotExist(err) {
+			// Expunged since it was listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fetched, err := m.Fetch(seqNums[i], items)
+		if err != nil {
+			continue
+		}
+		ch <- fetched
+	}
+	return nil
+}
+
+// SearchMessages implements backend.Mailbox
+func (mb *maildirMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	_, messages, err := mb.messages()
+	if err != nil {
+		return nil, err
+	}
+	withBody := searchNeedsBody(criteria)
+	var ids []uint32
+	for i, msg := range messages {
+		seqNum := uint32(i + 1)
+		m, err := mb.load(msg, withBody)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if withBody {
+			ok, err = m.Match(seqNum, criteria)
+		} else {
+			// Matching on uid, dates and flags only
+			e, _ := message.New(message.Header{}, bytes.NewReader(nil))
+			ok, err = backendutil.Match(e, seqNum, m.Uid, m.Date, m.Flags, criteria)
+		}
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids, nil
+}
+
+// CreateMessage implements backend.Mailbox
+func (mb *maildirMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(body); err != nil {
+		return err
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	_, err := mb.appendMessage(flags, date, buf.Bytes())
+	return err
+}
+
+// appendMessage implements appender. The message is written to tmp first,
+// then renamed into new, or into cur when it has flags, under the next uid.
+func (mb *maildirMailbox) appendMessage(flags []string, date time.Time, body []byte) (uid uint32, err error) {
+	base := maildirBaseName(len(body))
+	tmp := filepath.Join(mb.dir, "tmp", base)
+	if err = writeFileSync(tmp, body); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if err = os.Chtimes(tmp, date, date); err != nil {
+		return 0, err
+	}
+
+	unlock, err := mb.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	list, _, err := mb.sync()
+	if err != nil {
+		return 0, err
+	}
+	msg := maildirMessage{uid: list.next, base: base, sub: "new", flags: flags}
+	if len(maildirInfo(flags)) > 0 {
+		msg.sub = "cur"
+	}
+	if err = os.Rename(tmp, mb.path(msg)); err != nil {
+		return 0, err
+	}
+	list.uids[base] = list.next
+	list.next++
+	if err = mb.writeUIDList(list); err != nil {
+		// Without its uid the next sync would number the message again
+		os.Remove(mb.path(msg))
+		return 0, err
+	}
+	return msg.uid, nil
+}
+
+// UpdateMessagesFlags implements backend.Mailbox. Flags other than the system
+// flags have no letter in Maildir and are not kept.
+func (mb *maildirMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	unlock, err := mb.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, messages, err := mb.sync()
+	if err != nil {
+		return err
+	}
+	for i, msg := range messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.uid
+		}
+		if !seqset.Contains(id) {
+			continue
+		}
+		updated := msg
+		updated.sub = "cur"
+		updated.flags = backendutil.UpdateFlags(append([]string(nil), msg.flags...), operation, flags)
+		if err = os.Rename(mb.path(msg), mb.path(updated)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyMessages implements backend.Mailbox
+func (mb *maildirMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	dest := mb.user.mailbox(destName)
+	if err := dest.exists(); err != nil {
+		return err
+	}
+	messages, _, err := mb.selected(uid, seqset)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		m, err := mb.load(msg, true)
+		if err != nil {
+			return err
+		}
+		if _, err = dest.appendMessage(msg.flags, m.Date, m.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expunge implements backend.Mailbox
+func (mb *maildirMailbox) Expunge() error {
+	unlock, err := mb.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	list, messages, err := mb.sync()
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if !hasFlag(msg.flags, imap.DeletedFlag) {
+			continue
+		}
+		if err = os.Remove(mb.path(msg)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(list.uids, msg.base)
+	}
+	return mb.writeUIDList(list)
+}
+
+// deleteMessage implements appender
+func (mb *maildirMailbox) deleteMessage(uid uint32) error {
+	unlock, err := mb.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	list, messages, err := mb.sync()
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if msg.uid != uid {
+			continue
+		}
+		if err = os.Remove(mb.path(msg)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(list.uids, msg.base)
+		return mb.writeUIDList(list)
+	}
+	return errors.Wrapf(errMailNotFound, "no message %d in %s", uid, mb.name)
+}
+
+// moveAll moves the messages to another folder, which takes over the uids.
+// The folder itself continues with the next uid under another UIDVALIDITY.
+func (mb *maildirMailbox) moveAll(to *maildirMailbox) error {
+	unlock, err := mb.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	list, messages, err := mb.sync()
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if err = os.Rename(mb.path(msg), to.path(msg)); err != nil {
+			return err
+		}
+	}
+	if err = to.writeUIDList(list); err != nil {
+		return err
+	}
+	return mb.writeUIDList(maildirUIDList{validity: newUIDValidity(), next: list.next, uids: map[string]uint32{}})
+}
+
+// path is the file of a message, with the flags in its name once it is in cur
+func (mb *maildirMailbox) path(msg maildirMessage) string {
+	if msg.sub == "new" {
+		return filepath.Join(mb.dir, "new", msg.base)
+	}
+	return filepath.Join(mb.dir, "cur", msg.base+":2,"+maildirInfo(msg.flags))
+}
+
+// messages lists the messages in uid order, their index being the sequence number minus one
+func (mb *maildirMailbox) messages() (maildirUIDList, []maildirMessage, error) {
+	unlock, err := mb.lock()
+	if err != nil {
+		return maildirUIDList{}, nil, err
+	}
+	defer unlock()
+	return mb.sync()
+}
+
+// selected lists the messages in the seqset, by uid or sequence number
+func (mb *maildirMailbox) selected(uid bool, seqset *imap.SeqSet) (messages []maildirMessage, seqNums []uint32, err error) {
+	_, all, err := mb.messages()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, msg := range all {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if seqset.Contains(id) {
+			messages = append(messages, msg)
+			seqNums = append(seqNums, seqNum)
+		}
+	}
+	return messages, seqNums, nil
+}
+
+// load reads the date and size, and the body when it is needed
+func (mb *maildirMailbox) load(msg maildirMessage, withBody bool) (*memory.Message, error) {
+	info, err := os.Stat(mb.path(msg))
+	if err != nil {
+		return nil, err
+	}
+	m := &memory.Message{Uid: msg.uid, Date: info.ModTime(), Size: uint32(info.Size()), Flags: msg.flags}
+	if !withBody {
+		return m, nil
+	}
+	m.Body, err = os.ReadFile(mb.path(msg))
+	return m, err
+}
+
+// sync reads the messages in new and cur, and gives the ones that appeared
+// the next uids, in the order of their names. The caller holds the lock.
+func (mb *maildirMailbox) sync() (maildirUIDList, []maildirMessage, error) {
+	list, err := mb.readUIDList()
+	if err != nil {
+		return list, nil, err
+	}
+	var messages, appeared []maildirMessage
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(mb.dir, sub))
+		if err != nil {
+			return list, nil, err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			base, info, _ := strings.Cut(entry.Name(), ":")
+			msg := maildirMessage{base: base, sub: sub, flags: parseMaildirInfo(info)}
+			if uid, ok := list.uids[base]; ok {
+				msg.uid = uid
+				messages = append(messages, msg)
+			} else {
+				appeared = append(appeared, msg)
+			}
+		}
+	}
+
+	changed := len(messages) != len(list.uids)
+	if changed {
+		// Forget the messages that were removed
+		list.uids = make(map[string]uint32, len(messages))
+		for _, msg := range messages {
+			list.uids[msg.base] = msg.uid
+		}
+	}
+	sort.Slice(appeared, func(i, j int) bool { return appeared[i].base < appeared[j].base })
+	for _, msg := range appeared {
+		msg.uid = list.next
+		list.uids[msg.base] = msg.uid
+		list.next++
+		messages = append(messages, msg)
+		changed = true
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].uid < messages[j].uid })
+	if changed {
+		return list, messages, mb.writeUIDList(list)
+	}
+	return list, messages, nil
+}
+
+// readUIDList reads the dovecot-uidlist, a missing one starts a new UIDVALIDITY
+func (mb *maildirMailbox) readUIDList() (maildirUIDList, error) {
+	list := maildirUIDList{validity: newUIDValidity(), next: 1, uids: map[string]uint32{}}
+	f, err := os.Open(filepath.Join(mb.dir, maildirUIDListFile))
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return list, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return list, scanner.Err()
+	}
+	// The header is "3 V<uidvalidity> N<next uid> ...", the entries "<uid> ... :<base name>"
+	header := strings.Fields(scanner.Text())
+	if len(header) == 0 || header[0] != "3" {
+		return list, errors.Errorf("unsupported %s in %s", maildirUIDListFile, mb.dir)
+	}
+	for _, field := range header[1:] {
+		n, err := strconv.ParseUint(field[1:], 10, 32)
+		if err != nil {
+			continue
+		}
+		switch field[0] {
+		case 'V':
+			list.validity = uint32(n)
+		case 'N':
+			list.next = uint32(n)
+		}
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		uid, rest, _ := strings.Cut(line, " ")
+		n, err := strconv.ParseUint(uid, 10, 32)
+		_, base, ok := strings.Cut(rest, ":")
+		if err != nil || !ok {
+			return list, errors.Errorf("invalid line %q in %s of %s", line, maildirUIDListFile, mb.dir)
+		}
+		list.uids[base] = uint32(n)
+		if uint32(n) >= list.next {
+			list.next = uint32(n) + 1
+		}
+	}
+	return list, scanner.Err()
+}
+
+// writeUIDList replaces the dovecot-uidlist, the caller holds the lock
+func (mb *maildirMailbox) writeUIDList(list maildirUIDList) error {
+	type entry struct {
+		uid  uint32
+		base string
+	}
+	entries := make([]entry, 0, len(list.uids))
+	for base, uid := range list.uids {
+		entries = append(entries, entry{uid, base})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].uid < entries[j].uid })
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "3 V%d N%d\n", list.validity, list.next)
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%d :%s\n", e.uid, e.base)
+	}
+	return writeFileAtomic(filepath.Join(mb.dir, maildirUIDListFile), buf.Bytes())
+}
+
+// lock takes the dotlock of the dovecot-uidlist, which Dovecot takes as well.
+// Like Dovecot it touches the lock while it is held, so a lock older than
+// maildirStaleLock was left behind and is broken.
+func (mb *maildirMailbox) lock() (unlock func(), err error) {
+	if mb.dir == "" {
+		return nil, errMaildirName
+	}
+	path := filepath.Join(mb.dir, maildirUIDListFile+".lock")
+	deadline := time.Now().Add(maildirLockTimeout)
+	for wait := time.Millisecond; ; wait *= 2 {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, maildirFileMode)
+		if err == nil {
+			f.Close()
+			done := make(chan struct{})
+			go refreshLock(path, maildirLockRefresh, done)
+			return func() {
+				close(done)
+				os.Remove(path)
+			}, nil
+		}
+		if os.IsNotExist(err) {
+			return nil, backend.ErrNoSuchMailbox
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > maildirStaleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.Errorf("timed out waiting for %s", path)
+		}
+		if wait > 100*time.Millisecond {
+			wait = 100 * time.Millisecond
+		}
+		time.Sleep(wait)
+	}
+}
+
+// refreshLock touches the dotlock periodically until done is closed
+func refreshLock(path string, every time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			os.Chtimes(path, now, now)
+		}
+	}
+}
+
+// maildirBaseName is a unique file name as Dovecot makes them, with the size
+func maildirBaseName(size int) string {
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint32(&maildirDeliveries, 1), host, size)
+}
+
+// maildirInfo is the flags suffix of a file name, without the "2,"
+func maildirInfo(flags []string) string {
+	var info []byte
+	for _, f := range maildirFlags {
+		if hasFlag(flags, f.flag) {
+			info = append(info, f.letter)
+		}
+	}
+	return string(info)
+}
+
+func parseMaildirInfo(info string) (flags []string) {
+	if !strings.HasPrefix(info, "2,") {
+		return nil
+	}
+	letters := info[2:]
+	for _, f := range maildirFlags {
+		if strings.IndexByte(letters, f.letter) >= 0 {
+			flags = append(flags, f.flag)
+		}
+	}
+	return flags
+}
+
+// writeFileSync writes a new file and syncs it to disk before it is renamed into place
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, maildirFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// writeFileAtomic replaces a file by renaming a synced temporary file over it
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestMaildirLayout(t *testing.T) {
+	root := t.TempDir()
+	mails := newMaildirStore(root, zap.NewNop())
+	date := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	_, err := mails.Append("herman@ptsm.q42.com", "INBOX", nil, date, []byte(body))
+	assert.NoError(t, err)
+	_, err = mails.Append("herman@ptsm.q42.com", "Archive/2022", []string{imap.SeenFlag, imap.FlaggedFlag}, date, []byte(body))
+	assert.NoError(t, err)
+
+	inbox := filepath.Join(root, "herman@ptsm.q42.com")
+	for _, sub := range []string{"cur", "new", "tmp", ".Archive.2022/cur"} {
+		assert.DirExists(t, filepath.Join(inbox, sub))
+	}
+	assert.FileExists(t, filepath.Join(inbox, ".Archive.2022/maildirfolder"))
+	info, err := os.Stat(inbox)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// New mail without flags lands in new, with its date as modification time
+	files, _ := filepath.Glob(filepath.Join(inbox, "new", "*"))
+	if assert.Len(t, files, 1) {
+		assert.True(t, strings.HasSuffix(files[0], ",S=205"), files[0])
+		info, err = os.Stat(files[0])
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		assert.True(t, date.Equal(info.ModTime()))
+	}
+	files, _ = filepath.Glob(filepath.Join(inbox, ".Archive.2022", "cur", "*"))
+	if assert.Len(t, files, 1) {
+		assert.True(t, strings.HasSuffix(files[0], ":2,FS"), files[0])
+	}
+	uidlist, err := os.ReadFile(filepath.Join(inbox, ".Archive.2022", "dovecot-uidlist"))
+	assert.NoError(t, err)
+	assert.Regexp(t, `^3 V\d+ N2\n1 :\d+\.M\d+P\d+Q\d+\..*,S=205\n$`, string(uidlist))
+
+	// Flags and uids last beyond the opened user
+	assert.NoError(t, mails.SetFlags("herman@ptsm.q42.com", "INBOX", 1, []string{imap.AnsweredFlag, imap.DraftFlag}))
+	list, err := mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, uint32(1), list[0].UID)
+		assert.Equal(t, []string{imap.DraftFlag, imap.AnsweredFlag}, list[0].Flags)
+	}
+	files, _ = filepath.Glob(filepath.Join(inbox, "cur", "*"))
+	if assert.Len(t, files, 1) {
+		assert.True(t, strings.HasSuffix(files[0], ":2,DR"), files[0])
+	}
+}
+
+func TestMaildirConcurrentAppend(t *testing.T) {
+	mails := newMaildirStore(t.TempDir(), zap.NewNop())
+	var wg sync.WaitGroup
+	uids := make([]uint32, 20)
+	for i := range uids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stored, err := mails.Append("herman@ptsm.q42.com", "UNPAID", nil, time.Now(), []byte(body))
+			assert.NoError(t, err)
+			uids[i] = stored.UID
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[uint32]bool{}
+	for _, uid := range uids {
+		assert.False(t, seen[uid], "uid %d was given twice", uid)
+		seen[uid] = true
+	}
+	list, err := mails.List("herman@ptsm.q42.com", "UNPAID")
+	assert.NoError(t, err)
+	assert.Len(t, list, len(uids))
+}
+
+func TestMaildirExternalChanges(t *testing.T) {
+	root := t.TempDir()
+	mails := newMaildirStore(root, zap.NewNop())
+	_, err := mails.Append("herman@ptsm.q42.com", "INBOX", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+
+	// Mail delivered by another tool gets the next uid, removed mail is forgotten
+	inbox := filepath.Join(root, "herman@ptsm.q42.com")
+	assert.NoError(t, os.WriteFile(filepath.Join(inbox, "cur", "1664625600.M1P1.example.org:2,S"), []byte(body), 0600))
+	files, _ := filepath.Glob(filepath.Join(inbox, "new", "*"))
+	assert.NoError(t, os.Remove(files[0]))
+
+	list, err := mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	if assert.Len(t, list, 1) {
+		assert.Equal(t, uint32(2), list[0].UID)
+		assert.Equal(t, []string{imap.SeenFlag}, list[0].Flags)
+	}
+
+	// A stale lock left by a crash is broken
+	lock := filepath.Join(inbox, "dovecot-uidlist.lock")
+	assert.NoError(t, os.WriteFile(lock, nil, 0600))
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(lock, old, old))
+	_, err = mails.Append("herman@ptsm.q42.com", "INBOX", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	assert.NoFileExists(t, lock)
+}
+
+func TestMaildirFolders(t *testing.T) {
+	mails := newMaildirStore(t.TempDir(), zap.NewNop())
+	u, err := mails.User("herman@ptsm.q42.com")
+	assert.NoError(t, err)
+
+	assert.Equal(t, errMailboxExists, u.CreateMailbox("inbox"))
+	assert.NoError(t, u.CreateMailbox("Archive"))
+	assert.NoError(t, u.CreateMailbox("Archive/2022"))
+	assert.Equal(t, errMaildirName, u.CreateMailbox("Lists.go"))
+	assert.Equal(t, errMaildirName, u.CreateMailbox("Archive//2022"))
+
+	archive, err := u.GetMailbox("Archive")
+	assert.NoError(t, err)
+	assert.NoError(t, archive.SetSubscribed(true))
+	mailboxes, err := u.ListMailboxes(true)
+	assert.NoError(t, err)
+	if assert.Len(t, mailboxes, 1) {
+		assert.Equal(t, "Archive", mailboxes[0].Name())
+	}
+
+	_, err = mails.Append("herman@ptsm.q42.com", "Archive/2022", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	assert.NoError(t, u.RenameMailbox("Archive", "Old"))
+	mailboxes, err = u.ListMailboxes(false)
+	assert.NoError(t, err)
+	var names []string
+	for _, mb := range mailboxes {
+		names = append(names, mb.Name())
+	}
+	assert.Equal(t, []string{"INBOX", "Old", "Old/2022"}, names)
+	list, err := mails.List("herman@ptsm.q42.com", "Old/2022")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	mailboxes, err = u.ListMailboxes(true)
+	assert.NoError(t, err)
+	if assert.Len(t, mailboxes, 1) {
+		assert.Equal(t, "Old", mailboxes[0].Name(), "subscriptions are renamed along")
+	}
+
+	// Renaming INBOX moves its messages, INBOX continues with the next uid
+	_, err = mails.Append("herman@ptsm.q42.com", "INBOX", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	assert.NoError(t, u.RenameMailbox("INBOX", "Saved"))
+	list, err = mails.List("herman@ptsm.q42.com", "Saved")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	stored, err := mails.Append("herman@ptsm.q42.com", "INBOX", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), stored.UID)
+
+	assert.Error(t, u.DeleteMailbox("INBOX"))
+	assert.NoError(t, u.DeleteMailbox("Old/2022"))
+	assert.Equal(t, backend.ErrNoSuchMailbox, u.DeleteMailbox("Old/2022"))
+}
+
+func TestMaildirInfo(t *testing.T) {
+	assert.Equal(t, "FST", maildirInfo([]string{imap.DeletedFlag, imap.SeenFlag, imap.FlaggedFlag, "$Label1"}))
+	assert.Equal(t, "", maildirInfo(nil))
+	assert.Equal(t, []string{imap.DraftFlag, imap.AnsweredFlag}, parseMaildirInfo("2,RDa"))
+	assert.Nil(t, parseMaildirInfo("1,experimental"))
+}
+
+func TestMaildirLockRefresh(t *testing.T) {
+	defer func(refresh time.Duration) { maildirLockRefresh = refresh }(maildirLockRefresh)
+	maildirLockRefresh = 10 * time.Millisecond
+	dir := t.TempDir()
+	mb := &maildirMailbox{name: "INBOX", dir: dir}
+	path := filepath.Join(dir, maildirUIDListFile+".lock")
+
+	// A lock that is held does not become stale
+	unlock, err := mb.lock()
+	assert.NoError(t, err)
+	old := time.Now().Add(-maildirStaleLock)
+	assert.NoError(t, os.Chtimes(path, old, old))
+	time.Sleep(50 * time.Millisecond)
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, time.Now(), info.ModTime(), time.Second)
+	}
+	unlock()
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
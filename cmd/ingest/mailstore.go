@@ -0,0 +1,305 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// The mail store keeps the folders of all mailboxes. SMTP delivery, the IMAP
+// server and the HTTP API share one, so that delivered mail shows up in IMAP
+// and released mail moves for all of them. It is selected with -mail_store.
+
+const (
+	mailStoreDisk      = "disk"
+	mailStoreMemory    = "memory"
+	mailStoreMaildir   = "maildir"
+	mailStoreFirestore = "firestore"
+)
+
+var errMailNotFound = errors.New("mail not found")
+
+// MailStore stores the messages of mailboxes, by their full email address,
+// which the stores on disk name the directories after with mailboxKey.
+// Missing folders and messages are errMailNotFound.
+type MailStore interface {
+	// User opens a mailbox for IMAP
+	User(mailbox string) (backend.User, error)
+	// Append stores a message in the folder, which is created when missing
+	Append(mailbox, folder string, flags []string, date time.Time, body []byte) (StoredMessage, error)
+	// Move moves a message with its flags to another folder, which is created
+	// when missing. A non-zero uidValidity must match that of the folder.
+	Move(mailbox, from, to string, uid, uidValidity uint32) (StoredMessage, error)
+	// SetFlags replaces the flags of a message
+	SetFlags(mailbox, folder string, uid uint32, flags []string) error
+	// List lists the messages in a folder
+	List(mailbox, folder string) ([]StoredMessage, error)
+	// Delete removes a message from a folder. A non-zero uidValidity must
+	// match that of the folder.
+	Delete(mailbox, folder string, uid, uidValidity uint32) error
+}
+
+// StoredMessage is a message as the store keeps it. Together with the
+// UIDVALIDITY of its folder the UID identifies it.
+type StoredMessage struct {
+	UID         uint32
+	UIDValidity uint32
+	Size        uint32
+	Date        time.Time
+	Flags       []string
+}
+
+// newMailStore opens the store selected with mail_store
+func newMailStore(fb firestoreBackend, logger *zap.Logger) (MailStore, error) {
+	switch *mailStore {
+	case mailStoreDisk:
+		if err := migrateMailboxDirs("mails", *domain, logger); err != nil {
+			return nil, err
+		}
+		return newDiskStore("mails", logger), nil
+	case mailStoreMemory:
+		return newMemoryStore(logger), nil
+	case mailStoreMaildir:
+		if err := migrateMailboxDirs(*maildirRoot, *domain, logger); err != nil {
+			return nil, err
+		}
+		return newMaildirStore(*maildirRoot, logger), nil
+	case mailStoreFirestore:
+		return folderStore{logger: logger, open: func(mailbox string) (backend.User, error) {
+			return fb.mailUser(mailbox), nil
+		}}, nil
+	}
+	return nil, errors.Errorf("unknown mail store %q", *mailStore)
+}
+
+// appender is a mailbox that tells the uid it stored a message at,
+// which CreateMessage of backend.Mailbox does not
+type appender interface {
+	backend.Mailbox
+	appendMessage(flags []string, date time.Time, body []byte) (uid uint32, err error)
+	// deleteMessage removes the message alone, unlike Expunge which also
+	// removes the messages the user marked \Deleted
+	deleteMessage(uid uint32) error
+}
+
+// folderStore implements MailStore on the IMAP folders of the stores,
+// whose mailboxes must implement appender
+type folderStore struct {
+	logger *zap.Logger
+	open   func(mailbox string) (backend.User, error)
+}
+
+var _ MailStore = folderStore{}
+
+// User implements MailStore
+func (s folderStore) User(mailbox string) (backend.User, error) {
+	return s.open(mailbox)
+}
+
+// folder opens a folder of the mailbox, creating it when asked to
+func (s folderStore) folder(mailbox, name string, create bool) (appender, error) {
+	u, err := s.open(mailbox)
+	if err != nil {
+		return nil, err
+	}
+	var mb backend.Mailbox
+	if create {
+		mb, err = ensureMailbox(u, name, s.logger)
+	} else {
+		mb, err = u.GetMailbox(name)
+	}
+	if err == backend.ErrNoSuchMailbox {
+		return nil, errors.Wrapf(errMailNotFound, "no folder %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a, ok := mb.(appender)
+	if !ok {
+		return nil, errors.Errorf("folder %s of %T cannot append", name, mb)
+	}
+	return a, nil
+}
+
+// Append implements MailStore
+func (s folderStore) Append(mailbox, folder string, flags []string, date time.Time, body []byte) (StoredMessage, error) {
+	mb, err := s.folder(mailbox, folder, true)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	uid, err := mb.appendMessage(flags, date, body)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	status, err := mb.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	return StoredMessage{UID: uid, UIDValidity: status.UidValidity, Size: uint32(len(body)), Date: date, Flags: flags}, nil
+}
+
+// Move implements MailStore. The message is appended to the destination
+// before it is removed from the source, and removed from the destination
+// again when the source cannot let go of it.
+func (s folderStore) Move(mailbox, from, to string, uid, uidValidity uint32) (StoredMessage, error) {
+	src, err := s.folder(mailbox, from, false)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	if err = checkUIDValidity(src, from, uidValidity); err != nil {
+		return StoredMessage{}, err
+	}
+	section := &imap.BodySectionName{Peek: true}
+	msg, err := findMessage(src, uid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem())
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	// Stores key the body by the section as requested or as responded
+	var literal imap.Literal
+	for _, l := range msg.Body {
+		literal = l
+	}
+	if literal == nil {
+		return StoredMessage{}, errors.Errorf("no body for message %d in %s", uid, from)
+	}
+	body, err := io.ReadAll(literal)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	var flags []string
+	for _, flag := range msg.Flags {
+		if flag != imap.RecentFlag {
+			flags = append(flags, flag)
+		}
+	}
+	moved, err := s.Append(mailbox, to, flags, msg.InternalDate, body)
+	if err != nil {
+		return StoredMessage{}, err
+	}
+	if err = src.deleteMessage(uid); err != nil {
+		dst, errUndo := s.folder(mailbox, to, false)
+		if errUndo == nil {
+			errUndo = dst.deleteMessage(moved.UID)
+		}
+		if errUndo != nil {
+			s.logger.Error("Failed to undo move, the message is in both folders", zap.String("mailbox", mailbox), zap.String("from", from), zap.String("to", to), zap.Error(errUndo))
+		}
+		return StoredMessage{}, err
+	}
+	return moved, nil
+}
+
+// SetFlags implements MailStore
+func (s folderStore) SetFlags(mailbox, folder string, uid uint32, flags []string) error {
+	mb, err := s.folder(mailbox, folder, false)
+	if err != nil {
+		return err
+	}
+	if _, err = findMessage(mb, uid, imap.FetchUid); err != nil {
+		return err
+	}
+	return mb.UpdateMessagesFlags(true, uidSet(uid), imap.SetFlags, flags)
+}
+
+// List implements MailStore
+func (s folderStore) List(mailbox, folder string) (list []StoredMessage, err error) {
+	mb, err := s.folder(mailbox, folder, false)
+	if err != nil {
+		return nil, err
+	}
+	all := new(imap.SeqSet)
+	all.AddRange(1, 0)
+	messages, err := listMessages(mb, all, imap.FetchUid, imap.FetchRFC822Size, imap.FetchInternalDate, imap.FetchFlags)
+	for _, msg := range messages {
+		list = append(list, StoredMessage{UID: msg.Uid, Size: msg.Size, Date: msg.InternalDate, Flags: msg.Flags})
+	}
+	return list, err
+}
+
+// Delete implements MailStore
+func (s folderStore) Delete(mailbox, folder string, uid, uidValidity uint32) error {
+	mb, err := s.folder(mailbox, folder, false)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return errors.Wrapf(errMailNotFound, "no message 0 in %s", folder)
+	}
+	if err = checkUIDValidity(mb, folder, uidValidity); err != nil {
+		return err
+	}
+	return mb.deleteMessage(uid)
+}
+
+// checkUIDValidity tells the uids of a message are no longer those of the
+// folder, unless uidValidity is 0
+func checkUIDValidity(mb backend.Mailbox, folder string, uidValidity uint32) error {
+	if uidValidity == 0 {
+		return nil
+	}
+	status, err := mb.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return err
+	}
+	if status.UidValidity != uidValidity {
+		return errors.Wrapf(errMailNotFound, "%s was renumbered", folder)
+	}
+	return nil
+}
+
+// ensureMailbox opens a folder, creating it when missing
+func ensureMailbox(u backend.User, box string, logger *zap.Logger) (mb backend.Mailbox, err error) {
+	err = u.CreateMailbox(box)
+	if err != nil && err.Error() == errMailboxExists.Error() {
+		err = nil
+	}
+	if err == nil {
+		mb, err = u.GetMailbox(box)
+	}
+	if err != nil {
+		logger.Warn("Failed to create mailbox", zap.String("source", u.Username()), zap.Error(err), zap.String("mailbox", box))
+	}
+	return
+}
+
+func uidSet(uid uint32) *imap.SeqSet {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	return seqset
+}
+
+// listMessages fetches the items of the messages with the uids
+func listMessages(mb backend.Mailbox, uids *imap.SeqSet, items ...imap.FetchItem) (messages []*imap.Message, err error) {
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mb.ListMessages(true, uids, append(items, imap.FetchUid), ch)
+	}()
+	for msg := range ch {
+		messages = append(messages, msg)
+	}
+	return messages, <-done
+}
+
+// findMessage fetches the items of a single message
+func findMessage(mb backend.Mailbox, uid uint32, items ...imap.FetchItem) (*imap.Message, error) {
+	if uid == 0 {
+		// A zero in a sequence set is the last message
+		return nil, errors.Wrapf(errMailNotFound, "no message 0 in %s", mb.Name())
+	}
+	messages, err := listMessages(mb, uidSet(uid), items...)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.Wrapf(errMailNotFound, "no message %d in %s", uid, mb.Name())
+	}
+	return messages[0], nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func testMailStores(t *testing.T, test func(t *testing.T, mails MailStore)) {
+	t.Run("disk", func(t *testing.T) {
+		test(t, newDiskStore(filepath.Join(t.TempDir(), "mails"), zap.NewNop()))
+	})
+	t.Run("maildir", func(t *testing.T) {
+		test(t, newMaildirStore(t.TempDir(), zap.NewNop()))
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore(zap.NewNop()))
+	})
+}
+
+func TestMailStoreAppend(t *testing.T) {
+	testMailStores(t, func(t *testing.T, mails MailStore) {
+		date := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+		first, err := mails.Append("herman@ptsm.q42.com", "UNPAID", nil, date, []byte(body))
+		assert.NoError(t, err)
+		assert.NotZero(t, first.UIDValidity)
+		assert.Equal(t, StoredMessage{UID: 1, UIDValidity: first.UIDValidity, Size: uint32(len(body)), Date: date}, first)
+		second, err := mails.Append("herman@ptsm.q42.com", "UNPAID", []string{imap.FlaggedFlag}, date, []byte(body))
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(2), second.UID)
+
+		list, err := mails.List("herman@ptsm.q42.com", "UNPAID")
+		assert.NoError(t, err)
+		if assert.Len(t, list, 2) {
+			assert.Equal(t, uint32(len(body)), list[0].Size)
+			assert.Equal(t, uint32(2), list[1].UID)
+		}
+
+		_, err = mails.List("herman@ptsm.q42.com", "Nope")
+		assert.ErrorIs(t, err, errMailNotFound)
+		_, err = mails.List("athena@ptsm.q42.com", "UNPAID")
+		assert.ErrorIs(t, err, errMailNotFound, "mailboxes are separate")
+
+		// The folders show up in IMAP
+		u, err := mails.User("herman@ptsm.q42.com")
+		assert.NoError(t, err)
+		mb, err := u.GetMailbox("UNPAID")
+		assert.NoError(t, err)
+		status, err := mb.Status([]imap.StatusItem{imap.StatusMessages})
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(2), status.Messages)
+	})
+}
+
+func TestMailStoreMove(t *testing.T) {
+	testMailStores(t, func(t *testing.T, mails MailStore) {
+		_, err := mails.Append("herman@ptsm.q42.com", "UNPAID", []string{imap.FlaggedFlag}, time.Now(), []byte(body))
+		assert.NoError(t, err)
+		created, err := mails.Append("herman@ptsm.q42.com", "UNPAID", nil, time.Now(), []byte(body))
+		assert.NoError(t, err)
+
+		_, err = mails.Move("herman@ptsm.q42.com", "UNPAID", "INBOX", 42, 0)
+		assert.ErrorIs(t, err, errMailNotFound)
+		_, err = mails.Move("herman@ptsm.q42.com", "UNPAID", "INBOX", 0, 0)
+		assert.ErrorIs(t, err, errMailNotFound, "0 is not the last message")
+		_, err = mails.Move("herman@ptsm.q42.com", "Nope", "INBOX", created.UID, 0)
+		assert.ErrorIs(t, err, errMailNotFound)
+		_, err = mails.Move("herman@ptsm.q42.com", "UNPAID", "INBOX", created.UID, created.UIDValidity+1)
+		assert.ErrorIs(t, err, errMailNotFound, "the folder was renumbered")
+
+		moved, err := mails.Move("herman@ptsm.q42.com", "UNPAID", "INBOX", 1, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1), moved.UID)
+		inbox, err := mails.List("herman@ptsm.q42.com", "INBOX")
+		assert.NoError(t, err)
+		if assert.Len(t, inbox, 1) {
+			assert.Equal(t, uint32(len(body)), inbox[0].Size)
+		}
+		unpaid, err := mails.List("herman@ptsm.q42.com", "UNPAID")
+		assert.NoError(t, err)
+		assert.Len(t, unpaid, 1)
+	})
+}
+
+// stuckMailbox is a folder whose messages cannot be deleted
+type stuckMailbox struct {
+	appender
+}
+
+func (mb stuckMailbox) deleteMessage(uid uint32) error {
+	return errors.New("stuck")
+}
+
+type stuckUser struct {
+	backend.User
+	stuck string
+}
+
+func (u stuckUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mb, err := u.User.GetMailbox(name)
+	if err == nil && name == u.stuck {
+		mb = stuckMailbox{mb.(appender)}
+	}
+	return mb, err
+}
+
+func TestMailStoreMoveUndo(t *testing.T) {
+	memory := newMemoryStore(zap.NewNop()).(folderStore)
+	mails := folderStore{logger: zap.NewNop(), open: func(mailbox string) (backend.User, error) {
+		u, err := memory.open(mailbox)
+		return stuckUser{u, "UNPAID"}, err
+	}}
+	created, err := mails.Append("herman@ptsm.q42.com", "UNPAID", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+
+	// The message stays in the source only
+	_, err = mails.Move("herman@ptsm.q42.com", "UNPAID", "INBOX", created.UID, 0)
+	assert.EqualError(t, err, "stuck")
+	inbox, err := mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	assert.Empty(t, inbox)
+	unpaid, err := mails.List("herman@ptsm.q42.com", "UNPAID")
+	assert.NoError(t, err)
+	assert.Len(t, unpaid, 1)
+}
+
+func TestMailStoreDeleteAlone(t *testing.T) {
+	testMailStores(t, func(t *testing.T, mails MailStore) {
+		for i := 0; i < 3; i++ {
+			_, err := mails.Append("herman@ptsm.q42.com", "INBOX", nil, time.Now(), []byte(body))
+			assert.NoError(t, err)
+		}
+		u, err := mails.User("herman@ptsm.q42.com")
+		assert.NoError(t, err)
+		mb, err := u.GetMailbox("INBOX")
+		assert.NoError(t, err)
+
+		// A message the user marked \Deleted is not expunged along
+		assert.NoError(t, mb.UpdateMessagesFlags(true, uidSet(1), imap.AddFlags, []string{imap.DeletedFlag}))
+		assert.NoError(t, mb.(appender).deleteMessage(2))
+		assert.ErrorIs(t, mb.(appender).deleteMessage(2), errMailNotFound)
+		all := new(imap.SeqSet)
+		all.AddRange(1, 0)
+		messages, err := listMessages(mb, all, imap.FetchFlags)
+		assert.NoError(t, err)
+		if assert.Len(t, messages, 2) {
+			assert.Equal(t, uint32(1), messages[0].Uid)
+			assert.Equal(t, []string{imap.DeletedFlag}, messages[0].Flags)
+			assert.Equal(t, uint32(3), messages[1].Uid)
+		}
+	})
+}
+
+func TestMailStoreFlags(t *testing.T) {
+	// Flags on disk last only as long as the opened user
+	mails := newMemoryStore(zap.NewNop())
+	_, err := mails.Append("herman@ptsm.q42.com", "UNPAID", []string{imap.FlaggedFlag}, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	moved, err := mails.Move("herman@ptsm.q42.com", "UNPAID", "INBOX", 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{imap.FlaggedFlag}, moved.Flags)
+
+	created, err := mails.Append("herman@ptsm.q42.com", "INBOX", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), created.UID)
+
+	assert.NoError(t, mails.SetFlags("herman@ptsm.q42.com", "INBOX", created.UID, []string{imap.SeenFlag}))
+	assert.ErrorIs(t, mails.SetFlags("herman@ptsm.q42.com", "INBOX", 42, nil), errMailNotFound)
+	list, err := mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, []string{imap.FlaggedFlag}, list[0].Flags)
+		assert.Equal(t, []string{imap.SeenFlag}, list[1].Flags)
+	}
+
+	assert.ErrorIs(t, mails.Delete("herman@ptsm.q42.com", "INBOX", 42, 0), errMailNotFound)
+	assert.ErrorIs(t, mails.Delete("herman@ptsm.q42.com", "INBOX", created.UID, created.UIDValidity+1), errMailNotFound, "the folder was renumbered")
+	assert.NoError(t, mails.Delete("herman@ptsm.q42.com", "INBOX", created.UID, created.UIDValidity))
+	list, err = mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+}
+
+func TestDiskStoreUIDs(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, mailboxKey("herman@ptsm.q42.com"))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "INBOX"), 0700))
+	// Files of before the UIDs were stable can share a UID or have none
+	for _, name := range []string{"1_a", "1_b", "notes"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "INBOX", name), []byte(body), 0600))
+	}
+	mails := newDiskStore(root, zap.NewNop())
+	list, err := mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	var uids []uint32
+	for _, msg := range list {
+		uids = append(uids, msg.UID)
+	}
+	assert.Equal(t, []uint32{1, 2, 3}, uids)
+	names, err := filepath.Glob(filepath.Join(dir, "INBOX", "*"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1_a", "2_1_b", "3_notes"}, []string{filepath.Base(names[0]), filepath.Base(names[1]), filepath.Base(names[2])})
+
+	// Copies over IMAP take the next UID of the folder too
+	assert.NoError(t, mails.Delete("herman@ptsm.q42.com", "INBOX", 3, 0))
+	user, err := mails.User("herman@ptsm.q42.com")
+	assert.NoError(t, err)
+	assert.NoError(t, user.CreateMailbox("Archive"))
+	mb, err := user.GetMailbox("INBOX")
+	assert.NoError(t, err)
+	assert.NoError(t, mb.CopyMessages(true, uidSet(2), "INBOX"))
+	assert.NoError(t, mb.CopyMessages(true, uidSet(1), "Archive"))
+	status, err := mb.Status([]imap.StatusItem{imap.StatusUidNext, imap.StatusUidValidity})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(5), status.UidNext)
+	assert.Equal(t, uint32(diskUIDValidity), status.UidValidity)
+
+	list, err = mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	uids = nil
+	for _, msg := range list {
+		uids = append(uids, msg.UID)
+	}
+	assert.Equal(t, []uint32{1, 2, 4}, uids)
+	archive, err := mails.List("herman@ptsm.q42.com", "Archive")
+	assert.NoError(t, err)
+	if assert.Len(t, archive, 1) {
+		assert.Equal(t, uint32(1), archive[0].UID)
+	}
+}
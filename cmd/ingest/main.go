@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/emersion/go-msgauth/dkim"
@@ -14,7 +17,13 @@ import (
 )
 
 func main() {
-	logger, err := zap.NewDevelopment(zap.IncreaseLevel(zap.DebugLevel))
+	if err := loadConfig(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatal(err)
+	}
+	logger, err := newLogger()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -26,22 +35,92 @@ func main() {
 		handleSignals(logger)
 		cancel()
 	}()
+	drain, cancelDrain := graceContext(ctx, *shutdownGrace)
+	defer cancelDrain()
+	servers := newShutdownGroup(cancel)
 
-	flagset.Parse(os.Args[1:])
-	tlsConfig, err := startHttpServer(ctx, logger.Named("http"))
+	lns, err := openListeners(listenAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// One Firestore client checks all SMTP and IMAP logins
+	be, err := FirestoreBackend(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth := newAuthService(logger.Named("auth"), be)
+	// Delivery, IMAP and the API share the mail store
+	mails, err := newMailStore(be, logger.Named("store"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, err := startHttpServer(ctx, drain, logger.Named("http"), lns, servers, auth, mails)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	var transport transportFunc
+	if len(remotes) > 0 {
+		logger.Info("Relaying outbound mail", zap.Stringers("remotes", remotes))
+		transport = newRelay(logger.Named("relay"), remotes).Deliver
+	} else {
+		delivery, err := newDeliverer(logger.Named("delivery"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport = delivery.Deliver
+	}
+	queue, err := newOutboundQueue(*spoolDir, logger.Named("queue"), transport, mails)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// The queue stops after the servers, which may still queue mail while they drain
+	queueCtx, stopQueue := context.WithCancel(context.Background())
+	queueDone := make(chan struct{})
+	go func() {
+		defer close(queueDone)
+		queue.run(queueCtx, drain)
+	}()
+
+	signOptions := func() (*dkim.SignOptions, error) { return dkimOpts(tlsConfig, *domain, logger) }
+	servers.Go("smtp", func() error {
+		return startSmtpServers(ctx, drain, logger.Named("smtp"), tlsConfig, dkimSigner(tlsConfig, logger), signOptions, queue, lns, auth, mails)
+	})
+	servers.Go("imap", func() error {
+		return startImapServers(ctx, drain, logger.Named("imap"), tlsConfig, lns, auth, mails)
+	})
+	servers.Go("janitor", func() error {
+		return startJanitor(ctx, logger.Named("janitor"), dkimSigner(tlsConfig, logger), queue, mails)
+	})
 
-	go startSmtpServers(ctx, logger.Named("smtp"), tlsConfig, dkimSigner(tlsConfig, logger))
-	go startImapServers(ctx, logger.Named("imap"), tlsConfig)
 	<-ctx.Done()
+	logger.Info("Shutting down", zap.Duration("grace", *shutdownGrace))
+	err = servers.Wait()
+	stopQueue()
+	<-queueDone
+	if err != nil {
+		logger.Error("Shutdown failed", zap.Error(err))
+		logger.Sync()
+		os.Exit(1)
+	}
+	logger.Info("Shut down")
+	logger.Sync()
 }
 
-func dkimOpts(c *tls.Config, logger *zap.Logger) (*dkim.SignOptions, error) {
+// dkimOpts signs for a served domain with its key of dkim_keys or else the
+// key of the TLS certificate, other domains are signed for the primary domain
+func dkimOpts(c *tls.Config, signDomain string, logger *zap.Logger) (*dkim.SignOptions, error) {
+	signDomain = strings.ToLower(signDomain)
+	if key, ok := dkimKeys[signDomain]; ok {
+		return &dkim.SignOptions{
+			Signer:   key.signer,
+			Domain:   signDomain,
+			Selector: key.selector,
+		}, nil
+	}
+	if !isServedDomain(signDomain) {
+		signDomain = *domain
+	}
 	cert, err := c.GetCertificate(&tls.ClientHelloInfo{ServerName: *hostName})
 	if err != nil {
 		return nil, err
@@ -53,15 +132,15 @@ func dkimOpts(c *tls.Config, logger *zap.Logger) (*dkim.SignOptions, error) {
 	}
 	return &dkim.SignOptions{
 		Signer:   asSigner(cert.PrivateKey),
-		Domain:   *domain,
+		Domain:   signDomain,
 		Selector: *dkimSelector,
 	}, nil
 }
 
-func dkimSigner(c *tls.Config, logger *zap.Logger) func() (*dkim.Signer, error) {
-	return func() (s *dkim.Signer, err error) {
+func dkimSigner(c *tls.Config, logger *zap.Logger) func(signDomain string) (*dkim.Signer, error) {
+	return func(signDomain string) (s *dkim.Signer, err error) {
 		var opts *dkim.SignOptions
-		if opts, err = dkimOpts(c, logger); err != nil {
+		if opts, err = dkimOpts(c, signDomain, logger); err != nil {
 			return nil, err
 		}
 		return dkim.NewSigner(opts)
@@ -69,11 +148,24 @@ func dkimSigner(c *tls.Config, logger *zap.Logger) func() (*dkim.Signer, error)
 }
 
 func handleSignals(log *zap.Logger) {
-	// Wait for SIGINT, SIGQUIT, or SIGTERM
+	// Wait for SIGINT, SIGQUIT, or SIGTERM, reload the configuration on SIGHUP
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
-	sig := <-sigs
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			if err := reloadConfig(log); err != nil {
+				log.Error("Failed to reload configuration, keeping the current settings", zap.Error(err))
+			} else {
+				log.Info("Reloaded configuration")
+			}
+			continue
+		}
 
-	log.With(zap.Stringer("signal", sig)).
-		Info("shutting down in response to received signal")
+		// A second signal kills the process instead of waiting for the
+		// shutdown grace period
+		signal.Reset(syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+		log.With(zap.Stringer("signal", sig)).
+			Info("shutting down in response to received signal")
+		return
+	}
 }
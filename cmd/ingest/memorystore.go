@@ -0,0 +1,347 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// The memory store keeps mailboxes for as long as the process runs, for
+// tests and for trying out the server without disk or Firestore. One mutex
+// guards all of its mailboxes.
+
+type memoryStore struct {
+	mu    sync.Mutex
+	users map[string]*memoryUser
+}
+
+type memoryUser struct {
+	store   *memoryStore
+	email   string
+	folders map[string]*memoryMailbox
+}
+
+type memoryMailbox struct {
+	user        *memoryUser
+	name        string
+	subscribed  bool
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*memory.Message
+}
+
+var _ backend.User = &memoryUser{}
+var _ appender = &memoryMailbox{}
+
+// newMemoryStore keeps mailboxes in memory
+func newMemoryStore(logger *zap.Logger) MailStore {
+	s := &memoryStore{users: map[string]*memoryUser{}}
+	return folderStore{logger: logger, open: func(mailbox string) (backend.User, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		u, ok := s.users[mailboxKey(mailbox)]
+		if !ok {
+			u = &memoryUser{s, mailbox, map[string]*memoryMailbox{}}
+			s.users[mailboxKey(mailbox)] = u
+		}
+		return u, nil
+	}}
+}
+
+// Username implements backend.User
+func (u *memoryUser) Username() string {
+	return u.email
+}
+
+// ListMailboxes implements backend.User
+func (u *memoryUser) ListMailboxes(subscribed bool) (out []backend.Mailbox, err error) {
+	u.store.mu.Lock()
+	defer u.store.mu.Unlock()
+	for _, mb := range u.folders {
+		if subscribed && !mb.subscribed {
+			continue
+		}
+		out = append(out, mb)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+// GetMailbox implements backend.User
+func (u *memoryUser) GetMailbox(name string) (backend.Mailbox, error) {
+	u.store.mu.Lock()
+	defer u.store.mu.Unlock()
+	mb, ok := u.folders[folderName(name)]
+	if !ok {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return mb, nil
+}
+
+// CreateMailbox implements backend.User
+func (u *memoryUser) CreateMailbox(name string) error {
+	u.store.mu.Lock()
+	defer u.store.mu.Unlock()
+	name = folderName(name)
+	if _, ok := u.folders[name]; ok {
+		return errMailboxExists
+	}
+	u.folders[name] = &memoryMailbox{user: u, name: name, uidValidity: uint32(time.Now().Unix()), uidNext: 1}
+	return nil
+}
+
+// DeleteMailbox implements backend.User
+func (u *memoryUser) DeleteMailbox(name string) error {
+	u.store.mu.Lock()
+	defer u.store.mu.Unlock()
+	name = folderName(name)
+	if name == "INBOX" {
+		return errors.New("cannot delete INBOX")
+	}
+	if _, ok := u.folders[name]; !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	delete(u.folders, name)
+	return nil
+}
+
+// RenameMailbox implements backend.User. Renaming INBOX moves its messages
+// to a new mailbox, children move along with other mailboxes.
+func (u *memoryUser) RenameMailbox(existingName, newName string) error {
+	u.store.mu.Lock()
+	defer u.store.mu.Unlock()
+	existingName, newName = folderName(existingName), folderName(newName)
+	mb, ok := u.folders[existingName]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	if _, ok := u.folders[newName]; ok {
+		return errMailboxExists
+	}
+	if existingName == "INBOX" {
+		u.folders[newName] = &memoryMailbox{user: u, name: newName, uidValidity: uint32(time.Now().Unix()), uidNext: mb.uidNext, messages: mb.messages}
+		mb.messages = nil
+		return nil
+	}
+	for name, child := range u.folders {
+		if name == existingName || strings.HasPrefix(name, existingName+"/") {
+			delete(u.folders, name)
+			child.name = newName + strings.TrimPrefix(name, existingName)
+			u.folders[child.name] = child
+		}
+	}
+	return nil
+}
+
+// Logout implements backend.User
+func (u *memoryUser) Logout() error {
+	return nil
+}
+
+// Name implements backend.Mailbox
+func (mb *memoryMailbox) Name() string {
+	return mb.name
+}
+
+// Info implements backend.Mailbox
+func (mb *memoryMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: mb.Name()}, nil
+}
+
+// Status implements backend.Mailbox
+func (mb *memoryMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mb.user.store.mu.Lock()
+	defer mb.user.store.mu.Unlock()
+	status := imap.NewMailboxStatus(mb.name, items)
+	status.PermanentFlags = []string{"\\*"}
+	flags := map[string]bool{}
+	var unseen uint32
+	for i, msg := range mb.messages {
+		for _, flag := range msg.Flags {
+			flags[flag] = true
+		}
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			if unseen == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+	for flag := range flags {
+		status.Flags = append(status.Flags, flag)
+	}
+	sort.Strings(status.Flags)
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(mb.messages))
+		case imap.StatusUidNext:
+			status.UidNext = mb.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = mb.uidValidity
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+// SetSubscribed implements backend.Mailbox
+func (mb *memoryMailbox) SetSubscribed(subscribed bool) error {
+	mb.user.store.mu.Lock()
+	defer mb.user.store.mu.Unlock()
+	mb.subscribed = subscribed
+	return nil
+}
+
+// Check implements backend.Mailbox
+func (mb *memoryMailbox) Check() error {
+	return nil
+}
+
+// selected returns the messages in the set with their sequence numbers
+func (mb *memoryMailbox) selected(uid bool, seqset *imap.SeqSet) (messages []*memory.Message, seqNums []uint32) {
+	for i, msg := range mb.messages {
+		id := uint32(i + 1)
+		if uid {
+			id = msg.Uid
+		}
+		if seqset.Contains(id) {
+			messages = append(messages, msg)
+			seqNums = append(seqNums, uint32(i+1))
+		}
+	}
+	return messages, seqNums
+}
+
+// ListMessages implements backend.Mailbox. The messages are fetched under
+// the lock and sent after, as the receiver may call into the store.
+func (mb *memoryMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	mb.user.store.mu.Lock()
+	messages, seqNums := mb.selected(uid, seqset)
+	var fetched []*imap.Message
+	for i, msg := range messages {
+		if m, err := msg.Fetch(seqNums[i], items); err == nil {
+			fetched = append(fetched, m)
+		}
+	}
+	mb.user.store.mu.Unlock()
+	for _, m := range fetched {
+		ch <- m
+	}
+	return nil
+}
+
+// SearchMessages implements backend.Mailbox
+func (mb *memoryMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) (ids []uint32, err error) {
+	mb.user.store.mu.Lock()
+	defer mb.user.store.mu.Unlock()
+	for i, msg := range mb.messages {
+		seqNum := uint32(i + 1)
+		if ok, err := msg.Match(seqNum, criteria); err != nil || !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.Uid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids, nil
+}
+
+// CreateMessage implements backend.Mailbox
+func (mb *memoryMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	_, err = mb.appendMessage(flags, date, data)
+	return err
+}
+
+// appendMessage implements appender
+func (mb *memoryMailbox) appendMessage(flags []string, date time.Time, body []byte) (uint32, error) {
+	mb.user.store.mu.Lock()
+	defer mb.user.store.mu.Unlock()
+	uid := mb.uidNext
+	mb.uidNext++
+	mb.messages = append(mb.messages, &memory.Message{
+		Uid:   uid,
+		Date:  date,
+		Size:  uint32(len(body)),
+		Flags: append([]string(nil), flags...),
+		Body:  append([]byte(nil), body...),
+	})
+	return uid, nil
+}
+
+// deleteMessage implements appender
+func (mb *memoryMailbox) deleteMessage(uid uint32) error {
+	mb.user.store.mu.Lock()
+	defer mb.user.store.mu.Unlock()
+	for i, msg := range mb.messages {
+		if msg.Uid == uid {
+			mb.messages = append(mb.messages[:i:i], mb.messages[i+1:]...)
+			return nil
+		}
+	}
+	return errors.Wrapf(errMailNotFound, "no message %d in %s", uid, mb.name)
+}
+
+// UpdateMessagesFlags implements backend.Mailbox
+func (mb *memoryMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	mb.user.store.mu.Lock()
+	defer mb.user.store.mu.Unlock()
+	messages, _ := mb.selected(uid, seqset)
+	for _, msg := range messages {
+		msg.Flags = backendutil.UpdateFlags(msg.Flags, operation, flags)
+	}
+	return nil
+}
+
+// CopyMessages implements backend.Mailbox
+func (mb *memoryMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	mb.user.store.mu.Lock()
+	defer mb.user.store.mu.Unlock()
+	dest, ok := mb.user.folders[folderName(destName)]
+	if !ok {
+		return backend.ErrNoSuchMailbox
+	}
+	messages, _ := mb.selected(uid, seqset)
+	for _, msg := range messages {
+		copied := *msg
+		copied.Uid = dest.uidNext
+		copied.Flags = append([]string(nil), msg.Flags...)
+		dest.uidNext++
+		dest.messages = append(dest.messages, &copied)
+	}
+	return nil
+}
+
+// Expunge implements backend.Mailbox
+func (mb *memoryMailbox) Expunge() error {
+	mb.user.store.mu.Lock()
+	defer mb.user.store.mu.Unlock()
+	kept := mb.messages[:0]
+	for _, msg := range mb.messages {
+		if !hasFlag(msg.Flags, imap.DeletedFlag) {
+			kept = append(kept, msg)
+		}
+	}
+	mb.messages = kept
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// OAuth logins (OAUTHBEARER, RFC 7628, and Google's XOAUTH2) carry an OpenID
+// Connect ID token, such as a Firebase ID token, instead of an app key. The
+// token must be signed by a key of the JSON Web Key Set of the issuer, and
+// its email claim is mapped to a mailbox like the web app does.
+
+const (
+	firebaseJWKS   = "https://www.googleapis.com/service_accounts/v1/jwk/securetoken@system.gserviceaccount.com"
+	firebaseIssuer = "https://securetoken.google.com/"
+	xoauth2        = "XOAUTH2"
+
+	// jwksMaxAge is how long keys are cached when the response has no max-age
+	jwksMaxAge = time.Hour
+	// jwksMinRefresh limits refetching the keys when a token has an unknown key id
+	jwksMinRefresh = time.Minute
+	// jwksMaxSize is the largest key set we read
+	jwksMaxSize = 1024 * 1024
+	// tokenLeeway allows for clock skew in the exp, iat and nbf claims
+	tokenLeeway = time.Minute
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// idToken holds the claims of an ID token that we check
+type idToken struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      audience        `json:"aud"`
+	Expires       float64         `json:"exp"`
+	IssuedAt      float64         `json:"iat"`
+	NotBefore     float64         `json:"nbf"`
+	Email         string          `json:"email"`
+	EmailVerified json.RawMessage `json:"email_verified"`
+}
+
+// audience is the aud claim, a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a audience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// tokenVerifier verifies ID tokens against the keys of the issuer
+type tokenVerifier struct {
+	logger   *zap.Logger
+	http     *http.Client
+	jwksURL  string
+	issuer   string
+	audience string
+	now      func() time.Time
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	expires  time.Time
+}
+
+// newTokenVerifier returns nil when OAuth logins are not configured
+func newTokenVerifier(logger *zap.Logger) *tokenVerifier {
+	if *oauthAudience == "" {
+		return nil
+	}
+	issuer := *oauthIssuer
+	if issuer == "" {
+		issuer = firebaseIssuer + *oauthAudience
+	}
+	return &tokenVerifier{
+		logger:   logger,
+		http:     &http.Client{Timeout: 10 * time.Second},
+		jwksURL:  *oauthJWKS,
+		issuer:   issuer,
+		audience: *oauthAudience,
+		now:      time.Now,
+	}
+}
+
+func checkJWKSURL(str string) error {
+	u, err := url.Parse(str)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return errors.New("must be an https URL")
+	}
+	return nil
+}
+
+// Verify checks the signature and claims of an ID token. Tokens that are not
+// valid give an error wrapping errInvalidToken.
+func (v *tokenVerifier) Verify(ctx context.Context, token string) (*idToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.Wrap(errInvalidToken, "malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(errInvalidToken, "malformed header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(errInvalidToken, "malformed signature")
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.Wrapf(errInvalidToken, "unknown key id %q", header.Kid)
+	}
+	if err = verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := &idToken{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, errors.Wrap(errInvalidToken, "malformed claims")
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *tokenVerifier) checkClaims(claims *idToken) error {
+	now := v.now()
+	switch {
+	case claims.Issuer != v.issuer:
+		return errors.Wrapf(errInvalidToken, "issuer %q", claims.Issuer)
+	case !claims.Audience.contains(v.audience):
+		return errors.Wrapf(errInvalidToken, "audience %q", []string(claims.Audience))
+	case claims.Subject == "":
+		return errors.Wrap(errInvalidToken, "missing subject")
+	case claims.Expires == 0 || !now.Before(unixTime(claims.Expires).Add(tokenLeeway)):
+		return errors.Wrap(errInvalidToken, "expired")
+	case unixTime(claims.IssuedAt).After(now.Add(tokenLeeway)), unixTime(claims.NotBefore).After(now.Add(tokenLeeway)):
+		return errors.Wrap(errInvalidToken, "not valid yet")
+	case claims.Email == "":
+		return errors.Wrap(errInvalidToken, "missing email claim")
+	case string(claims.EmailVerified) != "true" && string(claims.EmailVerified) != `"true"`:
+		// Issuers that leave the claim out do not vouch for the address
+		return errors.Wrapf(errInvalidToken, "email %s is not verified", claims.Email)
+	}
+	return nil
+}
+
+// key finds the public key by id, fetching the key set when it expired or
+// when the id is unknown, as issuers rotate their keys
+func (v *tokenVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := v.now()
+	key, ok := v.keys[kid]
+	if now.Before(v.expires) && (ok || now.Sub(v.fetched) < jwksMinRefresh) {
+		return key, nil
+	}
+
+	keys, maxAge, err := v.fetchKeys(ctx)
+	if err != nil {
+		if ok {
+			v.logger.Warn("Using expired keys, failed to fetch the key set", zap.String("url", v.jwksURL), zap.Error(err))
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys, v.fetched, v.expires = keys, now, now.Add(maxAge)
+	return v.keys[kid], nil
+}
+
+func (v *tokenVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := v.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("jwks: %s returned %s", v.jwksURL, res.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, jwksMaxSize)).Decode(&set); err != nil {
+		return nil, 0, errors.Wrap(err, "jwks")
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			v.logger.Warn("Skipping key", zap.String("kid", jwk.Kid), zap.Error(err))
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, cacheMaxAge(res.Header, jwksMaxAge), nil
+}
+
+// cacheMaxAge is the max-age of the Cache-Control header, or def
+func cacheMaxAge(header http.Header, def time.Duration) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return def
+}
+
+func parseJWK(jwk jsonWebKey) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "modulus")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			return nil, errors.New("invalid point")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// verifySignature checks the RS256 or ES256 signature, the algorithms issuers
+// of ID tokens use
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && len(signature) == 64 {
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+		}
+	}
+	return errors.Wrapf(errInvalidToken, "bad %s signature", alg)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+// looksLikeIDToken tells if an SMTP password is an ID token rather than an
+// app key, which is hex
+func looksLikeIDToken(password string) bool {
+	return strings.HasPrefix(password, "eyJ") && strings.Count(password, ".") == 2
+}
+
+// oauthServer is the server side of OAUTHBEARER and XOAUTH2
+type oauthServer struct {
+	mechanism string
+	login     func(username, token string) error
+	done      bool
+	failed    error
+}
+
+func newOAuthServer(mechanism string, login func(username, token string) error) sasl.Server {
+	return &oauthServer{mechanism: mechanism, login: login}
+}
+
+func (a *oauthServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.failed != nil {
+		// The client answered the error challenge, which ends the exchange
+		return nil, true, a.failed
+	}
+	if a.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	a.done = true
+
+	username, token, err := parseOAuthResponse(a.mechanism, response)
+	if err != nil {
+		return nil, true, err
+	}
+	if err = a.login(username, token); err != nil {
+		// Failures are sent as a challenge first (RFC 7628 §3.2.2)
+		a.failed = err
+		status := "invalid_token"
+		if a.mechanism == xoauth2 {
+			status = "401"
+		}
+		challenge, _ = json.Marshal(map[string]string{"status": status, "schemes": "bearer"})
+		return challenge, false, nil
+	}
+	return nil, true, nil
+}
+
+// parseOAuthResponse reads the username and bearer token from the client
+// response, "n,a=user,\x01auth=Bearer token\x01\x01" for OAUTHBEARER and
+// "user=user\x01auth=Bearer token\x01\x01" for XOAUTH2
+func parseOAuthResponse(mechanism string, response []byte) (username, token string, err error) {
+	fields := response
+	if mechanism == sasl.OAuthBearer {
+		parts := bytes.SplitN(response, []byte{','}, 3)
+		if len(parts) != 3 || string(parts[0]) != "n" {
+			return "", "", errors.New("invalid gs2 header")
+		}
+		if len(parts[1]) > 0 {
+			if !bytes.HasPrefix(parts[1], []byte("a=")) {
+				return "", "", errors.New("invalid gs2 header")
+			}
+			username = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(string(parts[1][2:]))
+		}
+		fields = parts[2]
+	}
+	for _, field := range strings.Split(string(fields), "\x01") {
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return "", "", fmt.Errorf("invalid field %q", field)
+		}
+		switch key {
+		case "user":
+			if mechanism == xoauth2 {
+				username = value
+			}
+		case "auth":
+			scheme, credentials, _ := strings.Cut(value, " ")
+			if !strings.EqualFold(scheme, "Bearer") {
+				return "", "", fmt.Errorf("unsupported token type %q", scheme)
+			}
+			token = credentials
+		}
+	}
+	if token == "" {
+		return "", "", errors.New("missing bearer token")
+	}
+	return username, token, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-sasl"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type testIssuer struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	fetches int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return &testIssuer{rsa: rsaKey, ec: ecKey}
+}
+
+func (i *testIssuer) verifier(now time.Time) *tokenVerifier {
+	b64 := base64.RawURLEncoding.EncodeToString
+	return &tokenVerifier{
+		logger: zap.NewNop(),
+		http: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			i.fetches++
+			keys, _ := json.Marshal(map[string]interface{}{"keys": []jsonWebKey{
+				{Kty: "RSA", Kid: "rsa1", Use: "sig", N: b64(i.rsa.N.Bytes()), E: b64(big.NewInt(int64(i.rsa.E)).Bytes())},
+				{Kty: "EC", Kid: "ec1", Crv: "P-256", X: b64(i.ec.X.Bytes()), Y: b64(i.ec.Y.Bytes())},
+				{Kty: "RSA", Kid: "enc1", Use: "enc", N: b64(i.rsa.N.Bytes()), E: "AQAB"},
+			}})
+			return &http.Response{StatusCode: 200, Header: http.Header{"Cache-Control": {"public, max-age=3600"}}, Body: io.NopCloser(strings.NewReader(string(keys)))}, nil
+		})},
+		jwksURL:  "https://example.com/jwks",
+		issuer:   firebaseIssuer + "ptsm-2022",
+		audience: "ptsm-2022",
+		now:      func() time.Time { return now },
+	}
+}
+
+func (i *testIssuer) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if kid == "ec1" {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	if alg == "ES256" {
+		r, s, err := ecdsa.Sign(rand.Reader, i.ec, digest[:])
+		assert.NoError(t, err)
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsa, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            firebaseIssuer + "ptsm-2022",
+		"aud":            "ptsm-2022",
+		"sub":            "uid1",
+		"iat":            now.Add(-time.Minute).Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"email":          "herman@q42.nl",
+		"email_verified": true,
+	}
+}
+
+func TestTokenVerifier(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	issuer := newTestIssuer(t)
+	v := issuer.verifier(now)
+	ctx := context.Background()
+
+	for _, kid := range []string{"rsa1", "ec1"} {
+		claims, err := v.Verify(ctx, issuer.sign(t, kid, testClaims(now)))
+		if assert.NoError(t, err, kid) {
+			assert.Equal(t, "herman@q42.nl", claims.Email)
+		}
+	}
+	assert.Equal(t, 1, issuer.fetches, "keys are cached")
+
+	claims := testClaims(now)
+	claims["aud"] = []string{"other", "ptsm-2022"}
+	_, err := v.Verify(ctx, issuer.sign(t, "rsa1", claims))
+	assert.NoError(t, err)
+
+	for name, change := range map[string]func(map[string]interface{}){
+		"issuer":     func(c map[string]interface{}) { c["iss"] = "https://securetoken.google.com/other" },
+		"audience":   func(c map[string]interface{}) { c["aud"] = "other" },
+		"expired":    func(c map[string]interface{}) { c["exp"] = now.Add(-2 * time.Minute).Unix() },
+		"no expiry":  func(c map[string]interface{}) { delete(c, "exp") },
+		"future":     func(c map[string]interface{}) { c["iat"] = now.Add(time.Hour).Unix() },
+		"no email":   func(c map[string]interface{}) { delete(c, "email") },
+		"unverified": func(c map[string]interface{}) { c["email_verified"] = false },
+		"unknown":    func(c map[string]interface{}) { delete(c, "email_verified") },
+		"no subject": func(c map[string]interface{}) { delete(c, "sub") },
+	} {
+		claims := testClaims(now)
+		change(claims)
+		_, err := v.Verify(ctx, issuer.sign(t, "rsa1", claims))
+		assert.ErrorIs(t, err, errInvalidToken, name)
+	}
+
+	token := issuer.sign(t, "rsa1", testClaims(now))
+	parts := strings.Split(token, ".")
+	for name, invalid := range map[string]string{
+		"malformed":     "not.a-token",
+		"tampered":      parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"x"}`)) + "." + parts[2],
+		"wrong alg":     base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"rsa1"}`)) + "." + parts[1] + "." + parts[2],
+		"unsigned":      base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa1"}`)) + "." + parts[1] + ".",
+		"encryption":    base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"enc1"}`)) + "." + parts[1] + "." + parts[2],
+		"unknown kid":   base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"rsa2"}`)) + "." + parts[1] + "." + parts[2],
+		"bad signature": parts[0] + "." + parts[1] + ".AAAA",
+	} {
+		_, err := v.Verify(ctx, invalid)
+		assert.ErrorIs(t, err, errInvalidToken, name)
+	}
+	assert.Equal(t, 1, issuer.fetches, "unknown key ids do not refetch within a minute")
+
+	// Rotated keys are fetched for unknown key ids
+	now = now.Add(2 * time.Minute)
+	v.now = func() time.Time { return now }
+	_, err = v.Verify(ctx, base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"rsa2"}`))+"."+parts[1]+"."+parts[2])
+	assert.ErrorIs(t, err, errInvalidToken)
+	assert.Equal(t, 2, issuer.fetches)
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	assert.Equal(t, 6*time.Hour, cacheMaxAge(http.Header{"Cache-Control": {"public, max-age=21600, must-revalidate"}}, time.Hour))
+	assert.Equal(t, time.Hour, cacheMaxAge(http.Header{"Cache-Control": {"no-transform"}}, time.Hour))
+	assert.Equal(t, time.Hour, cacheMaxAge(http.Header{}, time.Hour))
+}
+
+func TestParseOAuthResponse(t *testing.T) {
+	for _, tc := range []struct {
+		mechanism, response string
+		username, token     string
+	}{
+		{sasl.OAuthBearer, "n,a=herman@ptsm.q42.com,\x01host=imap.example.com\x01port=993\x01auth=Bearer eyJ.a.b\x01\x01", "herman@ptsm.q42.com", "eyJ.a.b"},
+		{sasl.OAuthBearer, "n,,\x01auth=bearer eyJ.a.b\x01\x01", "", "eyJ.a.b"},
+		{sasl.OAuthBearer, "n,a=a=2Cb=3D,\x01auth=Bearer t\x01\x01", "a,b=", "t"},
+		{xoauth2, "user=herman@ptsm.q42.com\x01auth=Bearer eyJ.a.b\x01\x01", "herman@ptsm.q42.com", "eyJ.a.b"},
+	} {
+		username, token, err := parseOAuthResponse(tc.mechanism, []byte(tc.response))
+		assert.NoError(t, err, tc.response)
+		assert.Equal(t, tc.username, username)
+		assert.Equal(t, tc.token, token)
+	}
+
+	for _, tc := range []struct{ mechanism, response string }{
+		{sasl.OAuthBearer, "user=herman\x01auth=Bearer t\x01\x01"},
+		{sasl.OAuthBearer, "y,a=herman,\x01auth=Bearer t\x01\x01"},
+		{sasl.OAuthBearer, "n,a=herman,\x01auth=Basic dDp0\x01\x01"},
+		{xoauth2, "user=herman\x01\x01"},
+		{xoauth2, "user=herman\x01auth\x01\x01"},
+	} {
+		_, _, err := parseOAuthResponse(tc.mechanism, []byte(tc.response))
+		assert.Error(t, err, tc.response)
+	}
+}
+
+func TestOAuthServer(t *testing.T) {
+	var got []string
+	server := newOAuthServer(xoauth2, func(username, token string) error {
+		got = append(got, username, token)
+		return nil
+	})
+	challenge, done, err := server.Next(nil)
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.Empty(t, challenge)
+	_, done, err = server.Next([]byte("user=herman\x01auth=Bearer t\x01\x01"))
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, []string{"herman", "t"}, got)
+
+	// Failures are sent as a challenge, the error follows the client's answer
+	server = newOAuthServer(sasl.OAuthBearer, func(username, token string) error { return backend.ErrInvalidCredentials })
+	challenge, done, err = server.Next([]byte("n,,\x01auth=Bearer t\x01\x01"))
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.JSONEq(t, `{"status":"invalid_token","schemes":"bearer"}`, string(challenge))
+	_, done, err = server.Next([]byte{1})
+	assert.True(t, done)
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	issuer := newTestIssuer(t)
+	keys := &fakeAppKeys{users: map[string]string{"herman@q42.nl": "herman@ptsm.q42.com"}}
+	a, _ := newTestAuthService(keys)
+	ip := net.ParseIP("192.0.2.1")
+
+	_, err := a.AuthenticateToken("", issuer.sign(t, "rsa1", testClaims(now)), ip)
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials, "disabled without a verifier")
+
+	a.tokens = issuer.verifier(now)
+	token := issuer.sign(t, "rsa1", testClaims(now))
+	for _, username := range []string{"", "herman@ptsm.q42.com", "Herman@ptsm.q42.com"} {
+		mailbox, err := a.AuthenticateToken(username, token, ip)
+		assert.NoError(t, err, username)
+		assert.Equal(t, "herman@ptsm.q42.com", mailbox)
+	}
+
+	// The token is only valid for its own mailbox
+	_, err = a.AuthenticateToken("athena@ptsm.q42.com", token, ip)
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+
+	// Users without a mailbox cannot log in
+	claims := testClaims(now)
+	claims["email"] = "athena@q42.nl"
+	_, err = a.AuthenticateToken("", issuer.sign(t, "rsa1", claims), ip)
+	assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+
+	// Failures count towards the lockout of the IP
+	for i := 0; i < 3; i++ {
+		_, err = a.AuthenticateToken("", "eyJ.invalid.token", ip)
+		assert.ErrorIs(t, err, backend.ErrInvalidCredentials)
+	}
+	_, err = a.AuthenticateToken("", token, ip)
+	assert.ErrorIs(t, err, errLockedOut)
+}
+
+func TestLooksLikeIDToken(t *testing.T) {
+	assert.True(t, looksLikeIDToken("eyJhbGciOiJSUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln"))
+	assert.False(t, looksLikeIDToken("0123456789abcdef0123456789abcdef"))
+	assert.False(t, looksLikeIDToken("eyJ-but-no-dots"))
+}
+
+func TestSMTPAuthMechanisms(t *testing.T) {
+	now := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	issuer := newTestIssuer(t)
+	keys := &fakeAppKeys{users: map[string]string{"herman@q42.nl": "herman@ptsm.q42.com"}}
+	a, _ := newTestAuthService(keys)
+	w := wrap{logger: zap.NewNop(), auth: a}
+	assert.Nil(t, w.authMechanisms(), "disabled without a verifier")
+
+	a.tokens = issuer.verifier(now)
+	mechanisms := w.authMechanisms()
+	assert.Len(t, mechanisms, 2)
+	peer := smtpd.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}}
+
+	server := mechanisms[xoauth2](peer)
+	_, done, err := server.Next([]byte("user=\x01auth=Bearer " + issuer.sign(t, "rsa1", testClaims(now)) + "\x01\x01"))
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "herman@ptsm.q42.com", server.Username())
+
+	// Failures are reported with the SMTP reply of the authenticator
+	server = mechanisms[sasl.OAuthBearer](peer)
+	challenge, done, err := server.Next([]byte("n,,\x01auth=Bearer eyJ.invalid.token\x01\x01"))
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.NotEmpty(t, challenge)
+	_, done, err = server.Next([]byte{1})
+	assert.True(t, done)
+	assert.Equal(t, smtpd.Error{Code: 535, Message: "5.7.8 Authentication credentials invalid"}, err)
+	assert.Empty(t, server.Username())
+
+	server = mechanisms[xoauth2](peer)
+	_, _, err = server.Next([]byte("user=herman\x01\x01"))
+	assert.Equal(t, 501, err.(smtpd.Error).Code)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/chrj/smtpd"
+	"github.com/pkg/errors"
+)
+
+// defaultPrice is what a sender pays for a single mail, in cents
+const defaultPrice = 5
+
+const (
+	PaidByBalance   = "balance"
+	PaidByAllowlist = "allowlist"
+	PaidByThread    = "thread"
+	PaidByFreeTier  = "free"
+	PaidByDiscount  = "discount"
+)
+
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// PaymentRequest is a single (sender, recipient) pair to decide payment for
+type PaymentRequest struct {
+	Sender    string
+	Recipient string
+	MessageID string
+	// BodyHash is the sha256 of the body. With the Message-ID it tells a
+	// resend of a mail, which is not charged again, from new mail under a
+	// paid Message-ID.
+	BodyHash string
+	// Message ids from In-Reply-To and References
+	Thread []string
+	// Size of the mail in bytes
+	Size int
+}
+
+type PaymentDecision struct {
+	Paid   bool
+	Reason string
+	// Price of the mail according to the pricing of the recipient in cents
+	Price int64
+	// Amount debited from the sender balance in cents
+	Amount int64
+}
+
+// PaymentPolicy decides whether mail may be delivered to the INBOX,
+// and debits the sender when it needs to pay for it.
+type PaymentPolicy interface {
+	Decide(req PaymentRequest) (PaymentDecision, error)
+}
+
+// paymentStore holds the state payment decisions are based on
+type paymentStore interface {
+	Allowlisted(recipient, sender string) (bool, error)
+	// ThreadPaid tells if one of the messages was sent by the recipient to the sender
+	ThreadPaid(recipient, sender string, messageIDs []string) (bool, error)
+	// MarkThreadSent records a message the mailbox sent, replies to which are free
+	MarkThreadSent(mailbox, messageID string, recipients []string) error
+	Pricing(recipient string) (Pricing, error)
+	// RepeatSender tells if the sender paid the recipient before
+	RepeatSender(recipient, sender string) (bool, error)
+	// Debit charges a mail once per recipient, it returns ErrInsufficientBalance if the sender can not pay
+	Debit(sender, recipient, messageID, bodyHash string, amount int64) error
+}
+
+type storePaymentPolicy struct {
+	store paymentStore
+}
+
+func NewPaymentPolicy(store paymentStore) PaymentPolicy {
+	return storePaymentPolicy{store}
+}
+
+var _ PaymentPolicy = storePaymentPolicy{}
+
+// Decide implements PaymentPolicy
+func (p storePaymentPolicy) Decide(req PaymentRequest) (PaymentDecision, error) {
+	allowed, err := p.store.Allowlisted(req.Recipient, req.Sender)
+	if err != nil {
+		return PaymentDecision{}, errors.Wrap(err, "failed to check allowlist")
+	}
+	if allowed {
+		return PaymentDecision{Paid: true, Reason: PaidByAllowlist}, nil
+	}
+
+	// Replies to mail the recipient sent to the sender are free
+	if len(req.Thread) > 0 {
+		paid, err := p.store.ThreadPaid(req.Recipient, req.Sender, req.Thread)
+		if err != nil {
+			return PaymentDecision{}, errors.Wrap(err, "failed to check thread")
+		}
+		if paid {
+			return PaymentDecision{Paid: true, Reason: PaidByThread}, nil
+		}
+	}
+
+	pricing, err := p.store.Pricing(req.Recipient)
+	if err != nil {
+		return PaymentDecision{}, errors.Wrap(err, "failed to get pricing")
+	}
+	repeat, err := p.store.RepeatSender(req.Recipient, req.Sender)
+	if err != nil {
+		return PaymentDecision{}, errors.Wrap(err, "failed to check repeat sender")
+	}
+	price := pricing.Price(req.Sender, req.Size, repeat)
+	if price == 0 && repeat && pricing.Price(req.Sender, req.Size, false) > 0 {
+		return PaymentDecision{Paid: true, Reason: PaidByDiscount}, nil
+	}
+	if price == 0 {
+		return PaymentDecision{Paid: true, Reason: PaidByFreeTier}, nil
+	}
+	err = p.store.Debit(req.Sender, req.Recipient, req.MessageID, req.BodyHash, price)
+	if errors.Is(err, ErrInsufficientBalance) {
+		return PaymentDecision{Price: price}, nil
+	}
+	if err != nil {
+		return PaymentDecision{}, errors.Wrap(err, "failed to debit balance")
+	}
+	return PaymentDecision{Paid: true, Reason: PaidByBalance, Price: price, Amount: price}, nil
+}
+
+// newPaymentRequest reads the message ids of the thread from the envelope
+func newPaymentRequest(recipient string, env smtpd.Envelope) PaymentRequest {
+	req := PaymentRequest{Sender: env.Sender, Recipient: recipient, BodyHash: bodyHash(env.Data), Size: len(env.Data)}
+	header, err := getHeader(env)
+	if err != nil {
+		return req
+	}
+	req.MessageID, _ = header.MessageID()
+	for _, key := range []string{"In-Reply-To", "References"} {
+		ids, _ := header.MsgIDList(key)
+		req.Thread = append(req.Thread, ids...)
+	}
+	return req
+}
+
+// correspondent normalizes an address a thread was sent to
+func correspondent(address string) string {
+	return strings.ToLower(strings.Trim(address, "<> "))
+}
+
+// threadKey is a Firestore safe document id for a message id
+func threadKey(messageID string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(strings.Trim(messageID, "<> "))))
+	return hex.EncodeToString(sum[:])
+}
+
+// memoryPaymentStore keeps all payment state in memory
+type memoryPaymentStore struct {
+	mu        sync.Mutex
+	allowlist map[string][]string
+	threads   map[string]bool
+	balances  map[string]int64
+	debits    map[string]bool
+	pricing   map[string]Pricing
+	paid      map[string]bool
+}
+
+func NewMemoryPaymentStore() *memoryPaymentStore {
+	return &memoryPaymentStore{
+		allowlist: map[string][]string{},
+		threads:   map[string]bool{},
+		balances:  map[string]int64{},
+		debits:    map[string]bool{},
+		pricing:   map[string]Pricing{},
+		paid:      map[string]bool{},
+	}
+}
+
+var _ paymentStore = &memoryPaymentStore{}
+
+func (s *memoryPaymentStore) AddToAllowlist(recipient string, entries ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allowlist[recipient] = append(s.allowlist[recipient], entries...)
+}
+
+func (s *memoryPaymentStore) SetBalance(sender string, amount int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.balances[sender] = amount
+}
+
+func (s *memoryPaymentStore) SetPricing(recipient string, p Pricing) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pricing[recipient] = p
+}
+
+func (s *memoryPaymentStore) Balance(sender string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.balances[sender]
+}
+
+// Allowlisted implements paymentStore
+func (s *memoryPaymentStore) Allowlisted(recipient, sender string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return allowlisted(s.allowlist[recipient], sender), nil
+}
+
+// ThreadPaid implements paymentStore
+func (s *memoryPaymentStore) ThreadPaid(recipient, sender string, messageIDs []string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range messageIDs {
+		if s.threads[recipient+"/"+threadKey(id)+"/"+correspondent(sender)] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MarkThreadSent implements paymentStore
+func (s *memoryPaymentStore) MarkThreadSent(mailbox, messageID string, recipients []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rec := range recipients {
+		s.threads[mailbox+"/"+threadKey(messageID)+"/"+correspondent(rec)] = true
+	}
+	return nil
+}
+
+// Pricing implements paymentStore
+func (s *memoryPaymentStore) Pricing(recipient string) (Pricing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.pricing[recipient]; ok {
+		return p, nil
+	}
+	return DefaultPricing, nil
+}
+
+// RepeatSender implements paymentStore
+func (s *memoryPaymentStore) RepeatSender(recipient, sender string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paid[recipient+"/"+sender], nil
+}
+
+// Debit implements paymentStore
+func (s *memoryPaymentStore) Debit(sender, recipient, messageID, bodyHash string, amount int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := debitKey(sender, recipient, messageID, bodyHash)
+	if s.debits[key] {
+		return nil
+	}
+	if s.balances[sender] < amount {
+		return ErrInsufficientBalance
+	}
+	s.balances[sender] -= amount
+	s.debits[key] = true
+	s.paid[recipient+"/"+sender] = true
+	return nil
+}
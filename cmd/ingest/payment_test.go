@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/chrj/smtpd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaymentPolicy(t *testing.T) {
+	s := NewMemoryPaymentStore()
+	s.AddToAllowlist("herman@pay2mail.me", "friend@example.org", "@q42.nl")
+	s.SetBalance("rich@example.org", 7)
+	p := NewPaymentPolicy(s)
+
+	d, err := p.Decide(PaymentRequest{Sender: "Friend@example.org", Recipient: "herman@pay2mail.me"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByAllowlist}, d)
+
+	d, err = p.Decide(PaymentRequest{Sender: "colleague@q42.nl", Recipient: "herman@pay2mail.me"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByAllowlist}, d)
+
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "1@example.org", BodyHash: "h1"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByBalance, Price: 5, Amount: 5}, d)
+	assert.Equal(t, int64(2), s.Balance("rich@example.org"))
+
+	// A resent mail is not charged twice
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "1@example.org", BodyHash: "h1"})
+	assert.NoError(t, err)
+	assert.True(t, d.Paid)
+	assert.Equal(t, int64(2), s.Balance("rich@example.org"))
+
+	// Other content reusing the Message-ID is charged
+	s.SetBalance("rich@example.org", 7)
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "1@example.org", BodyHash: "h2"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByBalance, Price: 5, Amount: 5}, d)
+	assert.Equal(t, int64(2), s.Balance("rich@example.org"))
+
+	// Out of money
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "2@example.org"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Price: 5}, d)
+	assert.Equal(t, int64(2), s.Balance("rich@example.org"))
+
+	// Referencing its own paid mail does not make a thread free
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "3@example.org", Thread: []string{"1@example.org"}})
+	assert.NoError(t, err)
+	assert.False(t, d.Paid)
+
+	// Replying to mail the recipient sent is free
+	assert.NoError(t, s.MarkThreadSent("herman@pay2mail.me", "<5@pay2mail.me>", []string{"Rich@example.org"}))
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "6@example.org", Thread: []string{"5@pay2mail.me"}})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByThread}, d)
+
+	// but only for whom it was sent to, and per recipient
+	d, err = p.Decide(PaymentRequest{Sender: "poor@example.org", Recipient: "herman@pay2mail.me", MessageID: "7@example.org", Thread: []string{"5@pay2mail.me"}})
+	assert.NoError(t, err)
+	assert.False(t, d.Paid)
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "other@pay2mail.me", MessageID: "8@example.org", Thread: []string{"5@pay2mail.me"}})
+	assert.NoError(t, err)
+	assert.False(t, d.Paid)
+}
+
+func TestNewPaymentRequest(t *testing.T) {
+	env := smtpd.Envelope{
+		Sender: "rich@example.org",
+		Data: []byte("From: rich@example.org\r\n" +
+			"To: herman@pay2mail.me\r\n" +
+			"Subject: Re: hi\r\n" +
+			"Message-ID: <3@example.org>\r\n" +
+			"In-Reply-To: <2@pay2mail.me>\r\n" +
+			"References: <1@example.org> <2@pay2mail.me>\r\n" +
+			"\r\n" +
+			"Hi there :)"),
+	}
+	req := newPaymentRequest("herman@pay2mail.me", env)
+	assert.Equal(t, bodyHash([]byte("Received: from elsewhere\r\n\r\nHi there :)")), req.BodyHash)
+	assert.Equal(t, "3@example.org", req.MessageID)
+	assert.Equal(t, []string{"2@pay2mail.me", "1@example.org", "2@pay2mail.me"}, req.Thread)
+	assert.Equal(t, threadKey("<1@example.org>"), threadKey("1@example.org"))
+}
+
+func TestPaymentPolicyPricing(t *testing.T) {
+	s := NewMemoryPaymentStore()
+	s.SetBalance("rich@example.org", 100)
+	s.SetPricing("herman@pay2mail.me", Pricing{Base: 10, PerKB: 2, RepeatDiscount: 50, FreeDomains: []string{"q42.nl"}})
+	p := NewPaymentPolicy(s)
+
+	d, err := p.Decide(PaymentRequest{Sender: "colleague@Q42.nl", Recipient: "herman@pay2mail.me", Size: 4000})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByFreeTier}, d)
+
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "1@example.org", Size: 2049})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByBalance, Price: 16, Amount: 16}, d)
+
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "2@example.org", Size: 2049})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByBalance, Price: 8, Amount: 8}, d)
+	assert.Equal(t, int64(76), s.Balance("rich@example.org"))
+
+	// A full discount is told apart from the free tier
+	s.SetPricing("herman@pay2mail.me", Pricing{Base: 10, RepeatDiscount: 100})
+	d, err = p.Decide(PaymentRequest{Sender: "rich@example.org", Recipient: "herman@pay2mail.me", MessageID: "3@example.org"})
+	assert.NoError(t, err)
+	assert.Equal(t, PaymentDecision{Paid: true, Reason: PaidByDiscount}, d)
+	assert.Equal(t, int64(76), s.Balance("rich@example.org"))
+}
+
+func TestPricingValidate(t *testing.T) {
+	p := Pricing{Base: 5, FreeDomains: []string{" @Q42.nl"}}
+	assert.NoError(t, p.Validate())
+	assert.Equal(t, []string{"q42.nl"}, p.FreeDomains)
+
+	assert.Error(t, (&Pricing{Base: -1}).Validate())
+	assert.Error(t, (&Pricing{RepeatDiscount: 101}).Validate())
+	assert.Error(t, (&Pricing{FreeDomains: []string{"a@b.nl"}}).Validate())
+	assert.Equal(t, "$0.05", formatPrice(5))
+}
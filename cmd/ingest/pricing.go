@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// Pricing is what a mailbox charges senders, stored in the "pricing" field
+// of mailboxes/{m}. Amounts are in cents.
+type Pricing struct {
+	Base  int64 `firestore:"base" json:"base"`
+	PerKB int64 `firestore:"perKB" json:"perKB"`
+	// Discount percentage for senders that paid this mailbox before
+	RepeatDiscount int64 `firestore:"repeatDiscount" json:"repeatDiscount"`
+	// Senders from these domains never pay. The envelope sender is matched,
+	// which is only safe as payment is decided for authenticated senders
+	// only (SPF or aligned DKIM, see deliver), others are quarantined.
+	FreeDomains []string `firestore:"freeDomains" json:"freeDomains"`
+}
+
+var DefaultPricing = Pricing{Base: defaultPrice}
+
+// Price of a mail of size bytes from sender, which must be authenticated
+func (p Pricing) Price(sender string, size int, repeat bool) int64 {
+	senderDomain := strings.ToLower(sender[strings.LastIndex(sender, "@")+1:])
+	for _, d := range p.FreeDomains {
+		if strings.EqualFold(d, senderDomain) {
+			return 0
+		}
+	}
+	kb := int64((size + 1023) / 1024)
+	price := p.Base + kb*p.PerKB
+	if repeat {
+		price = price * (100 - p.RepeatDiscount) / 100
+	}
+	return price
+}
+
+// Validate checks the pricing and normalizes the free domains
+func (p *Pricing) Validate() error {
+	if p.Base < 0 || p.PerKB < 0 {
+		return errors.New("prices can not be negative")
+	}
+	if p.RepeatDiscount < 0 || p.RepeatDiscount > 100 {
+		return errors.New("repeatDiscount must be a percentage between 0 and 100")
+	}
+	for i, d := range p.FreeDomains {
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+		if d == "" || strings.ContainsAny(d, "@ ") {
+			return fmt.Errorf("invalid free domain %q", p.FreeDomains[i])
+		}
+		p.FreeDomains[i] = d
+	}
+	return nil
+}
+
+func formatPrice(cents int64) string {
+	return fmt.Sprintf("$%.02f", float64(cents)/100)
+}
+
+// pricingHandler reads and updates the pricing of the mailbox of the user
+func (s *provisionServer) pricingHandler(logger *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fb, mailbox, err := authorize(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			var p Pricing
+			if err = json.NewDecoder(r.Body).Decode(&p); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err = p.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err = fb.SetPricing(mailbox, p); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logger.Info("Updated pricing", zap.String("mailbox", mailbox), zap.Any("pricing", p))
+		}
+
+		p, err := fb.Pricing(mailbox)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, p)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Warn("Failed to write response", zap.Error(err))
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"net/http"
 	"strings"
 	"text/template"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	firebase "firebase.google.com/go"
@@ -37,6 +38,8 @@ var (
 type provisionServer struct {
 	*mux.Router
 	TLSConfig *tls.Config
+	auth      *authService
+	mails     MailStore
 }
 
 func DKIM(c *tls.Config) string {
@@ -47,14 +50,23 @@ func DKIM(c *tls.Config) string {
 	if err != nil {
 		return ""
 	}
+	return dkimRecord(asSigner(cert.PrivateKey))
+}
+
+// dkimRecord is the DKIM TXT record of the public key of the signer
+func dkimRecord(key crypto.Signer) string {
+	if key == nil {
+		return ""
+	}
 	var der []byte
+	var err error
 	var k = ""
-	switch pk := cert.PrivateKey.(type) {
-	case *rsa.PrivateKey:
-		der, err = x509.MarshalPKIXPublicKey(&pk.PublicKey)
+	switch pk := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err = x509.MarshalPKIXPublicKey(pk)
 		k = "rsa"
-	case *ed25519.PrivateKey:
-		der, err = x509.MarshalPKIXPublicKey(pk.Public())
+	case ed25519.PublicKey:
+		der, err = x509.MarshalPKIXPublicKey(pk)
 		k = "ed25519"
 	}
 	if len(der) == 0 || err != nil {
@@ -71,17 +83,28 @@ func DKIM(c *tls.Config) string {
 	return out
 }
 
-func NewProvisionServer(logger *zap.Logger) (*provisionServer, error) {
-	s := &provisionServer{mux.NewRouter(), nil}
+func NewProvisionServer(logger *zap.Logger, auth *authService, mails MailStore) (*provisionServer, error) {
+	s := &provisionServer{mux.NewRouter(), nil, auth, mails}
 
 	s.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		view := template.Must(template.ParseFS(templateResources, "resources/config.html"))
-		dkim, _ := dkimOpts(s.TLSConfig, logger)
+		type domainRecords struct{ Domain, DMARC, DKIM string }
+		var domains []domainRecords
+		for _, name := range servedDomains {
+			records := domainRecords{
+				Domain: name,
+				DMARC:  fmt.Sprintf("_dmarc.%s TXT v=DMARC1; p=reject; pct=100; rua=mailto:abuse@%s; ruf=mailto:abuse@%s; aspf=r; adkim=r; sp=none;", name, *domain, *domain),
+			}
+			if key, ok := dkimKeys[name]; ok {
+				records.DKIM = fmt.Sprintf("%s._domainkey TXT %s", key.selector, dkimRecord(key.signer))
+			} else if opts, err := dkimOpts(s.TLSConfig, name, logger); err == nil {
+				records.DKIM = fmt.Sprintf("%s._domainkey TXT %s", opts.Selector, DKIM(s.TLSConfig))
+			}
+			domains = append(domains, records)
+		}
 		data := map[string]interface{}{
-			"Domain": *domain,
-			"DMARC":  fmt.Sprintf("_dmarc.%s TXT v=DMARC1; p=reject; pct=100; rua=mailto:abuse@%s; ruf=mailto:abuse@%s; aspf=r; adkim=r; sp=none;", *domain, *domain, *domain),
-			"DKIM":   fmt.Sprintf("%s._domainkey TXT %s", dkim.Selector, DKIM(s.TLSConfig)),
-			"SPF":    fmt.Sprintf(". TXT v=spf1 a mx -all"),
+			"Domains": domains,
+			"SPF":     fmt.Sprintf(". TXT v=spf1 a mx -all"),
 		}
 
 		err := view.ExecuteTemplate(w, "config.html", data)
@@ -102,7 +125,7 @@ func NewProvisionServer(logger *zap.Logger) (*provisionServer, error) {
 			return
 		}
 
-		err = firestoreBackend{db, r.Context()}.AddAppKey("herman@pay2mail.me", "foobar")
+		err = firestoreBackend{db, r.Context()}.AddAppKey("herman@pay2mail.me", "foobar", "provisiontest")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -120,33 +143,13 @@ func NewProvisionServer(logger *zap.Logger) (*provisionServer, error) {
 	})
 
 	s.HandleFunc("/provision", func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		id_token := strings.TrimPrefix(strings.TrimPrefix(r.Form.Get("authorization"), "Bearer"), "bearer")
-
-		app, token, err := verify(r.Context(), id_token)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		db, err := app.Firestore(r.Context())
+		fb, email, err := authorize(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		userEmail, _ := token.Claims["email"].(string)
-		if userEmail == "" {
-			http.Error(w, "Missing email claim in token", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
 		// Credentials
-		email, err := firestoreBackend{db, r.Context()}.FindUser(userEmail)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
 		password := make([]byte, 32)
 		_, err = rand.Read(password)
 		if err != nil {
@@ -154,7 +157,11 @@ func NewProvisionServer(logger *zap.Logger) (*provisionServer, error) {
 			return
 		}
 		// Write new credential to Firestore
-		err = firestoreBackend{db, r.Context()}.AddAppKey(email, hex.EncodeToString(password))
+		label := r.FormValue("label")
+		if label == "" {
+			label = "Mail profile " + time.Now().Format("2006-01-02")
+		}
+		err = fb.AddAppKey(email, hex.EncodeToString(password), label)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -171,6 +178,13 @@ func NewProvisionServer(logger *zap.Logger) (*provisionServer, error) {
 			return
 		}
 	})
+
+	s.HandleFunc("/api/pricing", s.pricingHandler(logger)).Methods(http.MethodGet, http.MethodPut)
+	s.HandleFunc("/api/allowlist", s.allowlistHandler(logger)).Methods(http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete)
+	s.HandleFunc("/api/allowlist/{entry}", s.allowlistHandler(logger)).Methods(http.MethodDelete)
+	s.HandleFunc("/api/appkeys", s.appKeysHandler(logger)).Methods(http.MethodGet)
+	s.HandleFunc("/api/appkeys/{id}", s.appKeysHandler(logger)).Methods(http.MethodPut, http.MethodDelete)
+	s.HandleFunc("/paid/{user}/{id}", s.releaseHandler(logger)).Methods(http.MethodPost)
 	return s, nil
 }
 
@@ -266,10 +280,29 @@ func verify(ctx context.Context, token string) (app *firebase.App, out *auth.Tok
 	return
 }
 
-func emailUserName(str string) string {
-	idx := strings.Index(str, "@")
-	if idx <= 0 {
-		return str
+// authorize verifies the Firebase ID token of the request and finds the
+// mailbox of the user it belongs to
+func authorize(r *http.Request) (fb firestoreBackend, mailbox string, err error) {
+	idToken := r.Header.Get("Authorization")
+	if idToken == "" {
+		r.ParseForm()
+		idToken = r.Form.Get("authorization")
+	}
+	idToken = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(idToken, "Bearer"), "bearer"))
+
+	app, token, err := verify(r.Context(), idToken)
+	if err != nil {
+		return fb, "", err
+	}
+	db, err := app.Firestore(r.Context())
+	if err != nil {
+		return fb, "", err
+	}
+	userEmail, _ := token.Claims["email"].(string)
+	if userEmail == "" {
+		return fb, "", errors.New("missing email claim in token")
 	}
-	return str[0:idx]
+	fb = firestoreBackend{db, r.Context()}
+	mailbox, err = fb.FindUser(userEmail)
+	return fb, mailbox, err
 }
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/chrj/smtpd"
+	"github.com/pkg/errors"
+	"github.com/xtgo/uuid"
+	"go.uber.org/zap"
+)
+
+// The outbound queue spools mail to other servers on disk, one JSON file per
+// mail, so that it survives restarts. Workers retry temporary (4xx) failures
+// with exponential backoff until the lifetime of the mail expires, after which
+// the sender gets a delivery status notification (RFC 3464).
+
+const (
+	// attemptTimeout bounds a single delivery attempt
+	attemptTimeout = 5 * time.Minute
+	// maxBackoff caps the delay between attempts
+	maxBackoff = 4 * time.Hour
+	// queuePollInterval is how often the spool is scanned for mail that is due
+	queuePollInterval = 30 * time.Second
+)
+
+type spooledMail struct {
+	ID          string    `json:"id"`
+	Sender      string    `json:"sender"`
+	Recipients  []string  `json:"recipients"`
+	Data        []byte    `json:"data"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+func (m spooledMail) envelope() smtpd.Envelope {
+	return smtpd.Envelope{Sender: m.Sender, Recipients: m.Recipients, Data: m.Data}
+}
+
+// transportFunc delivers a mail, reporting the result per recipient
+type transportFunc func(ctx context.Context, env smtpd.Envelope) []deliveryResult
+
+type outboundQueue struct {
+	dir       string
+	logger    *zap.Logger
+	transport transportFunc
+	mails     MailStore
+	lifetime  time.Duration
+	backoff   time.Duration
+	workers   int
+	now       func() time.Time
+
+	wake     chan struct{}
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+func newOutboundQueue(dir string, logger *zap.Logger, transport transportFunc, mails MailStore) (*outboundQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create spool")
+	}
+	return &outboundQueue{
+		dir:       dir,
+		logger:    logger,
+		transport: transport,
+		mails:     mails,
+		lifetime:  *queueLifetime,
+		backoff:   *queueBackoff,
+		workers:   *queueWorkers,
+		now:       time.Now,
+		wake:      make(chan struct{}, 1),
+		inflight:  make(map[string]bool),
+	}, nil
+}
+
+// Enqueue stores the mail in the spool; it is sent as soon as a worker is free
+func (q *outboundQueue) Enqueue(env smtpd.Envelope) (string, error) {
+	now := q.now()
+	m := spooledMail{
+		ID:          fmt.Sprintf("%d-%s", now.UnixNano(), uuid.NewRandom().String()),
+		Sender:      env.Sender,
+		Recipients:  env.Recipients,
+		Data:        env.Data,
+		Created:     now,
+		NextAttempt: now,
+	}
+	if err := q.save(m); err != nil {
+		return "", errors.Wrap(err, "failed to spool mail")
+	}
+	q.logger.Info("Queued mail", zap.String("id", m.ID), zap.String("from", m.Sender), zap.Strings("to", m.Recipients))
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return m.ID, nil
+}
+
+// run delivers the spooled mail until ctx is done. It then flushes the mail
+// that is due and lets the deliveries finish until drain is done; what is
+// left is delivered after the next start.
+func (q *outboundQueue) run(ctx, drain context.Context) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				if err := q.attempt(drain, id); err != nil {
+					q.logger.Error("Failed to process queued mail", zap.String("id", id), zap.Error(err))
+				}
+				q.mu.Lock()
+				delete(q.inflight, id)
+				q.mu.Unlock()
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	for {
+		ids, err := q.due(q.now())
+		if err != nil {
+			q.logger.Error("Failed to scan spool", zap.Error(err))
+		}
+		for _, id := range ids {
+			if drain.Err() != nil {
+				return
+			}
+			q.mu.Lock()
+			busy := q.inflight[id]
+			q.inflight[id] = true
+			q.mu.Unlock()
+			if busy {
+				continue
+			}
+			select {
+			case jobs <- id:
+			case <-drain.Done():
+				q.mu.Lock()
+				delete(q.inflight, id)
+				q.mu.Unlock()
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			// This was the final flush
+			return
+		}
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// due lists the spooled mail to attempt at now, oldest first
+func (q *outboundQueue) due(now time.Time) ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || id == entry.Name() {
+			continue
+		}
+		m, err := q.load(id)
+		if err != nil {
+			q.logger.Warn("Skipping unreadable spool file", zap.String("file", entry.Name()), zap.Error(err))
+			continue
+		}
+		if !m.NextAttempt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// attempt delivers a spooled mail once. Recipients that failed temporarily
+// are retried later, the sender is notified of the others that failed.
+func (q *outboundQueue) attempt(ctx context.Context, id string) error {
+	m, err := q.load(id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, attemptTimeout)
+	results := q.transport(ctx, m.envelope())
+	cancel()
+	m.Attempts++
+	now := q.now()
+	expired := now.Sub(m.Created) >= q.lifetime
+	logger := q.logger.With(zap.String("id", m.ID), zap.String("from", m.Sender), zap.Int("attempts", m.Attempts))
+
+	var retry []string
+	var failed []deliveryResult
+	for _, res := range results {
+		switch {
+		case res.Err == nil:
+			logger.Info("Delivered queued mail", zap.String("to", res.Recipient))
+		case temporaryFailure(res.Err) && !expired:
+			logger.Warn("Deferred queued mail", zap.String("to", res.Recipient), zap.Error(res.Err))
+			retry = append(retry, res.Recipient)
+			m.LastError = res.Err.Error()
+		default:
+			logger.Warn("Giving up on queued mail", zap.String("to", res.Recipient), zap.Error(res.Err))
+			failed = append(failed, res)
+		}
+	}
+
+	if len(failed) > 0 {
+		if err = q.returnToSender(m, failed); err != nil {
+			return err
+		}
+	}
+	if len(retry) == 0 {
+		return q.remove(id)
+	}
+	m.Recipients = retry
+	m.NextAttempt = now.Add(retryDelay(q.backoff, m.Attempts))
+	return q.save(m)
+}
+
+// returnToSender queues a delivery status notification for the sender, or
+// stores it in the inbox of a sender at a served domain
+func (q *outboundQueue) returnToSender(m spooledMail, failed []deliveryResult) error {
+	if m.Sender == "" {
+		// Never bounce a bounce (RFC 5321 §4.5.5)
+		return nil
+	}
+	data, err := deliveryStatusNotification(m, failed, q.now())
+	if err != nil {
+		return err
+	}
+	if q.mails != nil && isServedDomain(addressDomain(m.Sender)) {
+		// Queued, the notification would go to the relay or loop back in
+		// through the public listener, where mail from the null sender to a
+		// local mailbox ends up unpaid
+		if _, err = q.mails.Append(m.Sender, "INBOX", nil, q.now(), data); err != nil {
+			q.logger.Error("Failed to store delivery status notification", zap.String("id", m.ID), zap.String("sender", m.Sender), zap.Error(err))
+		}
+		return nil
+	}
+	_, err = q.Enqueue(smtpd.Envelope{Sender: "", Recipients: []string{m.Sender}, Data: data})
+	return err
+}
+
+func (q *outboundQueue) path(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *outboundQueue) load(id string) (m spooledMail, err error) {
+	data, err := os.ReadFile(q.path(id))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// save writes the mail atomically, so a crash never leaves half a file
+func (q *outboundQueue) save(m spooledMail) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(q.dir, m.ID+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path(m.ID))
+}
+
+func (q *outboundQueue) remove(id string) error {
+	err := os.Remove(q.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// temporaryFailure tells if a delivery may succeed later: 4xx replies,
+// network errors and DNS failures other than a non-existing domain
+func temporaryFailure(err error) bool {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code < 500
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	return true
+}
+
+// retryDelay doubles the backoff with every attempt, up to maxBackoff
+func retryDelay(backoff time.Duration, attempts int) time.Duration {
+	delay := backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+var enhancedStatus = regexp.MustCompile(`^([245])\.\d{1,3}\.\d{1,3}\b`)
+
+// deliveryStatus is the RFC 3463 status code and diagnostic for a failure
+func deliveryStatus(err error) (status, diagnostic string) {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		if code := enhancedStatus.FindString(tpErr.Msg); code != "" {
+			return code, fmt.Sprintf("%d %s", tpErr.Code, tpErr.Msg)
+		}
+		return fmt.Sprintf("%d.0.0", tpErr.Code/100), fmt.Sprintf("%d %s", tpErr.Code, tpErr.Msg)
+	}
+	if temporaryFailure(err) {
+		// Delivery time expired
+		return "4.4.7", err.Error()
+	}
+	return "5.0.0", err.Error()
+}
+
+// deliveryStatusNotification renders a multipart/report (RFC 3464) for the failed recipients
+func deliveryStatusNotification(m spooledMail, failed []deliveryResult, now time.Time) ([]byte, error) {
+	type recipientStatus struct {
+		Recipient, Status, Diagnostic string
+	}
+	var recipients []recipientStatus
+	for _, res := range failed {
+		status, diagnostic := deliveryStatus(res.Err)
+		recipients = append(recipients, recipientStatus{res.Recipient, status, strings.ReplaceAll(diagnostic, "\n", " ")})
+	}
+	header, _, _ := bytes.Cut(bytes.ReplaceAll(m.Data, []byte("\r\n"), []byte("\n")), []byte("\n\n"))
+	original := smtpd.Envelope{Data: m.Data}
+
+	view := template.Must(template.ParseFS(templateResources, "resources/dsn.txt"))
+	buf := bytes.NewBuffer(nil)
+	err := view.ExecuteTemplate(buf, "dsn.txt", map[string]interface{}{
+		"Uid":             uuid.NewRandom().String(),
+		"Domain":          *domain,
+		"Hostname":        *hostName,
+		"From":            "MAILER-DAEMON@" + *domain,
+		"To":              m.Sender,
+		"OriginalSubject": mustGetSubject(original),
+		"Date":            now.Format(time.RFC1123Z),
+		"Arrival":         m.Created.Format(time.RFC1123Z),
+		"Recipients":      recipients,
+		"Headers":         string(header),
+		"Boundary":        uuid.NewRandom().String(),
+	})
+	return buf.Bytes(), err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestOutboundQueue(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2022, 10, 21, 12, 0, 0, 0, time.UTC)
+	var sent []smtpd.Envelope
+	var failure error
+	transport := func(ctx context.Context, env smtpd.Envelope) []deliveryResult {
+		if failure != nil {
+			return failAll(env.Recipients, failure)
+		}
+		sent = append(sent, env)
+		return failAll(env.Recipients, nil)
+	}
+	q, err := newOutboundQueue(dir, zap.NewNop(), transport, nil)
+	assert.NoError(t, err)
+	q.now = func() time.Time { return now }
+	q.backoff, q.lifetime = time.Minute, time.Hour
+
+	env := smtpd.Envelope{Sender: "herman@example.org", Recipients: []string{"a@example.net"}, Data: []byte("Subject: Hi\r\n\r\nHello\r\n")}
+	id, err := q.Enqueue(env)
+	assert.NoError(t, err)
+
+	// Temporary failures are retried later with increasing delays
+	failure = &textproto.Error{Code: 451, Msg: "4.7.1 Try again later"}
+	assert.NoError(t, q.attempt(context.Background(), id))
+	m, err := q.load(id)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Minute), m.NextAttempt)
+	due, err := q.due(now)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, q.attempt(context.Background(), id))
+	m, _ = q.load(id)
+	assert.Equal(t, now.Add(2*time.Minute), m.NextAttempt)
+
+	// The spool survives a restart
+	q, err = newOutboundQueue(dir, zap.NewNop(), transport, nil)
+	assert.NoError(t, err)
+	q.now = func() time.Time { return now }
+	now = now.Add(2 * time.Minute)
+	due, _ = q.due(now)
+	assert.Equal(t, []string{id}, due)
+	failure = nil
+	assert.NoError(t, q.attempt(context.Background(), id))
+	assert.Equal(t, []smtpd.Envelope{env}, sent)
+	due, _ = q.due(now)
+	assert.Empty(t, due)
+}
+
+func TestOutboundQueueReturnsToSender(t *testing.T) {
+	now := time.Date(2022, 10, 21, 12, 0, 0, 0, time.UTC)
+	failure := error(&textproto.Error{Code: 550, Msg: "5.1.1 No such user"})
+	q, err := newOutboundQueue(t.TempDir(), zap.NewNop(), func(ctx context.Context, env smtpd.Envelope) []deliveryResult {
+		return failAll(env.Recipients, failure)
+	}, nil)
+	assert.NoError(t, err)
+	q.now = func() time.Time { return now }
+
+	id, err := q.Enqueue(smtpd.Envelope{Sender: "herman@example.org", Recipients: []string{"a@example.net"}, Data: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+	assert.NoError(t, err)
+	assert.NoError(t, q.attempt(context.Background(), id))
+
+	// The mail is replaced by a notification from the null sender
+	due, _ := q.due(now)
+	assert.Len(t, due, 1)
+	dsn, err := q.load(due[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "", dsn.Sender)
+	assert.Equal(t, []string{"herman@example.org"}, dsn.Recipients)
+	assert.Contains(t, string(dsn.Data), "report-type=delivery-status")
+	assert.Contains(t, string(dsn.Data), "Final-Recipient: rfc822; a@example.net\nAction: failed\nStatus: 5.1.1\nDiagnostic-Code: smtp; 550 5.1.1 No such user")
+	assert.Contains(t, string(dsn.Data), "Subject: [Undelivered Mail Returned to Sender] Hi")
+
+	// Notifications that can not be delivered are dropped
+	assert.NoError(t, q.attempt(context.Background(), dsn.ID))
+	due, _ = q.due(now)
+	assert.Empty(t, due)
+
+	// Temporary failures are returned once the lifetime expires
+	failure = errors.New("connection refused")
+	id, _ = q.Enqueue(smtpd.Envelope{Sender: "herman@example.org", Recipients: []string{"a@example.net"}, Data: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+	now = now.Add(q.lifetime)
+	assert.NoError(t, q.attempt(context.Background(), id))
+	due, _ = q.due(now)
+	assert.Len(t, due, 1)
+	dsn, _ = q.load(due[0])
+	assert.Contains(t, string(dsn.Data), "Status: 4.4.7")
+}
+
+func TestOutboundQueueReturnsToLocalSender(t *testing.T) {
+	domains := servedDomains
+	t.Cleanup(func() { servedDomains = domains })
+	servedDomains = []string{"example.org"}
+
+	now := time.Date(2022, 10, 21, 12, 0, 0, 0, time.UTC)
+	mails := newMemoryStore(zap.NewNop())
+	q, err := newOutboundQueue(t.TempDir(), zap.NewNop(), func(ctx context.Context, env smtpd.Envelope) []deliveryResult {
+		return failAll(env.Recipients, &textproto.Error{Code: 550, Msg: "5.1.1 No such user"})
+	}, mails)
+	assert.NoError(t, err)
+	q.now = func() time.Time { return now }
+
+	id, err := q.Enqueue(smtpd.Envelope{Sender: "herman@example.org", Recipients: []string{"a@example.net"}, Data: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+	assert.NoError(t, err)
+	assert.NoError(t, q.attempt(context.Background(), id))
+
+	// The notification is not queued but stored in the inbox of the sender
+	due, _ := q.due(now)
+	assert.Empty(t, due)
+	inbox, err := mails.List("herman@example.org", "INBOX")
+	assert.NoError(t, err)
+	assert.Len(t, inbox, 1)
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, retryDelay(time.Minute, 1))
+	assert.Equal(t, 8*time.Minute, retryDelay(time.Minute, 4))
+	assert.Equal(t, maxBackoff, retryDelay(time.Minute, 40))
+}
+
+func TestOutboundQueuePerRecipient(t *testing.T) {
+	now := time.Date(2022, 10, 21, 12, 0, 0, 0, time.UTC)
+	q, err := newOutboundQueue(t.TempDir(), zap.NewNop(), func(ctx context.Context, env smtpd.Envelope) []deliveryResult {
+		return []deliveryResult{
+			{Recipient: "a@example.net"},
+			{Recipient: "b@example.net", Err: &textproto.Error{Code: 452, Msg: "4.2.2 Mailbox full"}},
+			{Recipient: "c@example.com", Err: &textproto.Error{Code: 550, Msg: "5.1.1 No such user"}},
+		}
+	}, nil)
+	assert.NoError(t, err)
+	q.now = func() time.Time { return now }
+
+	id, err := q.Enqueue(smtpd.Envelope{Sender: "herman@example.org", Recipients: []string{"a@example.net", "b@example.net", "c@example.com"}, Data: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+	assert.NoError(t, err)
+	assert.NoError(t, q.attempt(context.Background(), id))
+
+	// Only the deferred recipient is retried
+	m, err := q.load(id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b@example.net"}, m.Recipients)
+
+	// Only the failed recipient is reported
+	due, _ := q.due(now)
+	assert.Len(t, due, 1)
+	dsn, _ := q.load(due[0])
+	assert.Contains(t, string(dsn.Data), "Final-Recipient: rfc822; c@example.com")
+	assert.NotContains(t, string(dsn.Data), "a@example.net")
+	assert.NotContains(t, string(dsn.Data), "b@example.net")
+}
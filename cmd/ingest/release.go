@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// releaseHandler moves a quarantined mail to the INBOX once it is paid for.
+// It is called by the Stripe webhook, which authenticates with the release secret.
+func (s *provisionServer) releaseHandler(logger *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *releaseSecret == "" {
+			http.Error(w, "release is disabled", http.StatusForbidden)
+			return
+		}
+		secret := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer"))
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(*releaseSecret)) != 1 {
+			http.Error(w, "invalid secret", http.StatusUnauthorized)
+			return
+		}
+
+		var body struct {
+			Recipient string `json:"recipient"`
+			EmailID   string `json:"emailId"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		vars := mux.Vars(r)
+		if body.Recipient == "" {
+			body.Recipient = payAddress(vars["user"])
+		}
+		if body.EmailID == "" {
+			body.EmailID = vars["id"]
+		}
+		logger := logger.With(zap.String("recipient", body.Recipient), zap.String("id", body.EmailID))
+
+		fb, err := FirestoreBackend(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = releaseEmail(fb, s.mails, body.Recipient, body.EmailID)
+		if errors.Is(err, errMailNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to release email", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Released paid email")
+		writeJSON(w, map[string]interface{}{"released": true})
+	}
+}
+
+// quarantine records the mail that waits for payment
+type quarantine interface {
+	// QuarantinedMail is where QuarantineEmail recorded the mail was stored,
+	// and whether it was paid for
+	QuarantinedMail(recipient, id string) (stored StoredMessage, paid bool, err error)
+	MarkPaid(recipient, id string) error
+}
+
+var _ quarantine = firestoreBackend{}
+
+// releaseEmail moves the mail QuarantineEmail recorded as id from UNPAID to
+// INBOX. The message is found by the UID and UIDVALIDITY in the record. The
+// record is marked paid first, so that when the move fails the mail is not
+// purged, and the retry of the webhook moves it or finds it moved.
+func releaseEmail(q quarantine, mails MailStore, recipient, id string) error {
+	stored, paid, err := q.QuarantinedMail(recipient, id)
+	if err != nil {
+		return err
+	}
+	if !paid {
+		if err = q.MarkPaid(recipient, id); err != nil {
+			return err
+		}
+	}
+	_, err = mails.Move(recipient, "UNPAID", "INBOX", stored.UID, stored.UIDValidity)
+	if paid && errors.Is(err, errMailNotFound) {
+		// Moved by an earlier release
+		return nil
+	}
+	return err
+}
+
+// QuarantinedMail implements quarantine. Records from before the uid was
+// stored in them have it in their {uid}-{uuid} id.
+func (b firestoreBackend) QuarantinedMail(recipient, id string) (StoredMessage, bool, error) {
+	doc, err := b.db.Collection("mailboxes").Doc(recipient).Collection("emails").Doc(id).Get(b.ctx)
+	if status.Code(err) == codes.NotFound {
+		return StoredMessage{}, false, errors.Wrapf(errMailNotFound, "no quarantined mail %s", id)
+	}
+	if err != nil {
+		return StoredMessage{}, false, err
+	}
+	var data struct {
+		Paid        bool   `firestore:"paid"`
+		UID         uint32 `firestore:"uid"`
+		UIDValidity uint32 `firestore:"uidValidity"`
+	}
+	if err = doc.DataTo(&data); err != nil {
+		return StoredMessage{}, false, err
+	}
+	data.UID, err = recordUID(id, data.UID)
+	if err != nil {
+		return StoredMessage{}, false, err
+	}
+	return StoredMessage{UID: data.UID, UIDValidity: data.UIDValidity}, data.Paid, nil
+}
+
+// recordUID is the uid of a quarantine record, which is in the id of records
+// from before the uid was stored in them
+func recordUID(id string, uid uint32) (uint32, error) {
+	if uid != 0 {
+		return uid, nil
+	}
+	uidStr, _, _ := strings.Cut(id, "-")
+	parsed, err := strconv.ParseUint(uidStr, 10, 32)
+	if err != nil {
+		return 0, errors.Wrapf(errMailNotFound, "invalid id %q", id)
+	}
+	return uint32(parsed), nil
+}
+
+// MarkPaid records the quarantined mail was paid for
+func (b firestoreBackend) MarkPaid(recipient, id string) error {
+	_, err := b.db.Collection("mailboxes").Doc(recipient).Collection("emails").Doc(id).Update(b.ctx, []firestore.Update{
+		{Path: "paid", Value: true},
+		{Path: "paidAt", Value: time.Now()},
+	})
+	return errors.Wrapf(err, "failed to mark %s/%s as paid", recipient, id)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// memoryQuarantine keeps the quarantine records in memory
+type memoryQuarantine struct {
+	stored map[string]StoredMessage
+	paid   []string
+}
+
+func (q *memoryQuarantine) QuarantinedMail(recipient, id string) (StoredMessage, bool, error) {
+	stored, ok := q.stored[recipient+"/"+id]
+	if !ok {
+		return StoredMessage{}, false, errors.Wrapf(errMailNotFound, "no quarantined mail %s", id)
+	}
+	for _, paid := range q.paid {
+		if paid == recipient+"/"+id {
+			return stored, true, nil
+		}
+	}
+	return stored, false, nil
+}
+
+func (q *memoryQuarantine) MarkPaid(recipient, id string) error {
+	q.paid = append(q.paid, recipient+"/"+id)
+	return nil
+}
+
+func TestReleaseEmail(t *testing.T) {
+	mails := newMemoryStore(zap.NewNop())
+	q := &memoryQuarantine{stored: map[string]StoredMessage{}}
+	for i := 0; i < 3; i++ {
+		stored, err := mails.Append("herman@ptsm.q42.com", "UNPAID", nil, time.Now(), []byte(body))
+		assert.NoError(t, err)
+		q.stored["herman@ptsm.q42.com/"+string(rune('a'+i))] = stored
+	}
+	q.stored["herman@ptsm.q42.com/old"] = StoredMessage{UID: 3, UIDValidity: 1}
+	// The user marked another unpaid mail for deletion
+	assert.NoError(t, mails.SetFlags("herman@ptsm.q42.com", "UNPAID", 1, []string{imap.DeletedFlag}))
+
+	assert.ErrorIs(t, releaseEmail(q, mails, "herman@ptsm.q42.com", "nope"), errMailNotFound)
+	assert.ErrorIs(t, releaseEmail(q, mails, "athena@ptsm.q42.com", "b"), errMailNotFound)
+	assert.ErrorIs(t, releaseEmail(q, mails, "herman@ptsm.q42.com", "old"), errMailNotFound, "another UIDVALIDITY")
+
+	assert.NoError(t, releaseEmail(q, mails, "herman@ptsm.q42.com", "b"))
+	assert.Equal(t, []string{"herman@ptsm.q42.com/old", "herman@ptsm.q42.com/b"}, q.paid)
+	inbox, err := mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	assert.Len(t, inbox, 1)
+	unpaid, err := mails.List("herman@ptsm.q42.com", "UNPAID")
+	assert.NoError(t, err)
+	if assert.Len(t, unpaid, 2) {
+		assert.Equal(t, uint32(1), unpaid[0].UID)
+		assert.Equal(t, uint32(3), unpaid[1].UID)
+	}
+
+	// A retry of the webhook, after marking it paid failed, finds the mail moved
+	assert.NoError(t, releaseEmail(q, mails, "herman@ptsm.q42.com", "b"))
+	inbox, _ = mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.Len(t, inbox, 1)
+}
+
+func TestReleaseEmailDisk(t *testing.T) {
+	// The disk store keeps UIDs across rescans, and does not reuse them
+	mails := newDiskStore(t.TempDir(), zap.NewNop())
+	q := &memoryQuarantine{stored: map[string]StoredMessage{}}
+	for i := 0; i < 12; i++ {
+		stored, err := mails.Append("herman@ptsm.q42.com", "UNPAID", nil, time.Now(), []byte(fmt.Sprintf("Subject: %d\r\n\r\nHi\r\n", i+1)))
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(diskUIDValidity), stored.UIDValidity)
+		q.stored[fmt.Sprintf("herman@ptsm.q42.com/%d", i+1)] = stored
+	}
+	assert.NoError(t, mails.Delete("herman@ptsm.q42.com", "UNPAID", 12, 0))
+	assert.NoError(t, mails.Delete("herman@ptsm.q42.com", "UNPAID", 1, 0))
+	assert.NoError(t, releaseEmail(q, mails, "herman@ptsm.q42.com", "10"))
+	assert.ErrorIs(t, releaseEmail(q, mails, "herman@ptsm.q42.com", "12"), errMailNotFound)
+
+	created, err := mails.Append("herman@ptsm.q42.com", "UNPAID", nil, time.Now(), []byte(body))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(13), created.UID)
+
+	inbox, err := mails.List("herman@ptsm.q42.com", "INBOX")
+	assert.NoError(t, err)
+	assert.Len(t, inbox, 1)
+	user, err := mails.User("herman@ptsm.q42.com")
+	assert.NoError(t, err)
+	mb, err := user.GetMailbox("INBOX")
+	assert.NoError(t, err)
+	msg, err := findMessage(mb, inbox[0].UID, imap.FetchEnvelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "10", msg.Envelope.Subject)
+
+	unpaid, err := mails.List("herman@ptsm.q42.com", "UNPAID")
+	assert.NoError(t, err)
+	var uids []uint32
+	for _, msg := range unpaid {
+		uids = append(uids, msg.UID)
+	}
+	assert.Equal(t, []uint32{2, 3, 4, 5, 6, 7, 8, 9, 11, 13}, uids)
+}
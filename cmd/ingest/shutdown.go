@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On a signal the servers stop accepting connections and get the grace
+// period of -shutdown_grace to finish their sessions. Once they are done the
+// outbound queue delivers what is due in the remainder of the grace period;
+// what is left stays in the spool for the next start.
+
+// graceContext is done the grace period after ctx is done
+func graceContext(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	drain, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-drain.Done():
+			return
+		}
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-drain.Done():
+		}
+	}()
+	return drain, cancel
+}
+
+// shutdownGroup runs the servers, shutting all down when one of them fails
+type shutdownGroup struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	errs   []string
+}
+
+func newShutdownGroup(cancel context.CancelFunc) *shutdownGroup {
+	return &shutdownGroup{cancel: cancel}
+}
+
+// Go runs fn, which returns once it stopped; an error marks the shutdown as failed
+func (g *shutdownGroup) Go(name string, fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.mu.Lock()
+			g.errs = append(g.errs, fmt.Sprintf("%s: %v", name, err))
+			g.mu.Unlock()
+			g.cancel()
+		}
+	}()
+}
+
+// Wait waits until all have stopped and reports their failures
+func (g *shutdownGroup) Wait() error {
+	g.wg.Wait()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(g.errs, "; "))
+	}
+	return nil
+}
+
+// trackingListener remembers the open connections, so they can be closed
+// when the grace period is over
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTrackingListener(ln net.Listener) *trackingListener {
+	return &trackingListener{Listener: ln, conns: make(map[net.Conn]struct{})}
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.conns[conn] = struct{}{}
+	l.mu.Unlock()
+	return &trackedConn{Conn: conn, l: l}, nil
+}
+
+// closeConns closes the open connections and returns how many there were
+func (l *trackingListener) closeConns() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.conns)
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = make(map[net.Conn]struct{})
+	return n
+}
+
+type trackedConn struct {
+	net.Conn
+	l *trackingListener
+}
+
+func (c *trackedConn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c.Conn)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
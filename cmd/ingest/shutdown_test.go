@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestGraceContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	drain, cancelDrain := graceContext(ctx, 50*time.Millisecond)
+	defer cancelDrain()
+
+	// The grace period starts when ctx is done
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, drain.Err())
+	cancel()
+	assert.NoError(t, drain.Err())
+	select {
+	case <-drain.Done():
+	case <-time.After(time.Second):
+		t.Fatal("grace period did not end")
+	}
+}
+
+func TestShutdownGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	servers := newShutdownGroup(cancel)
+	servers.Go("ok", func() error {
+		<-ctx.Done()
+		return nil
+	})
+	// A failing server shuts down the others
+	servers.Go("broken", func() error { return errors.New("address in use") })
+	assert.EqualError(t, servers.Wait(), "broken: address in use")
+	assert.Error(t, ctx.Err())
+}
+
+func TestTrackingListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	tracker := newTrackingListener(ln)
+	defer tracker.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := tracker.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		assert.NoError(t, err)
+		return conn
+	}
+	first, second := dial(), dial()
+	defer first.Close()
+	defer second.Close()
+	(<-accepted).Close()
+	<-accepted
+
+	// Only the open connection is closed
+	assert.Equal(t, 1, tracker.closeConns())
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestOutboundQueueFlushesOnShutdown(t *testing.T) {
+	delivered := make(chan string, 2)
+	transport := func(ctx context.Context, env smtpd.Envelope) []deliveryResult {
+		delivered <- env.Recipients[0]
+		return failAll(env.Recipients, nil)
+	}
+	q, err := newOutboundQueue(t.TempDir(), zap.NewNop(), transport, nil)
+	assert.NoError(t, err)
+	_, err = q.Enqueue(smtpd.Envelope{Sender: "herman@example.org", Recipients: []string{"a@example.net"}, Data: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+	assert.NoError(t, err)
+
+	// Mail that is due when the queue stops is still delivered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.run(ctx, context.Background())
+	assert.Equal(t, "a@example.net", <-delivered)
+	due, err := q.due(q.now())
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+
+	// Unless the grace period is over, then it stays in the spool
+	_, err = q.Enqueue(smtpd.Envelope{Sender: "herman@example.org", Recipients: []string{"b@example.net"}, Data: []byte("Subject: Hi\r\n\r\nHello\r\n")})
+	assert.NoError(t, err)
+	q.run(ctx, ctx)
+	due, _ = q.due(q.now())
+	assert.Len(t, due, 1)
+	assert.Empty(t, delivered)
+}
@@ -7,98 +7,111 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"os"
-	"path"
+	"net/url"
 	"strings"
 	"text/template"
 	"time"
 
-	"github.com/bcampbell/tameimap/store"
 	"github.com/chrj/smtpd"
 	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/emersion/go-sasl"
 	"github.com/pkg/errors"
 	"github.com/xtgo/uuid"
 	"go.uber.org/zap"
 )
 
-type protoAddr struct {
-	protocol string
-	address  string
-}
-
 type wrap struct {
 	logger    *zap.Logger
 	fb        *firestoreBackend
-	getSigner func() (*dkim.Signer, error)
+	getSigner func(signDomain string) (*dkim.Signer, error)
+	// Key material for ARC sealing, shared with DKIM
+	signOptions func() (*dkim.SignOptions, error)
+	payments    PaymentPolicy
+	dns         resolver
+	queue       *outboundQueue
+	submission  bool
+	auth        *authService
+	mails       MailStore
 }
 
-func startSmtpServers(ctx context.Context, logger *zap.Logger, tlsConfig *tls.Config, getSigner func() (*dkim.Signer, error)) {
+// startSmtpServers serves until ctx is done, then lets the sessions finish until drain is done
+func startSmtpServers(ctx, drain context.Context, logger *zap.Logger, tlsConfig *tls.Config, getSigner func(signDomain string) (*dkim.Signer, error), signOptions func() (*dkim.SignOptions, error), queue *outboundQueue, lns listeners, auth *authService, mails MailStore) error {
 	var servers []*smtpd.Server
+	var tracked []*trackingListener
 
 	be, err := FirestoreBackend(ctx)
 	if err != nil {
-		logger.With(zap.Error(err)).Fatal("error starting firestore")
-	}
-
-	for _, listen := range []protoAddr{{"starttls", ":25"}, {"starttls", ":587"}, {"tls", ":465"}} {
-		var err error
-		var lsnr net.Listener
-
-		w := wrap{logger.With(zap.String("protocol", listen.protocol)), &be, getSigner}
-		server := &smtpd.Server{
-			Hostname:          *hostName,
-			WelcomeMessage:    *welcomeMsg,
-			ReadTimeout:       readTimeout,
-			WriteTimeout:      writeTimeout,
-			DataTimeout:       dataTimeout,
-			MaxConnections:    *maxConnections,
-			MaxMessageSize:    *maxMessageSize,
-			MaxRecipients:     *maxRecipients,
-			ConnectionChecker: w.connectionChecker,
-			SenderChecker:     w.senderChecker,
-			RecipientChecker:  w.recipientChecker,
-			Handler:           w.mailHandler,
-			Authenticator:     w.authenticator,
-			AllowAnonymous:    true,
-		}
-
-		switch listen.protocol {
-		case "":
-			logger.Sugar().Infof("listening on address %s", listen.address)
-			lsnr, err = net.Listen("tcp", listen.address)
-
-		case "starttls":
-			server.TLSConfig = tlsConfig
-			server.ForceTLS = *localForceTLS
-
-			logger.Sugar().Infof("listening on address %s (STARTTLS)", listen.address)
-			lsnr, err = net.Listen("tcp", listen.address)
+		return errors.Wrap(err, "error starting firestore")
+	}
+	failed := make(chan error, len(lns["smtp"])+len(lns["submission"])+len(lns["smtps"]))
+
+	for _, protocol := range []string{"smtp", "submission", "smtps"} {
+		for _, lsnr := range lns[protocol] {
+			listen := protoAddr{protocol: protocol, address: lsnr.Addr().String()}
+			w := wrap{
+				logger:      logger.With(zap.String("protocol", listen.protocol)),
+				fb:          &be,
+				getSigner:   getSigner,
+				signOptions: signOptions,
+				payments:    NewPaymentPolicy(be),
+				dns:         net.DefaultResolver,
+				queue:       queue,
+				submission:  listen.submission(),
+				auth:        auth,
+				mails:       mails,
+			}
+			server := &smtpd.Server{
+				Hostname:          *hostName,
+				WelcomeMessage:    *welcomeMsg,
+				ReadTimeout:       readTimeout,
+				WriteTimeout:      writeTimeout,
+				DataTimeout:       dataTimeout,
+				MaxConnections:    *maxConnections,
+				MaxMessageSize:    *maxMessageSize,
+				MaxRecipients:     *maxRecipients,
+				ConnectionChecker: w.connectionChecker,
+				SenderChecker:     w.senderChecker,
+				RecipientChecker:  w.recipientChecker,
+				Handler:           w.mailHandler,
+				Authenticator:     w.authenticator,
+				AuthMechanisms:    w.authMechanisms(),
+				AllowAnonymous:    true,
+				TLSConfig:         tlsConfig,
+			}
 
-		case "tls":
-			server.TLSConfig = tlsConfig
+			tracker := newTrackingListener(lsnr)
+			tracked = append(tracked, tracker)
+			lsnr = tracker
 
-			logger.Sugar().Infof("listening on address %s (TLS)", listen.address)
-			lsnr, err = tls.Listen("tcp", listen.address, server.TLSConfig)
+			switch listen.protocol {
+			case "smtp", "submission":
+				server.ForceTLS = *localForceTLS
+				logger.Sugar().Infof("listening on address %s (%s, STARTTLS)", listen.address, listen.protocol)
 
-		default:
-			logger.
-				With(zap.String("protocol", listen.protocol)).
-				Fatal("unknown protocol in listen address")
-		}
+			case "smtps":
+				logger.Sugar().Infof("listening on address %s (%s, TLS)", listen.address, listen.protocol)
+				lsnr = tls.NewListener(lsnr, tlsConfig)
+			}
 
-		if err != nil {
-			logger.With(zap.Error(err)).Fatal("error starting listener")
+			servers = append(servers, server)
+			go func(lsnr net.Listener) {
+				if err := server.Serve(lsnr); err != nil && err != smtpd.ErrServerClosed {
+					failed <- err
+				}
+			}(lsnr)
 		}
-		servers = append(servers, server)
-		go func() {
-			server.Serve(lsnr)
-		}()
 	}
 
 	// Wait until shutdown is requested
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case err = <-failed:
+		logger.Error("Server failed", zap.Error(err))
+	}
 
 	// First close the listeners
 	for _, server := range servers {
@@ -112,24 +125,65 @@ func startSmtpServers(ctx context.Context, logger *zap.Logger, tlsConfig *tls.Co
 	}
 
 	// Then wait for the clients to exit
-	for _, server := range servers {
-		logger := logger.With(zap.Any("address", server.Address()))
-		logger.Debug("Waiting for server")
-		err := server.Wait()
-		if err != nil {
-			logger.With(zap.Error(err)).
-				Warn("Wait failed")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, server := range servers {
+			logger := logger.With(zap.Any("address", server.Address()))
+			logger.Debug("Waiting for server")
+			err := server.Wait()
+			if err != nil {
+				logger.With(zap.Error(err)).
+					Warn("Wait failed")
+			}
 		}
+	}()
+	select {
+	case <-done:
+		logger.Debug("done")
+		return err
+	case <-drain.Done():
 	}
 
-	logger.Debug("done")
+	// Sessions that outlast the grace period are cut off
+	cut := 0
+	for _, tracker := range tracked {
+		cut += tracker.closeConns()
+	}
+	logger.Warn("Cut off sessions after the grace period", zap.Int("sessions", cut))
+	return fmt.Errorf("%d sessions were cut off after the grace period", cut)
 }
 
 func (w wrap) connectionChecker(peer smtpd.Peer) error {
-	// we listen openly on the internet, so each connection is OK
+	// Submission requires authentication, checked once the client sends mail
+	if w.submission {
+		return nil
+	}
+	// The MX port listens openly on the internet, except for blocklisted peers
+	ip := peerIP(peer)
+	if ip == nil || inNetworks(ip, settings().allowedNets) {
+		return nil
+	}
+	if zone, listed := dnsblListed(context.Background(), w.dns, w.logger, ip, settings().dnsblZones); listed {
+		w.logger.Warn("Rejected blocklisted peer", zap.Stringer("peer", ip), zap.String("zone", zone))
+		return smtpd.Error{Code: 554, Message: fmt.Sprintf("5.7.1 Service unavailable; client host [%s] blocked using %s", ip, zone)}
+	}
 	return nil
 }
 
+func peerIP(peer smtpd.Peer) net.IP {
+	return addrIP(peer.Addr)
+}
+
+// relayAllowed tells if the peer may send mail to other servers
+func (w wrap) relayAllowed(peer smtpd.Peer) bool {
+	if peer.Username != "" {
+		return true
+	}
+	ip := peerIP(peer)
+	return w.submission && ip != nil && inNetworks(ip, settings().allowedNets)
+}
+
 func addrAllowed(addr string, allowedAddrs []string) bool {
 	if allowedAddrs == nil {
 		// If absent, all addresses are allowed
@@ -174,11 +228,16 @@ func addrAllowed(addr string, allowedAddrs []string) bool {
 }
 
 func (w wrap) senderChecker(peer smtpd.Peer, addr string) error {
-	if peer.Username != "" {
-		// TODO verify if the mail is FROM one of us or TO one of us
-		_ = 0
+	if !ownDomain(peer, addressDomain(addr)) {
+		w.logger.Warn("Submission from another domain", zap.String("sender_address", addr), zap.String("user", peer.Username))
+		return errForeignSender
+	}
+	if w.submission && !w.relayAllowed(peer) {
+		w.logger.Warn("Unauthenticated submission", zap.String("sender_address", addr), zap.Any("peer", peer.Addr))
+		return smtpd.Error{Code: 530, Message: "5.7.0 Authentication required"}
 	}
 
+	allowedSender := settings().allowedSender
 	if allowedSender == nil {
 		// Any sender is permitted
 		return nil
@@ -196,6 +255,7 @@ func (w wrap) senderChecker(peer smtpd.Peer, addr string) error {
 }
 
 func (w wrap) recipientChecker(peer smtpd.Peer, addr string) error {
+	allowedRecipients := settings().allowedRecipients
 	if allowedRecipients == nil {
 		// Any recipient is permitted
 		return nil
@@ -212,8 +272,72 @@ func (w wrap) recipientChecker(peer smtpd.Peer, addr string) error {
 	return smtpd.Error{Code: 451, Message: "Bad recipient address"}
 }
 
-func (w wrap) authenticator(peer smtpd.Peer, username, password string) error {
-	return FirestoreAuthenticator(context.Background(), w.logger, peer, username, password)
+// authenticator checks app keys, and ID tokens when OAuth logins are enabled.
+// Clients without XOAUTH2 or OAUTHBEARER may send their ID token as the
+// password.
+func (w wrap) authenticator(peer smtpd.Peer, username, password string) (err error) {
+	if w.auth.tokens != nil && looksLikeIDToken(password) {
+		_, err = w.auth.AuthenticateToken(username, password, peerIP(peer))
+	} else {
+		_, err = w.auth.Authenticate(username, password, peerIP(peer))
+	}
+	return w.authError(username, err)
+}
+
+// authMechanisms offers the OAuth mechanisms when OAuth logins are enabled
+func (w wrap) authMechanisms() map[string]func(peer smtpd.Peer) smtpd.AuthServer {
+	if w.auth.tokens == nil {
+		return nil
+	}
+	mechanisms := map[string]func(peer smtpd.Peer) smtpd.AuthServer{}
+	for _, mechanism := range []string{sasl.OAuthBearer, xoauth2} {
+		mechanism := mechanism
+		mechanisms[mechanism] = func(peer smtpd.Peer) smtpd.AuthServer {
+			a := &smtpOAuth{}
+			a.Server = newOAuthServer(mechanism, func(username, token string) (err error) {
+				w.logger.Info("OAuth login", zap.String("mechanism", mechanism), zap.String("username", username))
+				a.mailbox, err = w.auth.AuthenticateToken(username, token, peerIP(peer))
+				return w.authError(username, err)
+			})
+			return a
+		}
+	}
+	return mechanisms
+}
+
+// smtpOAuth is an OAuth mechanism for the SMTP server, which authenticates
+// the session as the mailbox of the token
+type smtpOAuth struct {
+	sasl.Server
+	mailbox string
+}
+
+func (a *smtpOAuth) Next(response []byte) (challenge []byte, done bool, err error) {
+	challenge, done, err = a.Server.Next(response)
+	var smtpErr smtpd.Error
+	if err != nil && !errors.As(err, &smtpErr) {
+		// Malformed client responses
+		err = smtpd.Error{Code: 501, Message: "5.5.2 " + err.Error()}
+	}
+	return challenge, done, err
+}
+
+func (a *smtpOAuth) Username() string {
+	return a.mailbox
+}
+
+// authError maps authentication errors to SMTP replies
+func (w wrap) authError(username string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errLockedOut):
+		return smtpd.Error{Code: 454, Message: "4.7.0 Too many failed logins, try again later"}
+	case errors.Is(err, backend.ErrInvalidCredentials):
+		return smtpd.Error{Code: 535, Message: "5.7.8 Authentication credentials invalid"}
+	}
+	w.logger.Error("Failed to authenticate", zap.String("username", username), zap.Error(err))
+	return smtpd.Error{Code: 454, Message: "4.7.0 Temporary authentication failure"}
 }
 
 func (w wrap) mailHandler(peer smtpd.Peer, env smtpd.Envelope) (err error) {
@@ -221,7 +345,11 @@ func (w wrap) mailHandler(peer smtpd.Peer, env smtpd.Envelope) (err error) {
 	defer func() {
 		if err != nil {
 			logger.Error(errors.Wrap(err, "failed to handle mail").Error(), zap.Error(err))
-			if !errors.Is(err, smtpd.Error{}) {
+			var smtpErr smtpd.Error
+			if errors.As(err, &smtpErr) {
+				// smtpd only replies with the code of an unwrapped Error
+				err = smtpErr
+			} else {
 				err = smtpd.Error{Code: 500, Message: "Internal server error"}
 			}
 		} else {
@@ -243,12 +371,21 @@ func (w wrap) mailHandler(peer smtpd.Peer, env smtpd.Envelope) (err error) {
 	}
 
 	// Sender on this server
-	if peer.Username != "" {
+	if w.relayAllowed(peer) {
 		return w.forward(peer, env)
 	}
 
 	// Recipients on this server
+	verdict := authenticate(context.Background(), w.dns, peer, env)
+	logger.Info("authenticated sender", zap.String("spf", string(verdict.SPF)), zap.String("dkim", verdict.dkimSummary()), zap.String("dmarc", string(verdict.DMARC)), zap.Bool("authenticated", verdict.SenderAuthenticated()))
+	env.Data = stripAuthenticationResults(env.Data, *hostName)
+	PrefixLine(&env, []byte(verdict.header(*hostName)))
+	if verdict.Disposition == dmarc.PolicyReject {
+		return smtpd.Error{Code: 550, Message: fmt.Sprintf("5.7.1 Rejected by DMARC policy of %s", verdict.FromDomain)}
+	}
+
 	var errs []error
+	delivered := 0
 	for _, rec := range env.Recipients {
 		addr, err := mail.ParseAddress(rec)
 		if err != nil {
@@ -256,9 +393,12 @@ func (w wrap) mailHandler(peer smtpd.Peer, env smtpd.Envelope) (err error) {
 			logger.Warn("failed to parse recipient", zap.String("recipient", rec))
 			continue
 		}
-		if strings.HasSuffix(addr.Address, *domain) {
-			if err := w.deliver(addr.Address, env); err != nil {
+		if isServedDomain(addressDomain(addr.Address)) {
+			if err := w.deliver(addr.Address, env, verdict); err != nil {
 				errs = append(errs, errors.Wrap(err, "deliver failed"))
+				logger.Warn("failed to deliver", zap.String("recipient", addr.Address), zap.Error(err))
+			} else {
+				delivered++
 			}
 		} else {
 			// Error because we are not an open relay:
@@ -266,15 +406,20 @@ func (w wrap) mailHandler(peer smtpd.Peer, env smtpd.Envelope) (err error) {
 			errs = append(errs, smtpd.Error{Code: 451, Message: "Bad recipient address. We are no open relay."})
 		}
 	}
-	if len(errs) > 0 {
+	if len(errs) > 0 && delivered == 0 {
 		return errs[0]
 	}
+	if len(errs) > 0 {
+		// After DATA there is one reply for all recipients: rejecting would
+		// make the sender retry the recipients that already got the mail
+		logger.Warn("accepted mail for some of the recipients", zap.Int("delivered", delivered), zap.Int("failed", len(errs)))
+	}
 
 	return nil
 }
 
 // deliver handles inbox
-func (w wrap) deliver(recipientEmail string, env smtpd.Envelope) (err error) {
+func (w wrap) deliver(recipientEmail string, env smtpd.Envelope, verdict authVerdict) (err error) {
 	be, err := FirestoreBackend(context.Background())
 	if err != nil {
 		return err
@@ -288,99 +433,100 @@ func (w wrap) deliver(recipientEmail string, env smtpd.Envelope) (err error) {
 	}
 
 	w.logger.Debug("User exists", zap.String("recipient", recipientEmail))
-	if err = os.MkdirAll(path.Join("mails", emailUserName(recipientEmail)), 0777); err != nil {
-		return errors.Wrap(err, "failed to make inbox")
-	}
 
-	var u backend.User
-	u, err = store.NewUser(path.Join("mails", emailUserName(recipientEmail)), emailUserName(recipientEmail), "")
-	u = &loggingBackendUser{u, w.logger}
-	if err != nil {
+	// DMARC quarantine: no payment, no bounce
+	if verdict.Disposition == dmarc.PolicyQuarantine {
+		w.logger.Info("Delivering email to Junk by DMARC policy", zap.String("recipient", recipientEmail), zap.String("from", verdict.FromDomain))
+		_, err = w.mails.Append(recipientEmail, "Junk", nil, time.Now(), env.Data)
 		return err
 	}
 
-	// TODO subtract payment & forward, or place in quarantine & bounce
-	isPaid := false
-
-	if !isPaid {
-		defer func() {
-			// HACK mechanism to get the createdEmail from stupid library mailbox.CreateMessage
-			var createdMail noErrMailCreated
-			if errors.As(err, &createdMail) {
-				err = nil // reset because it was no real error
-			}
-
-			uuid := uuid.NewRandom().String()
-			err = w.fb.QuarantineEmail(recipientEmail, fmt.Sprintf("%d-%s", createdMail.Uid, uuid), env)
-			if err != nil {
-				w.logger.Error("Failed to quarantine email at firestore", zap.String("source", env.Sender), zap.Error(err))
-				return
-			}
-
-			view := template.Must(template.ParseFS(templateResources, "resources/bounce.txt"))
-			buf := bytes.NewBuffer(nil)
-			err = view.ExecuteTemplate(buf, "bounce.txt", map[string]interface{}{
-				"Uid":             uuid,
-				"Domain":          *domain,
-				"From":            "info@" + *domain,
-				"To":              env.Sender,
-				"ReplyTo":         recipientEmail,
-				"Recipients":      recipientEmail,
-				"OriginalSubject": mustGetSubject(env),
-				"Date":            time.Now().Format(time.RFC1123Z),
-				"MailSize":        fmt.Sprintf("%dB", createdMail.Size),
-				"Price":           fmt.Sprintf("$%.02f", 0.05),
-				"PaymentLink":     fmt.Sprintf("https://%s/pay/%s/%d-%s", *domain, emailUserName(recipientEmail), createdMail.Uid, uuid),
-			})
-			if err != nil {
-				w.logger.Error("Failed to create bounce email", zap.String("source", env.Sender), zap.Error(err))
-			}
-			bounce := smtpd.Envelope{
-				Sender:     "info@" + *domain,
-				Recipients: []string{env.Sender},
-				Data:       []byte(buf.Bytes())}
-			ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
-			defer cancel()
-			if err = w.emit(ctx, bounce); err != nil {
-				w.logger.Error("Failed to bounce for payment", zap.String("source", env.Sender), zap.Error(err))
-			}
-		}()
+	// Forged senders can neither pay nor be bounced to
+	authenticated := verdict.SenderAuthenticated()
+	decision := PaymentDecision{}
+	if authenticated {
+		decision, err = w.payments.Decide(newPaymentRequest(recipientEmail, env))
+		if err != nil {
+			w.logger.Error("Failed to decide payment, quarantining", zap.String("recipient", recipientEmail), zap.Error(err))
+			decision = PaymentDecision{Price: DefaultPricing.Price(env.Sender, len(env.Data), false)}
+		}
 	}
 
-	var mb backend.Mailbox
-	if isPaid {
-		mb, err = ensureMailbox(u, "INBOX", w.logger)
-	} else {
-		mb, err = ensureMailbox(u, "UNPAID", w.logger)
+	if decision.Paid {
+		w.logger.Info("Delivering paid email", zap.String("recipient", recipientEmail), zap.String("reason", decision.Reason), zap.Int64("amount", decision.Amount))
+		_, err = w.mails.Append(recipientEmail, "INBOX", nil, time.Now(), env.Data)
+		return err
 	}
+
+	createdMail, err := w.mails.Append(recipientEmail, "UNPAID", nil, time.Now(), env.Data)
 	if err != nil {
 		return err
 	}
-	return mb.CreateMessage(nil, time.Now(), envelopeLiteral{bytes.NewReader(env.Data), len(env.Data)})
-}
 
-func ensureMailbox(u backend.User, box string, logger *zap.Logger) (mb backend.Mailbox, err error) {
-	if box == "" {
-		return nil, os.MkdirAll(path.Join("mails", u.Username()), 0777)
-	}
-	err = os.MkdirAll(path.Join("mails", u.Username(), box), 0777)
-	if err == nil {
-		err = u.CreateMailbox(box)
-		if err != nil && err.Error() == "Mailbox already exists" {
-			err = nil
+	uuid := uuid.NewRandom().String()
+	err = w.fb.QuarantineEmail(recipientEmail, fmt.Sprintf("%d-%s", createdMail.UID, uuid), createdMail, env, verdict)
+	if err != nil {
+		w.logger.Error("Failed to quarantine email at firestore", zap.String("source", env.Sender), zap.Error(err))
+		// Without a record the janitor would never purge it, and the sender retries
+		if errDelete := w.mails.Delete(recipientEmail, "UNPAID", createdMail.UID, createdMail.UIDValidity); errDelete != nil {
+			w.logger.Error("Failed to remove unrecorded email", zap.String("recipient", recipientEmail), zap.Error(errDelete))
 		}
+		return err
 	}
-	if err == nil {
-		mb, err = u.GetMailbox(box)
+	if !authenticated {
+		w.logger.Info("Quarantined unauthenticated email without bounce", zap.String("source", env.Sender), zap.String("recipient", recipientEmail))
+		return nil
 	}
+
+	view := template.Must(template.ParseFS(templateResources, "resources/bounce.txt"))
+	buf := bytes.NewBuffer(nil)
+	err = view.ExecuteTemplate(buf, "bounce.txt", map[string]interface{}{
+		"Uid":             uuid,
+		"Domain":          *domain,
+		"From":            "info@" + *domain,
+		"To":              env.Sender,
+		"ReplyTo":         recipientEmail,
+		"Recipients":      recipientEmail,
+		"OriginalSubject": mustGetSubject(env),
+		"Date":            time.Now().Format(time.RFC1123Z),
+		"MailSize":        fmt.Sprintf("%dB", createdMail.Size),
+		"Price":           formatPrice(decision.Price),
+		"PaymentLink":     fmt.Sprintf("https://%s/pay/%s/%d-%s", *domain, url.PathEscape(payUser(recipientEmail)), createdMail.UID, uuid),
+	})
 	if err != nil {
-		logger.Warn("Failed to create mailbox", zap.String("source", u.Username()), zap.Error(err), zap.String("mailbox", box))
+		// The mail is already quarantined, rejecting it would make the sender retry
+		w.logger.Error("Failed to create bounce email", zap.String("source", env.Sender), zap.Error(err))
+		return nil
 	}
-	return
+	bounce := smtpd.Envelope{
+		Sender:     "info@" + *domain,
+		Recipients: []string{env.Sender},
+		Data:       []byte(buf.Bytes())}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+	if err = w.emit(ctx, bounce); err != nil {
+		w.logger.Error("Failed to bounce for payment", zap.String("source", env.Sender), zap.Error(err))
+	}
+	return nil
+}
+
+// errForeignSender rejects mail of users that is not from their own domain,
+// which the DKIM signature would otherwise vouch for
+var errForeignSender = smtpd.Error{Code: 553, Message: "5.7.1 Sender address is not in the domain of the authenticated user"}
+
+// ownDomain tells whether the peer may send mail from the domain: that of the
+// mailbox it authenticated as. Relays of allowed networks have no mailbox and
+// an empty domain, as of a bounce, has nothing to check.
+func ownDomain(peer smtpd.Peer, domain string) bool {
+	return peer.Username == "" || domain == "" || domain == addressDomain(peer.Username)
 }
 
 // forward handles outbox
 func (w wrap) forward(peer smtpd.Peer, env smtpd.Envelope) error {
+	if from := fromDomain(env.Data); !ownDomain(peer, addressDomain(env.Sender)) || !ownDomain(peer, from) {
+		w.logger.Warn("Submission from another domain", zap.String("sender_address", env.Sender), zap.String("from_domain", from), zap.String("user", peer.Username))
+		return errForeignSender
+	}
 	err := w.dkim(&env)
 	if err != nil {
 		return errors.Wrap(err, "failed to generated DKIM signer")
@@ -390,35 +536,59 @@ func (w wrap) forward(peer smtpd.Peer, env smtpd.Envelope) error {
 	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
 	defer cancel()
 
+	// Forwarded mail keeps the authentication results of when it reached us
+	if err = w.arc(ctx, peer, &env); err != nil {
+		w.logger.Warn("Failed to ARC seal", zap.String("sender", peer.Username), zap.Error(err))
+	}
+
 	// Move it to sent folder
 	defer func() {
-		var user backend.User
-		user, err := store.NewUser(path.Join("mails", emailUserName(peer.Username)), emailUserName(peer.Username), peer.Password)
-		if err != nil {
-			w.logger.Error(err.Error(), zap.Error(err))
-			return
-		}
-		user = &loggingBackendUser{user, w.logger}
-		mb, err := ensureMailbox(user, "Sent", w.logger)
-		if err != nil {
-			w.logger.Error(err.Error(), zap.Error(err))
+		if peer.Username == "" {
+			// Relayed for an allowed network, there is no mailbox
 			return
 		}
-		err = mb.CreateMessage(
-			[]string{"\\Seen"}, time.Now(),
-			envelopeLiteral{bytes.NewReader(env.Data), len(env.Data)})
+		_, err := w.mails.Append(peer.Username, "Sent", []string{"\\Seen"}, time.Now(), env.Data)
 		if err != nil {
 			w.logger.Error(err.Error(), zap.Error(err))
 			return
 		}
 	}()
 
-	return w.emit(ctx, env)
+	if err = w.emit(ctx, env); err != nil {
+		return err
+	}
+
+	// People the user writes to can write back without paying
+	var entries []string
+	for _, rec := range env.Recipients {
+		if entry, err := normalizeAllowlistEntry(rec); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) > 0 && peer.Username != "" {
+		if err = w.fb.AddToAllowlist(peer.Username, entries...); err != nil {
+			w.logger.Warn("Failed to add recipients to allowlist", zap.String("mailbox", peer.Username), zap.Error(err))
+		}
+	}
+
+	// Replies of the recipients to this mail are free
+	if header, err := getHeader(env); err == nil && peer.Username != "" {
+		if id, _ := header.MessageID(); id != "" {
+			if err = w.fb.MarkThreadSent(peer.Username, id, env.Recipients); err != nil {
+				w.logger.Warn("Failed to record sent thread", zap.String("mailbox", peer.Username), zap.Error(err))
+			}
+		}
+	}
+	return nil
 }
 
-// DKIM
+// DKIM signs for the From domain, or the sender domain without From
 func (w wrap) dkim(env *smtpd.Envelope) error {
-	signer, err := w.getSigner()
+	signDomain := fromDomain(env.Data)
+	if signDomain == "" {
+		signDomain = addressDomain(env.Sender)
+	}
+	signer, err := w.getSigner(signDomain)
 	if err != nil {
 		return err
 	}
@@ -434,24 +604,28 @@ func (w wrap) dkim(env *smtpd.Envelope) error {
 	return nil
 }
 
+// ARC
+func (w wrap) arc(ctx context.Context, peer smtpd.Peer, env *smtpd.Envelope) error {
+	if w.signOptions == nil {
+		return nil
+	}
+	opts, err := w.signOptions()
+	if err != nil {
+		return err
+	}
+	data, err := arcSeal(ctx, w.dns, opts, *hostName, env.Data, time.Now(), &authres.AuthResult{Value: authres.ResultPass, Auth: peer.Username})
+	if err != nil {
+		return err
+	}
+	env.Data = data
+	return nil
+}
+
 func generateUUID() string {
 	uniqueID := uuid.NewRandom()
 	return uniqueID.String()
 }
 
-type envelopeLiteral struct {
-	io.Reader
-	len int
-}
-
-func (e envelopeLiteral) Len() int {
-	return e.len
-}
-
-func (e envelopeLiteral) Read(b []byte) (n int, err error) {
-	return e.Reader.Read(b)
-}
-
 func mustGetSubject(env smtpd.Envelope) string {
 	header, _ := getHeader(env)
 	subj, _ := header.Subject()
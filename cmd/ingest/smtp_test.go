@@ -1,39 +1,132 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
 	"strings"
 	"testing"
 
 	"github.com/chrj/smtpd"
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
-func TestMailHandler(t *testing.T) {
-	env := smtpd.Envelope{
-		Sender:     "hermanbanken@gmail.com",
-		Recipients: []string{"herman@ptsm.hermanbanken.nl"},
-		Data:       []byte("Received: from mail-ed1-f43.google.com ([209.85.208.43]) by localhost.localdomain\r\n\twith ESMTP;\r\n\tFri, 21 Oct 2022 14:59:59 +0000 (UTC)\r\nReceived: by mail-ed1-f43.google.com with SMTP id m16so6874440edc.4\n        for <herman@ptsm.hermanbanken.nl>; Fri, 21 Oct 2022 07:59:59 -0700 (PDT)\nDKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\n        d=gmail.com; s=20210112;\n        h=to:subject:message-id:date:from:mime-version:from:to:cc:subject\n         :date:message-id:reply-to;\n        bh=JImGYayboS+aa+UFjQ2Gcm2T5RCchiP3q2SJjhSlt64=;\n        b=kAFNBq9UfhEZ/MmTdxaWFXZH7MRE+zQt99skGwZc+YY6baL7nza/eRfnwpr4aQKmeI\n         UMaILR9s+GDSx0RdwLZx6wNh5tOEVDdDTV16potBEQe9r6opOjlDABfNt9B38vuaeYxq\n         Z8MqyeP38pQw0B9aD6U9Yu9/s2wG3a3tTJa1qNvQOlbkgSSdVvRNJM11Auzp4VPxxGN/\n         HZYVbDA727cErv84DPW6QKQWfyZURnH8NVcdDg1coapZsPz8l+LVNcAY2CAYUzaErEET\n         aMC8lR4X5cEbQn14+12lXsMP6SotNgY6B2AHgKdnur7w5e/1vO2LPFQSBayrTKexr/hd\n         5WJw==\nX-Google-DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;\n        d=1e100.net; s=20210112;\n        h=to:subject:message-id:date:from:mime-version:x-gm-message-state\n         :from:to:cc:subject:date:message-id:reply-to;\n        bh=JImGYayboS+aa+UFjQ2Gcm2T5RCchiP3q2SJjhSlt64=;\n        b=1Nf6TeO9Q0z260C3vTGck+cz97NC1KaJkF+5PviMv0X7dMFaDkLQyIIatcIMtHeQ0U\n         HC9g0hfcYtLq6RcbiWTWGGvI5fcvRBV9WLu4RRuT4pWRUSk/JE+r5lx4OrDHbRuSX+N6\n         h8ITEU0B2B0yio2stoN+/oKVU90XmGP0MCOyWMuXYYTYXUJ8ngq6Jn1o6K3JfKonyt9e\n         GwSBZbEm9tr5x0OJYByu9cvC3AUL3y3u+5o7MsfCRXs5Xuhfposur564X561qYOIC5iu\n         6P6Cpo9Vbibb4G/JzVpLwmeQJnjazmiJyL3As2G0QR8qOcWGe+wCZlUuHorgkRrA9/44\n         NIyQ==\nX-Gm-Message-State: ACrzQf3tO6ah60NFO9oJudD4UaFJxiUMY+qchnm1CFWFbAy8q5PelPfM\n\t/FIuWvmdzxji8QptjUkh0gycB22U1AQ/JxREm9PhMpO1\nX-Google-Smtp-Source: AMsMyM6OEg1WwCBzGXLdITVr+Xjrm+AnHetcjlxiCwKKDfWQ0+eAdeIP5J4LjRMNK4EaiX2AH3GnUPQ3k9bKLmkBG4w=\nX-Received: by 2002:a05:6402:501b:b0:459:df91:983 with SMTP id\n p27-20020a056402501b00b00459df910983mr17043924eda.85.1666364398530; Fri, 21\n Oct 2022 07:59:58 -0700 (PDT)\nMIME-Version: 1.0\nFrom: Herman Banken <hermanbanken@gmail.com>\nDate: Fri, 21 Oct 2022 16:59:47 +0200\nMessage-ID: <CAKZLU9s5yCEbwNigD-6KQzKod-bgcwXBe7BewyH7USrG_+TCUg@mail.gmail.com>\nSubject: Second email test\nTo: herman@ptsm.hermanbanken.nl\nContent-Type: multipart/alternative; boundary=\"0000000000000a734005eb8cb29a\"\n\n--0000000000000a734005eb8cb29a\nContent-Type: text/plain; charset=\"UTF-8\"\n\nFingerscrossed!\n\nMet vriendelijke groet,\n\nSpammer\n\n--0000000000000a734005eb8cb29a\nContent-Type: text/html; charset=\"UTF-8\"\n\n<div dir=\"ltr\">Fingerscrossed!<div><br clear=\"all\"><div><div dir=\"ltr\" class=\"gmail_signature\" data-smartmail=\"gmail_signature\"><div dir=\"ltr\"><div><div dir=\"ltr\">Met vriendelijke groet,<br><br><div>Spammer</div></div></div></div></div></div></div></div>\n\n--0000000000000a734005eb8cb29a--\n"),
+// signedMail signs a mail from the domain with a fresh key that is published in dns
+func signedMail(t *testing.T, dns fakeResolver, from string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	domain := from[strings.LastIndex(from, "@")+1:]
+	dns.txt["test._domainkey."+domain] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}
+
+	msg := "From: Sender <" + from + ">\r\nTo: herman@ptsm.hermanbanken.nl\r\nSubject: Second email test\r\nMessage-ID: <1@" + domain + ">\r\n\r\nFingerscrossed!\r\n"
+	var out bytes.Buffer
+	assert.NoError(t, dkim.Sign(&out, strings.NewReader(msg), &dkim.SignOptions{Domain: domain, Selector: "test", Signer: key}))
+	return out.Bytes()
+}
+
+func TestAuthenticateDMARC(t *testing.T) {
+	dns := fakeResolver{
+		txt: map[string][]string{
+			"example.org":               {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"_dmarc.example.org":        {"v=DMARC1; p=reject"},
+			"_dmarc.quarantine.example": {"v=DMARC1; p=reject; sp=quarantine; adkim=s"},
+			"_dmarc.relaxed.example":    {"v=DMARC1; p=none"},
+		},
+	}
+	signed := signedMail(t, dns, "a@example.org")
+	subdomain := signedMail(t, dns, "a@mail.quarantine.example")
+	relaxed := signedMail(t, dns, "a@relaxed.example")
+	unknown := signedMail(t, dns, "a@unknown.example")
+	tampered := bytes.Replace(signed, []byte("Fingerscrossed"), []byte("Pay me now"), 1)
+
+	for _, tc := range []struct {
+		name        string
+		ip          string
+		sender      string
+		data        []byte
+		dmarc       authres.ResultValue
+		disposition dmarc.Policy
+	}{
+		{"dkim aligned", "198.51.100.1", "bounces@example.org", signed, authres.ResultPass, ""},
+		{"spf aligned", "192.0.2.1", "a@example.org", tampered, authres.ResultPass, ""},
+		{"dkim with unaligned spf", "192.0.2.1", "a@example.org", relaxed, authres.ResultPass, ""},
+		{"tampered", "198.51.100.1", "a@example.org", tampered, authres.ResultFail, dmarc.PolicyReject},
+		{"policy none", "198.51.100.1", "a@example.org", bytes.Replace(relaxed, []byte("Fingerscrossed"), []byte("x"), 1), authres.ResultFail, ""},
+		{"no policy", "198.51.100.1", "a@unknown.example", unknown, authres.ResultNone, ""},
+	} {
+		peer := smtpd.Peer{HeloName: "mail.example.org", Addr: &net.TCPAddr{IP: net.ParseIP(tc.ip)}}
+		v := authenticate(context.Background(), dns, peer, smtpd.Envelope{Sender: tc.sender, Data: tc.data})
+		assert.Equal(t, tc.dmarc, v.DMARC, tc.name)
+		assert.Equal(t, tc.disposition, v.Disposition, tc.name)
 	}
-	r := strings.NewReader(string(env.Data))
 
-	verifications, err := dkim.Verify(r)
-	if err != nil {
-		log.Fatal(err)
+	// Signed by the organizational domain, but adkim=s requires the exact subdomain
+	peer := smtpd.Peer{HeloName: "mail.example.org", Addr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1")}}
+	bad := bytes.Replace(subdomain, []byte("Fingerscrossed"), []byte("x"), 1)
+	v := authenticate(context.Background(), dns, peer, smtpd.Envelope{Sender: "a@mail.quarantine.example", Data: bad})
+	assert.Equal(t, dmarc.Policy(dmarc.PolicyQuarantine), v.Disposition)
+	assert.Equal(t, "mail.quarantine.example", v.FromDomain)
+}
+
+func TestAuthenticationResultsHeader(t *testing.T) {
+	v := authVerdict{SPF: SPFPass, SPFDomain: "example.org", DKIM: []dkimResult{{Domain: "example.org", Pass: true}}, FromDomain: "example.org", DMARC: authres.ResultPass}
+	header := v.header("mx.example.net")
+	assert.True(t, strings.HasPrefix(header, "Authentication-Results: mx.example.net; "))
+	assert.True(t, strings.HasSuffix(header, "\r\n"))
+
+	identity, results, err := authres.Parse(strings.TrimSuffix(strings.TrimPrefix(header, "Authentication-Results: "), "\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mx.example.net", identity)
+	assert.Equal(t, []authres.Result{
+		&authres.SPFResult{Value: authres.ResultPass, From: "example.org"},
+		&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.org"},
+		&authres.DMARCResult{Value: authres.ResultPass, From: "example.org"},
+	}, results)
+}
+
+func TestStripAuthenticationResults(t *testing.T) {
+	data := "Received: from x\r\nAuthentication-Results: mx.example.net;\r\n\tdmarc=pass header.from=example.org\r\nauthentication-results: other.example; spf=fail\r\nSubject: hi\r\n\r\nAuthentication-Results: mx.example.net; body\r\n"
+	assert.Equal(t,
+		"Received: from x\r\nauthentication-results: other.example; spf=fail\r\nSubject: hi\r\n\r\nAuthentication-Results: mx.example.net; body\r\n",
+		string(stripAuthenticationResults([]byte(data), "mx.example.net")))
+}
+
+func TestForwardForeignSender(t *testing.T) {
+	w := wrap{logger: zap.NewNop(), getSigner: func(signDomain string) (*dkim.Signer, error) {
+		t.Fatalf("signed for %s", signDomain)
+		return nil, nil
+	}}
+	user := smtpd.Peer{Username: "herman@example.org"}
+	for _, env := range []smtpd.Envelope{
+		{Sender: "herman@example.org", Recipients: []string{"a@example.net"}, Data: []byte("From: <ceo@example.net>\r\nSubject: Hi\r\n\r\nHello\r\n")},
+		{Sender: "ceo@example.net", Recipients: []string{"a@example.net"}, Data: []byte("From: <herman@example.org>\r\nSubject: Hi\r\n\r\nHello\r\n")},
+	} {
+		assert.Equal(t, errForeignSender, w.forward(user, env))
 	}
+}
 
-	for _, v := range verifications {
-		if v.Err == nil {
-			log.Println("Valid signature for:", v.Domain)
-		} else {
-			t.Fail()
-			log.Println("Invalid signature for:", v.Domain, v.Err)
-		}
-		rec, err := dmarc.Lookup(v.Domain)
-		_ = err
-		if rec.Policy == dmarc.PolicyReject {
-			log.Println("TODO Reject email")
-		}
+func TestMailHandler(t *testing.T) {
+	dns := fakeResolver{txt: map[string][]string{"_dmarc.gmail.com": {"v=DMARC1; p=reject"}}}
+	data := signedMail(t, dns, "hermanbanken@gmail.com")
+	w := wrap{logger: zap.NewNop(), dns: dns}
+	peer := smtpd.Peer{HeloName: "mail-ed1-f43.google.com", Addr: &net.TCPAddr{IP: net.ParseIP("209.85.208.43")}}
+
+	// Forged mail is rejected before it is delivered
+	env := smtpd.Envelope{
+		Sender:     "hermanbanken@gmail.com",
+		Recipients: []string{"herman@ptsm.hermanbanken.nl"},
+		Data:       bytes.Replace(data, []byte("Fingerscrossed"), []byte("Spammer"), 1),
 	}
+	err := w.mailHandler(peer, env)
+	assert.Equal(t, 550, err.(smtpd.Error).Code)
 }
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPF (RFC 7208) evaluation of the peer IP for the envelope sender
+
+type spfResult string
+
+const (
+	SPFNone      spfResult = "none"
+	SPFNeutral   spfResult = "neutral"
+	SPFPass      spfResult = "pass"
+	SPFFail      spfResult = "fail"
+	SPFSoftFail  spfResult = "softfail"
+	SPFTempError spfResult = "temperror"
+	SPFPermError spfResult = "permerror"
+)
+
+// spfLookupLimit is the maximum of DNS querying mechanisms (RFC 7208 §4.6.4)
+const spfLookupLimit = 10
+
+// resolver is the DNS used to authenticate mail, replaceable in tests
+type resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+var _ resolver = net.DefaultResolver
+
+var (
+	errSPFLookupLimit = errors.New("spf: too many DNS lookups")
+	errSPFMultiple    = errors.New("spf: multiple records")
+)
+
+type spfChecker struct {
+	ctx     context.Context
+	dns     resolver
+	ip      net.IP
+	sender  string
+	helo    string
+	lookups int
+}
+
+// checkSPF evaluates the SPF policy of the domain of the sender for the ip.
+// The HELO name is used when the sender is empty, as it is for bounces.
+func checkSPF(ctx context.Context, dns resolver, ip net.IP, sender, helo string) (spfResult, string) {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+	c := &spfChecker{ctx: ctx, dns: dns, ip: ip, sender: sender, helo: helo}
+	res, err := c.check(domain)
+	if err != nil && res == "" {
+		res = SPFPermError
+	}
+	return res, domain
+}
+
+func (c *spfChecker) check(domain string) (spfResult, error) {
+	record, err := c.record(domain)
+	if errors.Is(err, errSPFMultiple) {
+		return SPFPermError, err
+	}
+	if err != nil {
+		return SPFTempError, err
+	}
+	if record == "" {
+		return SPFNone, nil
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, isModifier := strings.Cut(term, "="); isModifier && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+
+		match, res, err := c.mechanism(domain, term)
+		if err != nil {
+			if res == "" {
+				res = SPFPermError
+			}
+			return res, err
+		}
+		if match {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		if c.lookups++; c.lookups > spfLookupLimit {
+			return SPFPermError, errSPFLookupLimit
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return SPFPermError, err
+		}
+		res, err := c.check(target)
+		if res == SPFNone {
+			res = SPFPermError
+		}
+		return res, err
+	}
+	return SPFNeutral, nil
+}
+
+// record fetches the "v=spf1" TXT record of the domain
+func (c *spfChecker) record(domain string) (string, error) {
+	txts, err := c.dns.LookupTXT(c.ctx, domain)
+	if isNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, txt := range txts {
+		if txt == "v=spf1" || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			found = append(found, txt)
+		}
+	}
+	if len(found) > 1 {
+		return "", errSPFMultiple
+	}
+	if len(found) == 0 {
+		return "", nil
+	}
+	return found[0], nil
+}
+
+// mechanism tells if the mechanism matches the ip
+func (c *spfChecker) mechanism(domain, term string) (bool, spfResult, error) {
+	name, arg, _ := strings.Cut(term, ":")
+	name, cidr, _ := strings.Cut(name, "/")
+	if cidr != "" {
+		// a/24 and mx/24 without domain
+		arg = "/" + cidr
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, "", nil
+
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, SPFPermError, fmt.Errorf("spf: invalid %s %q", name, arg)
+		}
+		return network.Contains(c.ip), "", nil
+
+	case "include":
+		if c.lookups++; c.lookups > spfLookupLimit {
+			return false, SPFPermError, errSPFLookupLimit
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+		res, err := c.check(target)
+		switch res {
+		case SPFPass:
+			return true, "", nil
+		case SPFTempError:
+			return false, SPFTempError, err
+		case SPFPermError, SPFNone:
+			return false, SPFPermError, fmt.Errorf("spf: include of %s failed: %v", target, err)
+		}
+		return false, "", nil
+
+	case "a", "mx":
+		if c.lookups++; c.lookups > spfLookupLimit {
+			return false, SPFPermError, errSPFLookupLimit
+		}
+		target, masks, _ := strings.Cut(arg, "/")
+		if target == "" {
+			target = domain
+		} else {
+			var err error
+			if target, err = c.expand(target, domain); err != nil {
+				return false, SPFPermError, err
+			}
+		}
+		ip4mask, ip6mask := 32, 128
+		if masks != "" {
+			m4, m6, dual := strings.Cut(masks, "//")
+			if dual {
+				masks = m4
+				ip6mask, _ = strconv.Atoi(m6)
+			}
+			if masks != "" {
+				ip4mask, _ = strconv.Atoi(masks)
+			}
+		}
+
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := c.dns.LookupMX(c.ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, SPFTempError, err
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := c.dns.LookupIPAddr(c.ctx, host)
+			if err != nil && !isNotFound(err) {
+				return false, SPFTempError, err
+			}
+			for _, addr := range addrs {
+				mask := net.CIDRMask(ip4mask, 32)
+				if addr.IP.To4() == nil {
+					mask = net.CIDRMask(ip6mask, 128)
+				}
+				if addr.IP.Mask(mask).Equal(c.ip.Mask(mask)) {
+					return true, "", nil
+				}
+			}
+		}
+		return false, "", nil
+
+	case "exists":
+		if c.lookups++; c.lookups > spfLookupLimit {
+			return false, SPFPermError, errSPFLookupLimit
+		}
+		target, err := c.expand(arg, domain)
+		if err != nil {
+			return false, SPFPermError, err
+		}
+		addrs, err := c.dns.LookupIPAddr(c.ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, SPFTempError, err
+		}
+		return len(addrs) > 0, "", nil
+
+	case "ptr":
+		// Deprecated (RFC 7208 §5.5), we never match it
+		c.lookups++
+		return false, "", nil
+	}
+	return false, SPFPermError, fmt.Errorf("spf: unknown mechanism %q", term)
+}
+
+// expand replaces the macros (RFC 7208 §7) in a domain spec
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("spf: invalid macro in %q", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end < 2 {
+				return "", fmt.Errorf("spf: invalid macro in %q", spec)
+			}
+			value, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", fmt.Errorf("spf: %v in %q", err, spec)
+			}
+			out.WriteString(value)
+			i += end
+		default:
+			return "", fmt.Errorf("spf: invalid macro in %q", spec)
+		}
+	}
+	return out.String(), nil
+}
+
+// macro expands the body of a %{...} macro: the letter, optionally followed
+// by the number of rightmost parts to keep, "r" to reverse the parts, and the
+// delimiters to split on (RFC 7208 §7.3). Uppercase letters are URL escaped.
+func (c *spfChecker) macro(body, domain string) (string, error) {
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+	if local == "" {
+		local = "postmaster"
+	}
+	var value string
+	switch strings.ToLower(body[:1]) {
+	case "s":
+		value = c.sender
+	case "l":
+		value = local
+	case "o":
+		value = senderDomain
+	case "d":
+		value = domain
+	case "h":
+		value = c.helo
+	case "i":
+		value = macroIP(c.ip)
+	case "v":
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		} else {
+			value = "ip6"
+		}
+	default:
+		return "", errors.New("unsupported macro")
+	}
+
+	rest := body[1:]
+	keep := 0
+	if digits := len(rest) - len(strings.TrimLeft(rest, "0123456789")); digits > 0 {
+		n, err := strconv.Atoi(rest[:digits])
+		if err != nil || n == 0 {
+			return "", errors.New("invalid macro transformer")
+		}
+		keep, rest = n, rest[digits:]
+	}
+	reverse := false
+	if rest != "" && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse, rest = true, rest[1:]
+	}
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", errors.New("invalid macro delimiter")
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+
+	if body[0] >= 'A' && body[0] <= 'Z' {
+		value = macroEscape(value)
+	}
+	return value, nil
+}
+
+// macroEscape URL escapes all but the unreserved characters, as uppercase macros are
+func macroEscape(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("-._~", b) >= 0 {
+			out.WriteByte(b)
+		} else {
+			fmt.Fprintf(&out, "%%%02X", b)
+		}
+	}
+	return out.String()
+}
+
+// macroIP formats the ip like the %{i} macro: dotted nibbles for IPv6
+func macroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	var parts []string
+	for _, b := range ip.To16() {
+		parts = append(parts, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+	}
+	return strings.Join(parts, ".")
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver answers DNS queries from memory
+type fakeResolver struct {
+	txt map[string][]string
+	ip  map[string][]string
+	mx  map[string][]*net.MX
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) (out []net.IPAddr, err error) {
+	ips, ok := r.ip[host]
+	if !ok {
+		return nil, notFound(host)
+	}
+	for _, ip := range ips {
+		out = append(out, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return out, nil
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, notFound(name)
+}
+
+var _ resolver = fakeResolver{}
+
+func TestCheckSPF(t *testing.T) {
+	dns := fakeResolver{
+		txt: map[string][]string{
+			"example.org":      {"google-site-verification=x", "v=spf1 ip4:192.0.2.0/24 a:relay.example.org mx include:_spf.example.net ~all"},
+			"_spf.example.net": {"v=spf1 ip6:2001:db8::/32 -all"},
+			"redirect.example": {"v=spf1 redirect=example.org"},
+			"strict.example":   {"v=spf1 exists:%{i}.allow.strict.example -all"},
+			"broken.example":   {"v=spf1 include:nowhere.example -all"},
+			"loop.example":     {"v=spf1 include:loop.example -all"},
+			"double.example":   {"v=spf1 -all", "v=spf1 +all"},
+		},
+		ip: map[string][]string{
+			"relay.example.org":                 {"198.51.100.7"},
+			"mx.example.org":                    {"203.0.113.9"},
+			"203.0.113.10.allow.strict.example": {"127.0.0.2"},
+		},
+		mx: map[string][]*net.MX{
+			"example.org": {{Host: "mx.example.org", Pref: 10}},
+		},
+	}
+
+	for _, tc := range []struct {
+		ip     string
+		sender string
+		result spfResult
+	}{
+		{"192.0.2.55", "a@example.org", SPFPass},
+		{"198.51.100.7", "a@example.org", SPFPass},
+		{"203.0.113.9", "a@example.org", SPFPass},
+		{"2001:db8::1", "a@example.org", SPFPass},
+		{"198.51.100.8", "a@example.org", SPFSoftFail},
+		{"192.0.2.55", "a@redirect.example", SPFPass},
+		{"198.51.100.8", "a@redirect.example", SPFSoftFail},
+		{"203.0.113.10", "a@strict.example", SPFPass},
+		{"203.0.113.11", "a@strict.example", SPFFail},
+		{"192.0.2.55", "a@broken.example", SPFPermError},
+		{"192.0.2.55", "a@loop.example", SPFPermError},
+		{"192.0.2.55", "a@double.example", SPFPermError},
+		{"192.0.2.55", "a@unknown.example", SPFNone},
+		{"192.0.2.55", "", SPFPass},
+	} {
+		res, _ := checkSPF(context.Background(), dns, net.ParseIP(tc.ip), tc.sender, "example.org")
+		assert.Equal(t, tc.result, res, "%s from %s", tc.sender, tc.ip)
+	}
+}
+
+func TestSPFMacros(t *testing.T) {
+	// The examples of RFC 7208 §7.4
+	c := &spfChecker{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	for spec, want := range map[string]string{
+		"%{s}":                  "strong-bad@email.example.com",
+		"%{o}":                  "email.example.com",
+		"%{d}":                  "email.example.com",
+		"%{d4}":                 "email.example.com",
+		"%{d3}":                 "email.example.com",
+		"%{d2}":                 "example.com",
+		"%{d1}":                 "com",
+		"%{dr}":                 "com.example.email",
+		"%{d2r}":                "example.email",
+		"%{l}":                  "strong-bad",
+		"%{l-}":                 "strong.bad",
+		"%{lr}":                 "strong-bad",
+		"%{lr-}":                "bad.strong",
+		"%{l1r-}":               "strong",
+		"%{ir}.%{v}._spf.%{d2}": "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":  "bad.strong.lp._spf.example.com",
+		"%{S}":                  "strong-bad%40email.example.com",
+		"%{h}%%%_%-":            "mx.example.org% %20",
+	} {
+		got, err := c.expand(spec, "email.example.com")
+		assert.NoError(t, err, spec)
+		assert.Equal(t, want, got, spec)
+	}
+
+	for _, spec := range []string{"%{d0}", "%{dx}", "%{d2r;}", "%{x}", "%{}", "%{d", "%x", "%"} {
+		_, err := c.expand(spec, "email.example.com")
+		assert.Error(t, err, spec)
+	}
+
+	ip6 := &spfChecker{ip: net.ParseIP("2001:db8::cb01"), sender: "@example.com"}
+	got, err := ip6.expand("%{ir}.%{v}.%{l}", "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.postmaster", got)
+}
+
+func TestSenderAuthenticated(t *testing.T) {
+	assert.True(t, authVerdict{SPF: SPFPass, SPFDomain: "example.org", SenderDomain: "example.org"}.SenderAuthenticated())
+	assert.False(t, authVerdict{SPF: SPFSoftFail, SPFDomain: "example.org", SenderDomain: "example.org"}.SenderAuthenticated())
+	assert.True(t, authVerdict{SPF: SPFNone, SenderDomain: "example.co.uk", DKIM: []dkimResult{{Domain: "mail.example.co.uk", Pass: true}}}.SenderAuthenticated())
+	assert.False(t, authVerdict{SPF: SPFNone, SenderDomain: "example.co.uk", DKIM: []dkimResult{{Domain: "other.co.uk", Pass: true}}}.SenderAuthenticated())
+	assert.False(t, authVerdict{SPF: SPFNone, SenderDomain: "example.org", DKIM: []dkimResult{{Domain: "example.org", Err: "bad signature"}}}.SenderAuthenticated())
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Outbound TLS is opportunistic: STARTTLS is used when offered, without
+// checking the certificate. Domains can require authenticated TLS by
+// publishing DANE TLSA records (RFC 7672) for their mail exchangers, or an
+// MTA-STS policy (RFC 8461). DANE takes precedence over MTA-STS.
+
+const (
+	policyDANE   = "dane"
+	policyMTASTS = "mta-sts"
+
+	// stsMaxAge caps the time an MTA-STS policy is cached (RFC 8461 §3.2)
+	stsMaxAge = 31557600 * time.Second
+	// stsMaxPolicySize is the largest MTA-STS policy we read
+	stsMaxPolicySize = 64 * 1024
+	// stsMaxCached bounds the number of domains with a cached MTA-STS policy
+	stsMaxCached = 10000
+)
+
+var errTLSRequired = errors.New("tls: server does not offer STARTTLS, but the policy requires it")
+
+type tlsaRecord struct {
+	Usage, Selector, MatchingType uint8
+	Data                          []byte
+}
+
+// tlsaResolver looks up TLSA records, telling if they were DNSSEC validated
+type tlsaResolver interface {
+	LookupTLSA(ctx context.Context, name string) (records []tlsaRecord, secure bool, err error)
+	// SecureMX tells if the MX records of the domain, or their absence, were
+	// DNSSEC validated
+	SecureMX(ctx context.Context, domain string) (bool, error)
+}
+
+// stsPolicy is an MTA-STS policy of a domain
+type stsPolicy struct {
+	ID   string
+	Mode string
+	MX   []string
+	// Expires is when the cached policy should no longer be used
+	Expires time.Time
+}
+
+// matches tells if the MX host matches one of the mx patterns of the policy
+func (p *stsPolicy) matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			if _, parent, ok := strings.Cut(host, "."); ok && parent == pattern[2:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsPolicies decides how to use TLS towards the mail exchangers of a domain
+type tlsPolicies struct {
+	logger *zap.Logger
+	dns    resolver
+	tlsa   tlsaResolver
+	http   *http.Client
+	// roots verifies certificates for MTA-STS, nil for the system roots
+	roots  *x509.CertPool
+	dane   bool
+	mtasts bool
+	now    func() time.Time
+	mu     sync.Mutex
+	sts    map[string]*stsPolicy
+}
+
+func newTLSPolicies(logger *zap.Logger, dns resolver) (*tlsPolicies, error) {
+	p := &tlsPolicies{
+		logger: logger,
+		dns:    dns,
+		http: &http.Client{
+			Timeout: time.Minute,
+			// Policies must be served without redirects (RFC 8461 §3.3)
+			CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		now: time.Now,
+		sts: make(map[string]*stsPolicy),
+	}
+	for _, name := range strings.Fields(*tlsPolicyNames) {
+		switch name {
+		case policyDANE:
+			p.dane = true
+		case policyMTASTS:
+			p.mtasts = true
+		default:
+			return nil, fmt.Errorf("unknown outbound tls policy %q", name)
+		}
+	}
+	if p.dane {
+		server := *daneResolver
+		if server == "" {
+			var err error
+			if server, err = systemNameserver(); err != nil {
+				return nil, errors.Wrap(err, "no DNS server for DANE, set -dane_resolver")
+			}
+		}
+		p.tlsa = &dnsTLSAResolver{server: server}
+	}
+	return p, nil
+}
+
+// domainPolicy is the MTA-STS policy to enforce for the domain, or nil
+func (p *tlsPolicies) domainPolicy(ctx context.Context, domain string) *stsPolicy {
+	if p == nil || !p.mtasts {
+		return nil
+	}
+	policy, err := p.lookupSTS(ctx, domain)
+	if err != nil {
+		p.logger.Debug("No MTA-STS policy", zap.String("domain", domain), zap.Error(err))
+	}
+	if policy == nil || policy.Mode != "enforce" {
+		return nil
+	}
+	return policy
+}
+
+// lookupSTS finds the MTA-STS policy of the domain, from the cache if its id did not change
+func (p *tlsPolicies) lookupSTS(ctx context.Context, domain string) (*stsPolicy, error) {
+	p.mu.Lock()
+	cached := p.sts[domain]
+	p.mu.Unlock()
+	if cached != nil && !p.now().Before(cached.Expires) {
+		cached = nil
+	}
+
+	txts, err := p.dns.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return cached, err
+	}
+	id := ""
+	for _, txt := range txts {
+		tags := parseTags(txt)
+		if tags["v"] == "STSv1" {
+			id = tags["id"]
+		}
+	}
+	if id == "" {
+		return cached, nil
+	}
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+
+	policy, err := p.fetchSTS(ctx, domain)
+	if err != nil {
+		return cached, err
+	}
+	policy.ID = id
+	p.cacheSTS(domain, policy)
+	return policy, nil
+}
+
+// cacheSTS keeps the policy of the domain. A full cache first drops the
+// expired policies, then the policy that expires first.
+func (p *tlsPolicies) cacheSTS(domain string, policy *stsPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.sts[domain]; !ok && len(p.sts) >= stsMaxCached {
+		now := p.now()
+		first := ""
+		for d, cached := range p.sts {
+			if !now.Before(cached.Expires) {
+				delete(p.sts, d)
+			} else if first == "" || cached.Expires.Before(p.sts[first].Expires) {
+				first = d
+			}
+		}
+		if len(p.sts) >= stsMaxCached {
+			delete(p.sts, first)
+		}
+	}
+	p.sts[domain] = policy
+}
+
+func (p *tlsPolicies) fetchSTS(ctx context.Context, domain string) (*stsPolicy, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mta-sts: policy of %s returned %s", domain, res.Status)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		return nil, fmt.Errorf("mta-sts: policy of %s is not text/plain", domain)
+	}
+	return parseSTSPolicy(io.LimitReader(res.Body, stsMaxPolicySize), p.now())
+}
+
+func parseSTSPolicy(r io.Reader, now time.Time) (*stsPolicy, error) {
+	policy := &stsPolicy{}
+	var version string
+	var maxAge time.Duration
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = value
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("mta-sts: invalid max_age %q", value)
+			}
+			maxAge = time.Duration(seconds) * time.Second
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if version != "STSv1" {
+		return nil, fmt.Errorf("mta-sts: unsupported version %q", version)
+	}
+	switch policy.Mode {
+	case "enforce", "testing":
+		if len(policy.MX) == 0 {
+			return nil, errors.New("mta-sts: policy without mx")
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("mta-sts: invalid mode %q", policy.Mode)
+	}
+	if maxAge > stsMaxAge {
+		maxAge = stsMaxAge
+	}
+	policy.Expires = now.Add(maxAge)
+	return policy, nil
+}
+
+// secureMX tells if DANE applies to the mail exchangers of the domain: only
+// MX records that were DNSSEC validated lead to TLSA records (RFC 7672 §2.2)
+func (p *tlsPolicies) secureMX(ctx context.Context, domain string) (bool, error) {
+	if p == nil || !p.dane {
+		return false, nil
+	}
+	secure, err := p.tlsa.SecureMX(ctx, domain)
+	if err != nil {
+		// A failing DNSSEC lookup may hide the validated MX records
+		return false, errors.Wrap(err, "dane: failed to lookup MX")
+	}
+	return secure, nil
+}
+
+// hostConfig is the TLS configuration to connect to the MX host, and if TLS
+// is required. TLSA records are only looked up when the MX records were secure.
+func (p *tlsPolicies) hostConfig(ctx context.Context, host string, port int, mxSecure bool, sts *stsPolicy) (*tls.Config, bool, error) {
+	if p != nil && p.dane && mxSecure {
+		records, secure, err := p.tlsa.LookupTLSA(ctx, fmt.Sprintf("_%d._tcp.%s", port, host))
+		if err != nil && !isNotFound(err) {
+			// A failing DNSSEC lookup may hide TLSA records (RFC 7672 §2.2)
+			return nil, false, errors.Wrap(err, "dane: failed to lookup TLSA")
+		}
+		if secure && len(records) > 0 {
+			return &tls.Config{
+				ServerName:         host,
+				InsecureSkipVerify: true,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					return verifyDANE(cs.PeerCertificates, records, host)
+				},
+			}, true, nil
+		}
+	}
+	if sts != nil {
+		return &tls.Config{ServerName: host, RootCAs: p.roots}, true, nil
+	}
+	// Opportunistic (RFC 7435): any encryption beats none
+	return &tls.Config{ServerName: host, InsecureSkipVerify: true}, false, nil
+}
+
+// verifyDANE checks the certificates of the server against usable TLSA records:
+// DANE-EE (3) matches the server certificate, DANE-TA (2) a trust anchor in the chain
+func verifyDANE(certs []*x509.Certificate, records []tlsaRecord, host string) error {
+	if len(certs) == 0 {
+		return errors.New("dane: no certificates")
+	}
+	usable := false
+	for _, rec := range records {
+		switch rec.Usage {
+		case 3:
+			usable = true
+			if rec.matches(certs[0]) {
+				return nil
+			}
+		case 2:
+			usable = true
+			for _, ta := range certs[1:] {
+				if !rec.matches(ta) {
+					continue
+				}
+				roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+				roots.AddCert(ta)
+				for _, cert := range certs[1:] {
+					intermediates.AddCert(cert)
+				}
+				if _, err := certs[0].Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates}); err == nil {
+					return nil
+				}
+			}
+		}
+	}
+	if !usable {
+		// Only PKIX usages, which are not used with SMTP (RFC 7672 §3.1.3): encrypt unauthenticated
+		return nil
+	}
+	return fmt.Errorf("dane: no TLSA record of %s matches the certificate", host)
+}
+
+func (rec tlsaRecord) matches(cert *x509.Certificate) bool {
+	data := cert.Raw
+	if rec.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch rec.MatchingType {
+	case 0:
+		return bytes.Equal(data, rec.Data)
+	case 1:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], rec.Data)
+	case 2:
+		sum := sha512.Sum512(data)
+		return bytes.Equal(sum[:], rec.Data)
+	}
+	return false
+}
+
+// dnsTLSAResolver queries TLSA records from a DNSSEC validating resolver,
+// trusting its AD bit: it must be local or reached over a trusted network
+type dnsTLSAResolver struct {
+	server string
+}
+
+const typeTLSA = dnsmessage.Type(52)
+
+func (r *dnsTLSAResolver) LookupTLSA(ctx context.Context, name string) ([]tlsaRecord, bool, error) {
+	answer, err := r.query(ctx, name, typeTLSA)
+	if err != nil {
+		return nil, answer != nil && answer.AuthenticData, err
+	}
+
+	var records []tlsaRecord
+	for _, res := range answer.Answers {
+		body, ok := res.Body.(*dnsmessage.UnknownResource)
+		if res.Header.Type != typeTLSA || !ok || len(body.Data) < 3 {
+			continue
+		}
+		records = append(records, tlsaRecord{Usage: body.Data[0], Selector: body.Data[1], MatchingType: body.Data[2], Data: body.Data[3:]})
+	}
+	return records, answer.AuthenticData, nil
+}
+
+func (r *dnsTLSAResolver) SecureMX(ctx context.Context, domain string) (bool, error) {
+	answer, err := r.query(ctx, domain, dnsmessage.TypeMX)
+	if answer == nil {
+		return false, err
+	}
+	// Records that do not exist are secure when their absence is
+	return answer.AuthenticData, nil
+}
+
+// query asks the resolver for the records of the name with the DNSSEC OK bit.
+// A name that does not exist is reported with the answer.
+func (r *dnsTLSAResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 2)
+	if _, err = crand.Read(id); err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: binary.BigEndian.Uint16(id), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	var opt dnsmessage.ResourceHeader
+	if err = opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, err
+	}
+	msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := r.exchange(ctx, "udp", query)
+	if err == nil && answer.Truncated {
+		answer, err = r.exchange(ctx, "tcp", query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if answer.ID != msg.ID {
+		return nil, errors.New("dane: DNS answer id mismatch")
+	}
+	switch answer.RCode {
+	case dnsmessage.RCodeSuccess:
+		return answer, nil
+	case dnsmessage.RCodeNameError:
+		return answer, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil, &net.DNSError{Err: answer.RCode.String(), Name: name, IsTemporary: true}
+}
+
+func (r *dnsTLSAResolver) exchange(ctx context.Context, network string, query []byte) (*dnsmessage.Message, error) {
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, network, r.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length
+		if _, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(buf[:2]))
+		if _, err = io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+	}
+	var answer dnsmessage.Message
+	return &answer, answer.Unpack(buf[:n])
+}
+
+// systemNameserver is the first nameserver of /etc/resolv.conf
+func systemNameserver() (string, error) {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrj/smtpd"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeTLSA struct {
+	records    map[string][]tlsaRecord
+	insecureMX map[string]bool
+}
+
+func (r fakeTLSA) LookupTLSA(ctx context.Context, name string) ([]tlsaRecord, bool, error) {
+	if records, ok := r.records[name]; ok {
+		return records, true, nil
+	}
+	return nil, true, notFound(name)
+}
+
+func (r fakeTLSA) SecureMX(ctx context.Context, domain string) (bool, error) {
+	return !r.insecureMX[domain], nil
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestParseSTSPolicy(t *testing.T) {
+	now := time.Now()
+	policy, err := parseSTSPolicy(strings.NewReader("version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n"), now)
+	assert.NoError(t, err)
+	assert.Equal(t, "enforce", policy.Mode)
+	assert.Equal(t, now.Add(24*time.Hour), policy.Expires)
+	assert.True(t, policy.matches("mail.example.com."))
+	assert.True(t, policy.matches("MX1.example.net"))
+	assert.False(t, policy.matches("a.mx1.example.net"))
+	assert.False(t, policy.matches("example.net"))
+
+	_, err = parseSTSPolicy(strings.NewReader("version: STSv1\nmode: enforce\nmax_age: 86400\n"), now)
+	assert.Error(t, err)
+	_, err = parseSTSPolicy(strings.NewReader("version: STSv2\nmode: none\n"), now)
+	assert.Error(t, err)
+}
+
+func TestLookupSTS(t *testing.T) {
+	dns := fakeResolver{txt: map[string][]string{"_mta-sts.example.com": {"v=STSv1; id=1"}}}
+	fetches := 0
+	body := "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 3600\n"
+	p := &tlsPolicies{
+		logger: zap.NewNop(),
+		dns:    dns,
+		mtasts: true,
+		http: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			assert.Equal(t, "https://mta-sts.example.com/.well-known/mta-sts.txt", req.URL.String())
+			fetches++
+			if body == "" {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain; charset=utf-8"}}, Body: io.NopCloser(strings.NewReader(body))}, nil
+		})},
+		now: time.Now,
+		sts: map[string]*stsPolicy{},
+	}
+	ctx := context.Background()
+
+	policy := p.domainPolicy(ctx, "example.com")
+	assert.NotNil(t, policy)
+	assert.Equal(t, []string{"mail.example.com"}, policy.MX)
+	assert.Nil(t, p.domainPolicy(ctx, "example.org"))
+
+	// Cached until the id changes
+	p.domainPolicy(ctx, "example.com")
+	assert.Equal(t, 1, fetches)
+	dns.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	body = "version: STSv1\nmode: testing\nmx: mail.example.com\nmax_age: 3600\n"
+	assert.Nil(t, p.domainPolicy(ctx, "example.com"), "testing mode is not enforced")
+	assert.Equal(t, 2, fetches)
+
+	// A failing fetch keeps using the cached policy until it expires
+	dns.txt["_mta-sts.example.com"] = []string{"v=STSv1; id=3"}
+	body = ""
+	policy, err := p.lookupSTS(ctx, "example.com")
+	assert.Error(t, err)
+	assert.Equal(t, "2", policy.ID)
+	p.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	policy, _ = p.lookupSTS(ctx, "example.com")
+	assert.Nil(t, policy)
+}
+
+func TestCacheSTS(t *testing.T) {
+	now := time.Now()
+	p := &tlsPolicies{now: func() time.Time { return now }, sts: map[string]*stsPolicy{}}
+	for i := 0; i < stsMaxCached; i++ {
+		p.cacheSTS(fmt.Sprintf("%d.example.com", i), &stsPolicy{Expires: now.Add(time.Duration(i+1) * time.Hour)})
+	}
+	p.sts["0.example.com"].Expires = now
+	p.sts["1.example.com"].Expires = now
+
+	// Expired policies make room first
+	p.cacheSTS("a.example.com", &stsPolicy{Expires: now.Add(90 * time.Minute)})
+	assert.Len(t, p.sts, stsMaxCached-1)
+	assert.NotContains(t, p.sts, "1.example.com")
+	p.cacheSTS("b.example.com", &stsPolicy{Expires: now.Add(90 * time.Minute)})
+	p.cacheSTS("2.example.com", &stsPolicy{Expires: now.Add(time.Hour)})
+	assert.Len(t, p.sts, stsMaxCached)
+
+	// Then the policy that expires first
+	p.cacheSTS("c.example.com", &stsPolicy{Expires: now.Add(time.Hour)})
+	assert.Len(t, p.sts, stsMaxCached)
+	assert.Contains(t, p.sts, "c.example.com")
+	assert.NotContains(t, p.sts, "2.example.com")
+}
+
+func testCertificate(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	cert, err := genX509KeyPair()
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	return cert, leaf
+}
+
+func TestVerifyDANE(t *testing.T) {
+	_, leaf := testCertificate(t)
+	_, other := testCertificate(t)
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	assert.NoError(t, verifyDANE([]*x509.Certificate{leaf}, []tlsaRecord{{3, 1, 1, spki[:]}}, "mx.example.com"))
+	assert.NoError(t, verifyDANE([]*x509.Certificate{leaf}, []tlsaRecord{{3, 0, 0, other.Raw}, {3, 0, 0, leaf.Raw}}, "mx.example.com"))
+	assert.Error(t, verifyDANE([]*x509.Certificate{other}, []tlsaRecord{{3, 1, 1, spki[:]}}, "mx.example.com"))
+	assert.Error(t, verifyDANE([]*x509.Certificate{other, leaf}, []tlsaRecord{{2, 1, 1, spki[:]}}, "mx.example.com"), "leaf not signed by trust anchor")
+	assert.NoError(t, verifyDANE([]*x509.Certificate{other}, []tlsaRecord{{1, 1, 1, spki[:]}}, "mx.example.com"), "PKIX usages are unusable")
+}
+
+func TestDelivererTLSPolicy(t *testing.T) {
+	cert, leaf := testCertificate(t)
+	var received []smtpd.Envelope
+	server := &smtpd.Server{
+		Hostname:  "mx.example.net",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Handler: func(peer smtpd.Peer, env smtpd.Envelope) error {
+			if peer.TLS == nil {
+				return smtpd.Error{Code: 530, Message: "5.7.0 Must issue a STARTTLS command first"}
+			}
+			received = append(received, env)
+			return nil
+		},
+	}
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go server.Serve(lsnr)
+	defer server.Shutdown(false)
+
+	spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	tlsa := fakeTLSA{
+		records: map[string][]tlsaRecord{
+			"_25._tcp.mx.example.net": {{3, 1, 1, spki[:]}},
+			"_25._tcp.mx.example.org": {{3, 1, 1, make([]byte, 32)}},
+		},
+		insecureMX: map[string]bool{"example.edu": true},
+	}
+	dns := fakeResolver{
+		ip: map[string][]string{"mx.example.net": {"192.0.2.1"}, "mx.example.org": {"192.0.2.1"}, "example.com": {"192.0.2.1"}},
+		mx: map[string][]*net.MX{"example.net": {{Host: "mx.example.net", Pref: 10}}, "example.org": {{Host: "mx.example.org", Pref: 10}}, "example.edu": {{Host: "mx.example.org", Pref: 10}}},
+	}
+	d := &deliverer{
+		logger:   zap.NewNop(),
+		hostname: "mail.example.com",
+		dns:      dns,
+		ports:    []int{25},
+		dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial(network, lsnr.Addr().String())
+		},
+		tls: &tlsPolicies{logger: zap.NewNop(), dns: dns, dane: true, tlsa: tlsa},
+	}
+
+	results := d.Deliver(context.Background(), smtpd.Envelope{
+		Sender:     "herman@example.com",
+		Recipients: []string{"a@example.net", "b@example.org", "c@example.com", "d@example.edu"},
+		Data:       []byte("Subject: Hi\r\n\r\nHello\r\n"),
+	})
+	assert.Len(t, results, 4)
+	assert.NoError(t, results[0].Err, "DANE match")
+	assert.Error(t, results[1].Err, "DANE mismatch")
+	assert.True(t, temporaryFailure(results[1].Err))
+	assert.NoError(t, results[2].Err, "opportunistic")
+	assert.NoError(t, results[3].Err, "TLSA of an MX that is not DNSSEC validated is not used")
+	assert.Len(t, received, 3)
+}
+
+func TestDNSTLSAResolver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			answer := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, AuthenticData: true},
+				Questions: query.Questions,
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: typeTLSA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.UnknownResource{Type: typeTLSA, Data: []byte{3, 1, 1, 0xab, 0xcd}},
+				}},
+			}
+			switch query.Questions[0].Name.String() {
+			case "_25._tcp.mx.example.net.":
+			case "example.net.":
+				// Secure, but without MX records for brevity
+				answer.Answers = nil
+			default:
+				answer.AuthenticData = false
+				answer.RCode = dnsmessage.RCodeNameError
+				answer.Answers = nil
+			}
+			out, _ := answer.Pack()
+			conn.WriteTo(out, addr)
+		}
+	}()
+
+	r := &dnsTLSAResolver{server: conn.LocalAddr().String()}
+	records, secure, err := r.LookupTLSA(context.Background(), "_25._tcp.mx.example.net")
+	assert.NoError(t, err)
+	assert.True(t, secure)
+	assert.Equal(t, []tlsaRecord{{3, 1, 1, []byte{0xab, 0xcd}}}, records)
+
+	_, _, err = r.LookupTLSA(context.Background(), "_25._tcp.mx.example.org")
+	assert.True(t, isNotFound(err))
+
+	secure, err = r.SecureMX(context.Background(), "example.net")
+	assert.NoError(t, err)
+	assert.True(t, secure)
+	secure, err = r.SecureMX(context.Background(), "example.org")
+	assert.NoError(t, err)
+	assert.False(t, secure)
+}
@@ -81,7 +81,8 @@ const handlePaymentIntentSucceeded = async (paymentIntent: any) => {
         const response = await bent(
           `https://mail.pay2mail.me`,
           "POST",
-          "json"
+          "json",
+          { Authorization: `Bearer ${process.env.RELEASE_SECRET}` }
         )(`/paid/${mailbox.id.split("@")[0]}/${email.id}`, {
           recipient: mailbox.id,
           emailId: email.id,